@@ -2,13 +2,17 @@ package cc.bran.bnotify;
 
 import com.google.firebase.messaging.FirebaseMessagingService;
 import android.app.Notification;
+import android.app.NotificationChannel;
 import android.app.NotificationManager;
+import android.app.PendingIntent;
 import android.content.Context;
+import android.content.Intent;
 import android.content.SharedPreferences;
 import android.database.Cursor;
 import android.database.SQLException;
 import android.database.sqlite.SQLiteDatabase;
 import android.database.sqlite.SQLiteOpenHelper;
+import android.net.Uri;
 import android.util.Base64;
 import android.util.Log;
 
@@ -110,8 +114,13 @@ public class FcmListenerService extends FirebaseMessagingService {
         BNotifyProtos.Message message = BNotifyProtos.Message.parseFrom(messageBytes);
 
         if (checkSeq(message)) {
-          showNotification(message.getNotification().getTitle(),
-              message.getNotification().getText());
+          BNotifyProtos.Notification notification = message.getNotification();
+          if (notification.getSilent()) {
+            // Silent notifications only wake the app; they are never displayed.
+            Log.i(LOG_TAG, "Received silent notification with data " + notification.getDataMap());
+          } else {
+            showNotification(notification);
+          }
         }
       }
     } catch (IOException | NoSuchAlgorithmException | InvalidKeySpecException
@@ -141,19 +150,54 @@ public class FcmListenerService extends FirebaseMessagingService {
   }
 
   private void showNotification(String title, String text) {
+    showNotification(BNotifyProtos.Notification.newBuilder()
+        .setTitle(title)
+        .setText(text)
+        .build());
+  }
+
+  private void showNotification(BNotifyProtos.Notification notification) {
     NotificationManager notificationManager =
         (NotificationManager) getSystemService(Context.NOTIFICATION_SERVICE);
 
     int notificationId = getNextNotificationId();
-    Notification notification = new Notification.Builder(this, NOTIFICATION_CHANNEL_ID)
+    Notification.Builder builder = new Notification.Builder(this,
+            getChannelId(notificationManager, notification.getCategory()))
         .setSmallIcon(R.drawable.logo_white)
-        .setContentTitle(title)
+        .setContentTitle(notification.getTitle())
         .setStyle(new Notification.BigTextStyle()
-            .bigText(text))
-        .setContentText(text)
-        .build();
+            .bigText(notification.getText()))
+        .setContentText(notification.getText())
+        .setLocalOnly(notification.getLocalOnly());
+    if (!notification.getThreadId().isEmpty()) {
+      // Notifications with the same thread ID are bundled together, beneath
+      // the group's summary.
+      builder.setGroup(notification.getThreadId())
+          .setGroupSummary(notification.getGroupSummary());
+    }
+    if (!notification.getNotificationUrl().isEmpty()) {
+      // Open the URL (or deep link) when the notification is tapped.
+      Intent intent = new Intent(Intent.ACTION_VIEW, Uri.parse(notification.getNotificationUrl()));
+      builder.setContentIntent(PendingIntent.getActivity(this, notificationId, intent, PendingIntent.FLAG_ONE_SHOT))
+          .setAutoCancel(true);
+    }
 
-    notificationManager.notify(notificationId, notification);
+    notificationManager.notify(notificationId, builder.build());
+  }
+
+  private String getChannelId(NotificationManager notificationManager, String category) {
+    if (category.isEmpty()) {
+      return NOTIFICATION_CHANNEL_ID;
+    }
+
+    // Each category gets its own channel, created on first use, so that it can
+    // be configured separately in the system settings.
+    String channelId = NOTIFICATION_CHANNEL_ID + "_" + category;
+    if (notificationManager.getNotificationChannel(channelId) == null) {
+      notificationManager.createNotificationChannel(
+          new NotificationChannel(channelId, category, NotificationManager.IMPORTANCE_DEFAULT));
+    }
+    return channelId;
   }
 
   private SecretKey getKey() throws NoSuchAlgorithmException, InvalidKeySpecException {
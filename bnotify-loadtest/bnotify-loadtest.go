@@ -0,0 +1,239 @@
+// bnotify-loadtest measures the throughput of a running bnotifyd instance.
+//
+// Every request sends a real notification, so this should be run against an
+// instance started with --test-mode or --echo rather than one that delivers
+// to a device.
+package main
+
+import (
+	pb "../proto"
+
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+)
+
+var (
+	host        = flag.String("host", "localhost:50051", "address of host")
+	rps         = flag.Float64("rps", 100, "target requests per second across all workers (0 for unlimited)")
+	duration    = flag.Duration("duration", 30*time.Second, "how long to run the test for")
+	concurrency = flag.Int("concurrency", 10, "number of concurrent workers")
+	csvFilename = flag.String("csv", "", "if set, filename to write per-second metrics to, as CSV")
+)
+
+// second holds the metrics collected during one second of the test.
+type second struct {
+	latencies    []time.Duration // of successful requests
+	errors       int
+	pendingCount int64 // -1 if not sampled
+}
+
+// recorder collects metrics, bucketed by second since the start of the test.
+type recorder struct {
+	start time.Time
+
+	mu      sync.Mutex
+	seconds []*second
+}
+
+func newRecorder(start time.Time) *recorder {
+	return &recorder{start: start}
+}
+
+// at returns the bucket for the given time. r.mu must be held.
+func (r *recorder) at(t time.Time) *second {
+	i := int(t.Sub(r.start) / time.Second)
+	for len(r.seconds) <= i {
+		r.seconds = append(r.seconds, &second{pendingCount: -1})
+	}
+	return r.seconds[i]
+}
+
+func (r *recorder) recordRequest(t time.Time, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.at(t)
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+func (r *recorder) recordPendingCount(t time.Time, pendingCount int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.at(t).pendingCount = pendingCount
+}
+
+func main() {
+	flag.Parse()
+	if *concurrency < 1 {
+		log.Fatalf("--concurrency must be at least 1")
+	}
+	if *duration <= 0 {
+		log.Fatalf("--duration must be positive")
+	}
+
+	conn, err := grpc.Dial(*host, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Error connecting to bnotifyd: %v", err)
+	}
+	defer conn.Close()
+	ns := pb.NewNotificationServiceClient(conn)
+
+	limit := rate.Inf
+	if *rps > 0 {
+		limit = rate.Limit(*rps)
+	}
+	limiter := rate.NewLimiter(limit, 1)
+
+	log.Printf("Sending to %s at up to %v requests/second with %d worker(s) for %v", *host, *rps, *concurrency, *duration)
+	start := time.Now()
+	rec := newRecorder(start)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+				reqStart := time.Now()
+				_, err := ns.SendNotification(ctx, &pb.SendNotificationRequest{
+					Notification: &pb.Notification{
+						Title: "bnotify-loadtest",
+						Text:  fmt.Sprintf("Load test message %d from worker %d", n, worker),
+					},
+				})
+				if err != nil && ctx.Err() != nil {
+					// Cut off by the end of the test; don't count it.
+					return
+				}
+				rec.recordRequest(reqStart, time.Since(reqStart), err)
+			}
+		}(i)
+	}
+
+	// Sample queue depth once per second.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-ticker.C:
+				resp, err := ns.GetStatus(ctx, &pb.GetStatusRequest{})
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Error during GetStatus RPC: %v", err)
+					}
+					continue
+				}
+				rec.recordPendingCount(t, resp.PendingCount)
+			}
+		}
+	}()
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	printSummary(rec, elapsed)
+	if *csvFilename != "" {
+		if err := writeCSV(*csvFilename, rec); err != nil {
+			log.Fatalf("Error writing CSV: %v", err)
+		}
+	}
+}
+
+func printSummary(rec *recorder, elapsed time.Duration) {
+	var latencies []time.Duration
+	var errors int
+	var maxPending int64 = -1
+	for _, s := range rec.seconds {
+		latencies = append(latencies, s.latencies...)
+		errors += s.errors
+		if s.pendingCount > maxPending {
+			maxPending = s.pendingCount
+		}
+	}
+	total := len(latencies) + errors
+	sortDurations(latencies)
+
+	fmt.Printf("Requests:     %d in %v\n", total, elapsed)
+	fmt.Printf("Achieved RPS: %.1f\n", float64(total)/elapsed.Seconds())
+	if total > 0 {
+		fmt.Printf("Errors:       %d (%.2f%%)\n", errors, 100*float64(errors)/float64(total))
+	}
+	fmt.Printf("Latency:      p50=%v p95=%v p99=%v\n", percentile(latencies, 50), percentile(latencies, 95), percentile(latencies, 99))
+	if maxPending >= 0 {
+		fmt.Printf("Max pending:  %d\n", maxPending)
+	}
+}
+
+func writeCSV(filename string, rec *recorder) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"second", "requests", "errors", "p50_ms", "p95_ms", "p99_ms", "pending_count"})
+	for i, s := range rec.seconds {
+		sortDurations(s.latencies)
+		pending := ""
+		if s.pendingCount >= 0 {
+			pending = strconv.FormatInt(s.pendingCount, 10)
+		}
+		w.Write([]string{
+			strconv.Itoa(i),
+			strconv.Itoa(len(s.latencies) + s.errors),
+			strconv.Itoa(s.errors),
+			millis(percentile(s.latencies, 50)),
+			millis(percentile(s.latencies, 95)),
+			millis(percentile(s.latencies, 99)),
+			pending,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortDurations(ds []time.Duration) {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+}
+
+// percentile returns the pth percentile of the given sorted durations, or 0 if there are none.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	pb "../proto"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	adminToken     = flag.String("admin-token", "", "admin token for administrative subcommands (default $BNOTIFY_ADMIN_TOKEN)")
+	registrationID = flag.String("registration-id", "", "update-registration-id: the new registration ID; decode: the registration ID the payload was encrypted for")
+	totpCode       = flag.String("totp-code", "", "current TOTP code, for administrative subcommands if bnotifyd requires one")
+)
+
+// adminContext returns a context carrying the admin token (& TOTP code, if
+// given), for administrative RPCs.
+func adminContext() context.Context {
+	token := *adminToken
+	if token == "" {
+		token = os.Getenv("BNOTIFY_ADMIN_TOKEN")
+	}
+	if token == "" {
+		log.Fatalf("--admin-token or $BNOTIFY_ADMIN_TOKEN is required")
+	}
+	md := metadata.Pairs("bnotify-admin-token", token)
+	if *totpCode != "" {
+		md.Set("x-totp-code", *totpCode)
+	}
+	return metadata.NewOutgoingContext(context.Background(), md)
+}
+
+func updateRegistrationID() {
+	if *registrationID == "" {
+		log.Fatalf("--registration-id is required")
+	}
+	ctx := adminContext()
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.UpdateRegistrationID(ctx, &pb.UpdateRegIDRequest{NewRegistrationId: *registrationID})
+	if err != nil {
+		log.Fatalf("Error during UpdateRegistrationID RPC: %v", err)
+	}
+	fmt.Printf("Updated registration ID; re-encrypted %d pending message(s)\n", resp.ReencryptedCount)
+}
@@ -3,47 +3,459 @@ package main
 import (
 	pb "../proto"
 
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 var (
-	host  = flag.String("host", "localhost:50051", "address of host")
-	title = flag.String("title", "", "title to send in notification")
-	text  = flag.String("text", "", "text to send in notification")
+	host             = flag.String("host", "localhost:50051", "address of host")
+	title            = flag.String("title", "", "title to send in notification")
+	text             = flag.String("text", "", "text to send in notification")
+	waitForReady     = flag.Duration("wait-for-ready", 0, "if nonzero, wait up to this long for bnotifyd to become reachable (e.g. while it restarts) rather than failing immediately")
+	keepaliveTime    = flag.Duration("keepalive-time", 30*time.Second, "how long the connection to bnotifyd may be idle before it is checked with a keepalive ping")
+	keepaliveTimeout = flag.Duration("keepalive-timeout", 10*time.Second, "how long to wait for a keepalive ping response before closing the connection")
+	wait             = flag.Duration("wait", 0, "if nonzero, wait up to this long for the notification to be sent to FCM before exiting")
+	configDir        = flag.String("config-dir", "", "directory containing the client configuration file (default $XDG_CONFIG_HOME/bnotify)")
+	priority         = flag.String("priority", "normal", "scheduling priority of the notification: critical, high, normal, or low")
+	silent           = flag.Bool("silent", false, "send a silent notification, which is not displayed but wakes the app (e.g. to sync); --title & --text are optional")
+	category         = flag.String("category", "", "category of the notification, which the app may use to choose a notification channel")
+	threadID         = flag.String("thread-id", "", "identifier of the thread the notification belongs to, used by the app to group related notifications")
+	notificationURL  = flag.String("url", "", "URL or app deep link to open when the notification is tapped")
+	delayWhileIdle   = flag.Bool("delay-while-idle", false, "hold the notification until the device is active rather than delivering it immediately, to save battery (deprecated by FCM, which may ignore it)")
+	localOnly        = flag.Bool("local-only", false, "show the notification only on the phone, without bridging it to connected Wear OS devices")
+	data             = dataFlag{}
+	verbose          = flag.Bool("v", false, "print the ID & encoded payload size of each sent notification")
+	file             = flag.String("file", "", "file containing notification(s) to send, as JSON or textproto (- for stdin); explicitly passed flags override values from the file")
+	refreshConfig    = flag.Bool("refresh-config", false, "before running the subcommand (if any), fetch the client configuration from bnotifyd & rewrite the configuration file if it changed; requires the admin token")
+)
+
+func init() {
+	flag.Var(data, "data", "key=value data to send to the app with the notification; may be repeated")
+}
+
+const (
+	// textprotoSeparator separates multiple notifications in a single textproto file.
+	textprotoSeparator = "---"
+
+	// waitPollInterval is how often notification status is polled when --wait is specified.
+	waitPollInterval = time.Second
 )
 
 // TODO(bran): add retry
 func main() {
-	// Parse & verify flags.
+	// Parse flags & determine subcommand. Flags may be given either before or after the subcommand.
 	flag.Parse()
-	if *title == "" {
-		log.Fatalf("--title is required")
+	cmd := nextArg()
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error reading configuration: %v", err)
+	}
+	if *refreshConfig {
+		refreshConfigFile()
+		if cmd == "" {
+			return
+		}
+	}
+	if cmd == "" {
+		cmd = "send"
+	}
+
+	switch cmd {
+	case "send":
+		send()
+	case "mute":
+		switch subcmd := nextArg(); subcmd {
+		case "add":
+			muteAdd()
+		case "list":
+			muteList()
+		case "remove":
+			muteRemove()
+		default:
+			log.Fatalf("Unknown mute subcommand %q", subcmd)
+		}
+	case "update-registration-id":
+		updateRegistrationID()
+	case "tail":
+		tail()
+	case "test":
+		testNotification()
+	case "group":
+		group()
+	case "resend":
+		resend()
+	case "decode":
+		decode()
+	case "describe":
+		describe()
+	case "check":
+		switch subcmd := nextArg(); subcmd {
+		case "ping":
+			checkPing()
+		default:
+			log.Fatalf("Unknown check subcommand %q", subcmd)
+		}
+	case "pending":
+		switch subcmd := nextArg(); subcmd {
+		case "list":
+			pendingList()
+		default:
+			log.Fatalf("Unknown pending subcommand %q", subcmd)
+		}
+	case "history":
+		switch subcmd := nextArg(); subcmd {
+		case "export":
+			historyExport()
+		case "check":
+			historyCheck()
+		case "purge-plaintext":
+			historyPurgePlaintext()
+		default:
+			log.Fatalf("Unknown history subcommand %q", subcmd)
+		}
+	case "enrich":
+		switch subcmd := nextArg(); subcmd {
+		case "preview":
+			enrichPreview()
+		default:
+			log.Fatalf("Unknown enrich subcommand %q", subcmd)
+		}
+	case "config":
+		switch subcmd := nextArg(); subcmd {
+		case "init":
+			configInit()
+		default:
+			log.Fatalf("Unknown config subcommand %q", subcmd)
+		}
+	default:
+		log.Fatalf("Unknown subcommand %q", cmd)
 	}
-	if *text == "" {
-		log.Fatalf("--text is required")
+}
+
+// nextArg pops the next positional argument, parsing any flags that follow
+// it. It returns "" if there are no more positional arguments.
+func nextArg() string {
+	if flag.NArg() == 0 {
+		return ""
+	}
+	arg := flag.Arg(0)
+	flag.CommandLine.Parse(flag.Args()[1:])
+	return arg
+}
+
+func send() {
+	// Figure out which notifications to send.
+	var requests []*pb.SendNotificationRequest
+	if *file != "" {
+		reqs, err := readNotificationFile(*file)
+		if err != nil {
+			log.Fatalf("Error reading notification file: %v", err)
+		}
+		requests = reqs
+	} else {
+		requests = []*pb.SendNotificationRequest{{Notification: &pb.Notification{}}}
+	}
+	for _, req := range requests {
+		applyRequestFlags(req)
+	}
+
+	// Verify notifications before sending anything.
+	for i, req := range requests {
+		if err := validateNotification(req.Notification); err != nil {
+			if len(requests) == 1 {
+				log.Fatalf("%v", err)
+			}
+			log.Fatalf("Notification %d: %v", i+1, err)
+		}
 	}
 
 	// Connect to RPC server.
-	conn, err := grpc.Dial(*host, grpc.WithInsecure())
+	release := beforeConnect()
+	defer release()
+	conn, ns := dial()
+	defer conn.Close()
+
+	// Make requests.
+	if len(requests) == 1 {
+		resp, err := sendNotification(ns, requests[0])
+		if err != nil {
+			log.Fatalf("Error during SendNotification RPC: %s", describeError(err))
+		}
+		if *verbose {
+			fmt.Printf("Notification %s (payload size: %d bytes)\n", resp.NotificationId, resp.PayloadSize)
+		}
+		if *wait > 0 {
+			waitForSend(ns, resp.NotificationId)
+		}
+		return
+	}
+	var failed int
+	for i, req := range requests {
+		n := req.Notification
+		resp, err := sendNotification(ns, req)
+		if err != nil {
+			fmt.Printf("[%d/%d] FAILED %q: %s\n", i+1, len(requests), n.Title, describeError(err))
+			failed++
+			continue
+		}
+		if *verbose {
+			fmt.Printf("[%d/%d] OK %q (%s, payload size: %d bytes)\n", i+1, len(requests), n.Title, resp.NotificationId, resp.PayloadSize)
+			continue
+		}
+		fmt.Printf("[%d/%d] OK %q\n", i+1, len(requests), n.Title)
+	}
+	fmt.Printf("Sent %d of %d notifications (%d failed)\n", len(requests)-failed, len(requests), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// dial connects to bnotifyd.
+func dial() (*grpc.ClientConn, pb.NotificationServiceClient) {
+	conn, err := grpc.Dial(*host, grpc.WithInsecure(), grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                *keepaliveTime,
+		Timeout:             *keepaliveTimeout,
+		PermitWithoutStream: true,
+	}))
 	if err != nil {
 		log.Fatalf("Error connecting to bnotifyd: %v", err)
 	}
-	defer conn.Close()
-	ns := pb.NewNotificationServiceClient(conn)
+	return conn, pb.NewNotificationServiceClient(conn)
+}
+
+// sendNotification makes a SendNotification RPC, waiting for the server to
+// become reachable if requested by --wait-for-ready.
+func sendNotification(ns pb.NotificationServiceClient, req *pb.SendNotificationRequest) (*pb.SendNotificationResponse, error) {
+	ctx := context.Background()
+	var opts []grpc.CallOption
+	if *waitForReady > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *waitForReady)
+		defer cancel()
+		opts = append(opts, grpc.WaitForReady(true))
+	}
+	return ns.SendNotification(ctx, req, opts...)
+}
+
+// waitForSend polls the status of the given notification until it is sent or
+// fails, or --wait elapses. It exits unsuccessfully if the notification was
+// not sent.
+func waitForSend(ns pb.NotificationServiceClient, id string) {
+	deadline := time.Now().Add(*wait)
+	for {
+		resp, err := ns.GetNotificationStatus(context.Background(), &pb.StatusRequest{NotificationId: id})
+		if err != nil {
+			log.Fatalf("Error during GetNotificationStatus RPC: %v", err)
+		}
+		switch resp.Status {
+		case pb.StatusResponse_SENT, pb.StatusResponse_ACKNOWLEDGED:
+			return
+		case pb.StatusResponse_FAILED:
+			log.Fatalf("Notification %s could not be sent", id)
+		}
+		if time.Now().After(deadline) {
+			log.Fatalf("Timed out waiting for notification %s to be sent (status: %v)", id, resp.Status)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// applyRequestFlags overwrites fields of the given request, including its
+// notification, with any explicitly passed flags.
+func applyRequestFlags(req *pb.SendNotificationRequest) {
+	applyFlags(req.Notification)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "priority" {
+			req.Priority = flagPriority()
+		}
+	})
+}
+
+// flagPriority returns the priority given by --priority.
+func flagPriority() pb.Priority {
+	p, ok := pb.Priority_value[strings.ToUpper(*priority)]
+	if !ok {
+		log.Fatalf("Bad --priority %q", *priority)
+	}
+	return pb.Priority(p)
+}
+
+// applyFlags overwrites fields of the given notification with any explicitly passed flags.
+func applyFlags(n *pb.Notification) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "title":
+			n.Title = *title
+		case "text":
+			n.Text = *text
+		case "silent":
+			n.Silent = *silent
+		case "category":
+			n.Category = *category
+		case "thread-id":
+			n.ThreadId = *threadID
+		case "url":
+			n.NotificationUrl = *notificationURL
+		case "delay-while-idle":
+			n.DelayWhileIdle = *delayWhileIdle
+		case "local-only":
+			n.LocalOnly = *localOnly
+		case "data":
+			if n.Data == nil {
+				n.Data = map[string]string{}
+			}
+			for k, v := range data {
+				n.Data[k] = v
+			}
+		}
+	})
+}
+
+func validateNotification(n *pb.Notification) error {
+	if n.Silent {
+		return nil
+	}
+	if n.Title == "" {
+		return fmt.Errorf("--title is required")
+	}
+	if n.Text == "" {
+		return fmt.Errorf("--text is required")
+	}
+	return nil
+}
 
-	// Make request.
-	request := &pb.SendNotificationRequest{
-		Notification: &pb.Notification{
-			Title: *title,
-			Text:  *text,
-		},
+// readNotificationFile reads one or more notification requests from the
+// given filename, or from stdin if filename is "-". JSON files contain either
+// a single object or an array of objects; textproto files contain one or more
+// documents separated by lines consisting only of "---". Each document may be
+// either a Notification or a SendNotificationRequest; all of a
+// SendNotificationRequest's fields (e.g. priority & android_config) are kept.
+func readNotificationFile(filename string) ([]*pb.SendNotificationRequest, error) {
+	var content []byte
+	var err error
+	if filename == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(filename)
 	}
-	_, err = ns.SendNotification(context.Background(), request)
 	if err != nil {
-		log.Fatalf("Error during SendNotification RPC: %v", err)
+		return nil, err
+	}
+
+	isJSON := false
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		isJSON = true
+	case ".textproto", ".pbtxt", ".txt":
+	default:
+		trimmed := strings.TrimSpace(string(content))
+		isJSON = strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+	}
+	if isJSON {
+		return parseJSONRequests(content)
+	}
+	return parseTextRequests(string(content))
+}
+
+func parseJSONRequests(content []byte) ([]*pb.SendNotificationRequest, error) {
+	var docs []json.RawMessage
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "[") {
+		if err := json.Unmarshal(content, &docs); err != nil {
+			return nil, fmt.Errorf("could not parse JSON array: %v", err)
+		}
+	} else {
+		docs = []json.RawMessage{content}
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no notifications in file")
+	}
+
+	var requests []*pb.SendNotificationRequest
+	for i, doc := range docs {
+		req, err := unmarshalRequest(string(doc), jsonpb.UnmarshalString)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse JSON document %d: %v", i+1, err)
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+func parseTextRequests(content string) ([]*pb.SendNotificationRequest, error) {
+	var docs []string
+	var doc []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == textprotoSeparator {
+			docs = append(docs, strings.Join(doc, "\n"))
+			doc = nil
+			continue
+		}
+		doc = append(doc, line)
+	}
+	docs = append(docs, strings.Join(doc, "\n"))
+
+	var requests []*pb.SendNotificationRequest
+	for i, doc := range docs {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		req, err := unmarshalRequest(doc, proto.UnmarshalText)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse textproto document %d: %v", i+1, err)
+		}
+		requests = append(requests, req)
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("no notifications in file")
+	}
+	return requests, nil
+}
+
+// unmarshalRequest parses a single document as a Notification (returning a
+// request for it), falling back to parsing it as a SendNotificationRequest.
+func unmarshalRequest(doc string, unmarshal func(string, proto.Message) error) (*pb.SendNotificationRequest, error) {
+	n := &pb.Notification{}
+	err := unmarshal(doc, n)
+	if err == nil {
+		return &pb.SendNotificationRequest{Notification: n}, nil
+	}
+	req := &pb.SendNotificationRequest{}
+	if reqErr := unmarshal(doc, req); reqErr != nil || req.Notification == nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// dataFlag is a flag.Value accumulating key=value pairs.
+type dataFlag map[string]string
+
+func (d dataFlag) String() string {
+	var pairs []string
+	for k, v := range d {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (d dataFlag) Set(pair string) error {
+	i := strings.Index(pair, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", pair)
 	}
+	d[pair[:i]] = pair[i+1:]
+	return nil
 }
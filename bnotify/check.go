@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+// checkPing pings the dead man's switch check named by the next argument.
+func checkPing() {
+	name := nextArg()
+	if name == "" {
+		log.Fatalf("Usage: bnotify check ping NAME")
+	}
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.PingCheck(context.Background(), &pb.PingCheckRequest{Name: name})
+	if err != nil {
+		log.Fatalf("Error during PingCheck RPC: %s", describeError(err))
+	}
+	if *verbose {
+		if due, err := ptypes.Timestamp(resp.NextPingDue); err == nil {
+			fmt.Printf("Pinged check %q; next ping due by %s\n", name, due.Local().Format("2006-01-02 15:04:05"))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	pb "../proto"
+
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const configFilename = "client.conf"
+
+// configPath returns the filename of the client configuration file. In order
+// of preference, this is: the file in --config-dir, $BNOTIFY_CONFIG, or the
+// file in the XDG configuration directory.
+func configPath() (string, error) {
+	if *configDir != "" {
+		return filepath.Join(*configDir, configFilename), nil
+	}
+	if path := os.Getenv("BNOTIFY_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", fmt.Errorf("neither $XDG_CONFIG_HOME nor $HOME is set")
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "bnotify", configFilename), nil
+}
+
+// readConfig reads the client configuration file. A missing file is treated
+// as an empty configuration.
+func readConfig() (*pb.BNotifyClientSettings, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	cfgBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &pb.BNotifyClientSettings{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &pb.BNotifyClientSettings{}
+	if err := proto.UnmarshalText(string(cfgBytes), cfg); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// loadConfig reads the client configuration file and uses it to set any flags
+// that were not explicitly passed.
+func loadConfig() error {
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if cfg.Host != "" && !set["host"] {
+		*host = cfg.Host
+	}
+	return nil
+}
+
+// configInit writes a new client configuration file based on the current
+// flags, creating the configuration directory if needed.
+func configInit() {
+	path, err := configPath()
+	if err != nil {
+		log.Fatalf("Error determining configuration path: %v", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		log.Fatalf("Configuration file %s already exists", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Fatalf("Error creating configuration directory: %v", err)
+	}
+	cfg := &pb.BNotifyClientSettings{Host: *host}
+	if err := ioutil.WriteFile(path, []byte(proto.MarshalTextString(cfg)), 0600); err != nil {
+		log.Fatalf("Error writing configuration file: %v", err)
+	}
+	fmt.Printf("Wrote %s\n", path)
+}
+
+// refreshConfigFile fetches the client configuration from bnotifyd &, if it
+// has changed, atomically replaces the configuration file with it. The new
+// configuration takes effect for the rest of this invocation.
+func refreshConfigFile() {
+	path, err := configPath()
+	if err != nil {
+		log.Fatalf("Error determining configuration path: %v", err)
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		log.Fatalf("Error reading configuration: %v", err)
+	}
+	ctx := adminContext()
+	conn, ns := dial()
+	resp, err := ns.GetClientConfig(ctx, &pb.GetClientConfigRequest{CurrentVersion: cfg.ConfigVersion})
+	conn.Close()
+	if err != nil {
+		log.Fatalf("Error during GetClientConfig RPC: %v", err)
+	}
+	if resp.Unchanged {
+		fmt.Printf("Configuration is up to date (version %s)\n", resp.Version)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Fatalf("Error creating configuration directory: %v", err)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), configFilename+".tmp")
+	if err != nil {
+		log.Fatalf("Error writing configuration file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString(proto.MarshalTextString(resp.Config)); err != nil {
+		tmpFile.Close()
+		log.Fatalf("Error writing configuration file: %v", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		log.Fatalf("Error writing configuration file: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		log.Fatalf("Error writing configuration file: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		log.Fatalf("Error replacing configuration file: %v", err)
+	}
+	fmt.Printf("Updated %s to version %s\n", path, resp.Version)
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error reading configuration: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh/terminal"
+
+	pb "../proto"
+)
+
+// These must match the daemon's key derivation & nonce format.
+const (
+	aesKeySize     = 16
+	pbkdfIterCount = 400000
+	serverIDSize   = 16
+)
+
+var payload = flag.String("payload", "", "decode: base64-encoded data.payload value to decrypt (- for stdin)")
+
+// decode decrypts & prints a payload received out-of-band (e.g. from the
+// app's debug log), using only what the app knows: the password & the
+// registration ID. Each stage reports its own error, so a failure points at
+// what is wrong.
+func decode() {
+	if *payload == "" {
+		log.Fatalf("--payload is required")
+	}
+	if *registrationID == "" {
+		log.Fatalf("--registration-id is required, to derive the key")
+	}
+	encoded := *payload
+	if encoded == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Error reading payload: %v", err)
+		}
+		encoded = string(b)
+	}
+	password, err := readPassword()
+	if err != nil {
+		log.Fatalf("Error reading password: %v", err)
+	}
+
+	payloadBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		log.Fatalf("Payload is not valid base64: %v", err)
+	}
+	envelope := &pb.Envelope{}
+	if err := proto.Unmarshal(payloadBytes, envelope); err != nil {
+		log.Fatalf("Payload is not an Envelope: %v", err)
+	}
+	fmt.Printf("Envelope version: %d\n", envelope.Version)
+	if nonceSize := serverIDSize + binary.Size(uint64(0)); len(envelope.Nonce) != nonceSize {
+		log.Fatalf("Envelope nonce is %d bytes, expected %d", len(envelope.Nonce), nonceSize)
+	}
+	fmt.Printf("Nonce: server ID %x, seq %d\n", envelope.Nonce[:serverIDSize], binary.BigEndian.Uint64(envelope.Nonce[serverIDSize:]))
+
+	key := pbkdf2.Key([]byte(password), []byte(*registrationID), pbkdfIterCount, aesKeySize, sha1.New)
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatalf("Error initializing block cipher: %v", err)
+	}
+	gcmCipher, err := cipher.NewGCMWithNonceSize(blockCipher, len(envelope.Nonce))
+	if err != nil {
+		log.Fatalf("Error initializing GCM cipher: %v", err)
+	}
+	plaintextMessage, err := gcmCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+	if err != nil {
+		log.Fatalf("Could not decrypt message; is the password or registration ID wrong, or was the payload encrypted for a previous registration ID?")
+	}
+	message := &pb.Message{}
+	if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+		log.Fatalf("Decrypted message is not a Message: %v", err)
+	}
+	fmt.Printf("Server ID: %x\nSeq: %d\n", message.ServerId, message.Seq)
+	if !bytes.Equal(message.ServerId, envelope.Nonce[:serverIDSize]) || message.Seq != binary.BigEndian.Uint64(envelope.Nonce[serverIDSize:]) {
+		fmt.Println("Warning: message server ID & seq do not match the nonce; the app will reject it")
+	}
+	if message.Ordering != nil {
+		fmt.Printf("Ordering:\n%s", indent(proto.MarshalTextString(message.Ordering)))
+	}
+	fmt.Printf("Notification:\n%s", indent(proto.MarshalTextString(message.Notification)))
+}
+
+// readPassword returns $BNOTIFY_PASSWORD if set, and otherwise prompts for the
+// password on the terminal.
+func readPassword() (string, error) {
+	if password := os.Getenv("BNOTIFY_PASSWORD"); password != "" {
+		return password, nil
+	}
+	if *payload == "-" {
+		return "", fmt.Errorf("$BNOTIFY_PASSWORD is required when reading the payload from stdin")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	defer fmt.Fprintln(os.Stderr)
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		return string(password), err
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSuffix(password, "\n"), err
+}
+
+// indent indents each line of s by two spaces.
+func indent(s string) string {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line != "" {
+			buf.WriteString("  " + line)
+		}
+	}
+	return buf.String()
+}
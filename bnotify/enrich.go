@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+// enrichPreview shows how bnotifyd's enrichers would transform the
+// notification described by the notification flags, without sending it.
+func enrichPreview() {
+	n := &pb.Notification{}
+	applyFlags(n)
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.PreviewEnrichment(context.Background(), &pb.PreviewEnrichmentRequest{Notification: n})
+	if err != nil {
+		log.Fatalf("Error during PreviewEnrichment RPC: %v", err)
+	}
+	if len(resp.Applied) == 0 {
+		fmt.Println("No enrichers apply to this notification")
+		return
+	}
+	fmt.Printf("Applied: %s\n\nBefore:\n%s\nAfter:\n%s", strings.Join(resp.Applied, ", "), proto.MarshalTextString(n), proto.MarshalTextString(resp.Notification))
+}
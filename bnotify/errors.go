@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// describeError formats an RPC error for display, including any structured
+// details attached by bnotifyd.
+func describeError(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err.Error()
+	}
+	lines := []string{st.Message()}
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				lines = append(lines, fmt.Sprintf("  %s: %s", v.Field, v.Description))
+			}
+		case *errdetails.QuotaFailure:
+			for _, v := range d.Violations {
+				lines = append(lines, fmt.Sprintf("  limit %s reached", v.Subject))
+			}
+		case *errdetails.RetryInfo:
+			if delay, err := ptypes.Duration(d.RetryDelay); err == nil {
+				lines = append(lines, fmt.Sprintf("  try again in %v", delay))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
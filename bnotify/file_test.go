@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/goleak"
+
+	pb "../proto"
+)
+
+// writeNotificationFile writes content to a file with the given name in a new
+// temporary directory, returning the file's path & a function removing it.
+func writeNotificationFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "bnotify-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not write notification file: %v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestReadNotificationFileKeepsRequestFields(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, tc := range []struct {
+		name, content string
+	}{
+		{"requests.txt", `
+notification { title: "request" }
+priority: HIGH
+android_config { restricted_package_name: "cc.bran.test" }
+---
+title: "notification"
+`},
+		{"requests.json", `[
+	{"notification": {"title": "request"}, "priority": "HIGH", "androidConfig": {"restrictedPackageName": "cc.bran.test"}},
+	{"title": "notification"}
+]`},
+	} {
+		path, cleanup := writeNotificationFile(t, tc.name, tc.content)
+		reqs, err := readNotificationFile(path)
+		cleanup()
+		if err != nil {
+			t.Fatalf("%s: readNotificationFile got unexpected error: %v", tc.name, err)
+		}
+		if len(reqs) != 2 {
+			t.Fatalf("%s: got %d requests, want 2", tc.name, len(reqs))
+		}
+		if got := reqs[0].Notification.GetTitle(); got != "request" {
+			t.Errorf("%s: first request has title %q, want %q", tc.name, got, "request")
+		}
+		if reqs[0].Priority != pb.Priority_HIGH {
+			t.Errorf("%s: first request has priority %v, want %v", tc.name, reqs[0].Priority, pb.Priority_HIGH)
+		}
+		if got := reqs[0].AndroidConfig.GetRestrictedPackageName(); got != "cc.bran.test" {
+			t.Errorf("%s: first request has restricted package name %q, want %q", tc.name, got, "cc.bran.test")
+		}
+		if got := reqs[1].Notification.GetTitle(); got != "notification" {
+			t.Errorf("%s: second request has title %q, want %q", tc.name, got, "notification")
+		}
+		if reqs[1].Priority != pb.Priority_NORMAL {
+			t.Errorf("%s: second request has priority %v, want %v", tc.name, reqs[1].Priority, pb.Priority_NORMAL)
+		}
+	}
+}
+
+func TestApplyRequestFlagsPriority(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	// --priority is not set, so the file's priority is kept.
+	req := &pb.SendNotificationRequest{Notification: &pb.Notification{}, Priority: pb.Priority_HIGH}
+	applyRequestFlags(req)
+	if req.Priority != pb.Priority_HIGH {
+		t.Errorf("Without --priority, got priority %v, want %v", req.Priority, pb.Priority_HIGH)
+	}
+
+	// Once --priority is set, it overrides the file's priority.
+	if err := flag.Set("priority", "low"); err != nil {
+		t.Fatalf("Could not set --priority: %v", err)
+	}
+	defer flag.Set("priority", "normal")
+	applyRequestFlags(req)
+	if req.Priority != pb.Priority_LOW {
+		t.Errorf("With --priority=low, got priority %v, want %v", req.Priority, pb.Priority_LOW)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+// group sends the notifications in --file as a group with the thread ID given
+// by --thread-id. bnotifyd appends a summary of the group.
+func group() {
+	if *threadID == "" || *file == "" {
+		log.Fatalf("Usage: bnotify group --thread-id=ID --file=FILE")
+	}
+	requests, err := readNotificationFile(*file)
+	if err != nil {
+		log.Fatalf("Error reading notification file: %v", err)
+	}
+	// The group has a single priority, so per-request fields in the file
+	// (other than the notification) do not apply.
+	notifications := make([]*pb.Notification, len(requests))
+	for i, req := range requests {
+		n := req.Notification
+		notifications[i] = n
+		applyFlags(n)
+		if err := validateNotification(n); err != nil {
+			log.Fatalf("Notification %d: %v", i+1, err)
+		}
+	}
+
+	release := beforeConnect()
+	defer release()
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.SendGroupNotification(context.Background(), &pb.GroupRequest{
+		ThreadId:      *threadID,
+		Notifications: notifications,
+		Priority:      flagPriority(),
+	})
+	if err != nil {
+		log.Fatalf("Error during SendGroupNotification RPC: %s", describeError(err))
+	}
+	if resp.SummaryNotificationId == "" {
+		fmt.Printf("Every notification in the group was muted\n")
+		return
+	}
+	if *verbose {
+		fmt.Printf("Sent %d of %d notifications (%s), summary %s\n", len(resp.NotificationIds), len(notifications), strings.Join(resp.NotificationIds, ", "), resp.SummaryNotificationId)
+	}
+	if *wait > 0 {
+		// The summary is sent last.
+		waitForSend(ns, resp.SummaryNotificationId)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	pb "../proto"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	since    = flag.String("since", "", "history export: only export notifications enqueued at or after this time (YYYY-MM-DD or RFC 3339)")
+	format   = flag.String("format", "jsonl", "history export: output format; only jsonl is supported")
+	redact   = flag.Bool("redact", false, "history export: omit notification titles")
+	afterSeq = flag.Uint64("after-seq", 0, "history export, pending list: only include notifications with a sequence number greater than this (to resume an interrupted listing)")
+)
+
+const (
+	// maxExportRetries is the number of times an interrupted export is resumed before giving up.
+	maxExportRetries = 5
+
+	// exportRetryDelay is how long to wait before resuming an interrupted export.
+	exportRetryDelay = time.Second
+)
+
+func historyExport() {
+	if *format != "jsonl" {
+		log.Fatalf("Unsupported --format %q", *format)
+	}
+	req := &pb.ExportHistoryRequest{
+		AfterSeq:     *afterSeq,
+		RedactTitles: *redact,
+	}
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			log.Fatalf("Bad --since: %v", err)
+		}
+		if req.Since, err = ptypes.TimestampProto(t); err != nil {
+			log.Fatalf("Bad --since: %v", err)
+		}
+	}
+
+	conn, ns := dial()
+	defer conn.Close()
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	m := &jsonpb.Marshaler{OrigName: true}
+	for retries := 0; ; retries++ {
+		err := exportHistory(ns, req, w, m)
+		if err == nil {
+			return
+		}
+		if status.Code(err) != codes.Unavailable || retries == maxExportRetries {
+			w.Flush()
+			log.Fatalf("Error during ExportHistory RPC: %v (resume with --after-seq=%d)", err, req.AfterSeq)
+		}
+		log.Printf("Export interrupted (%v); resuming after seq %d", err, req.AfterSeq)
+		time.Sleep(exportRetryDelay)
+	}
+}
+
+// exportHistory streams history records to w, one JSON object per line, in
+// the order the notifications were enqueued (not the order they finished).
+// req.AfterSeq is updated as records are written, so that the export may be
+// resumed if interrupted.
+func exportHistory(ns pb.NotificationServiceClient, req *pb.ExportHistoryRequest, w io.Writer, m *jsonpb.Marshaler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := ns.ExportHistory(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.Marshal(w, record); err != nil {
+			log.Fatalf("Could not marshal history record: %v", err)
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			log.Fatalf("Could not write history record: %v", err)
+		}
+		req.AfterSeq = record.Seq
+	}
+}
+
+// parseSince parses a --since value, which is either a date (interpreted in
+// local time) or an RFC 3339 timestamp.
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// historyCheck reports whether a notification with the given --title & --text
+// was sent. This works even if bnotifyd retains only hashes of sent
+// notifications, though such notifications cannot be shown or resent.
+func historyCheck() {
+	if *title == "" && *text == "" {
+		log.Fatalf("--title or --text is required")
+	}
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.CheckHistory(context.Background(), &pb.CheckHistoryRequest{Title: *title, Text: *text})
+	if err != nil {
+		log.Fatalf("Error during CheckHistory RPC: %v", err)
+	}
+	if len(resp.Matches) == 0 {
+		fmt.Println("No matching notification was sent")
+		os.Exit(1)
+	}
+	for _, m := range resp.Matches {
+		sentTime, err := ptypes.Timestamp(m.SentTime)
+		if err != nil {
+			log.Fatalf("Bad sent time in history record %d: %v", m.Seq, err)
+		}
+		fmt.Printf("%s\tsent=%v\n", m.NotificationId, sentTime.Local().Format(time.RFC3339))
+	}
+}
+
+func historyPurgePlaintext() {
+	ctx := adminContext()
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.PurgePlaintextHistory(ctx, &pb.PurgePlaintextHistoryRequest{})
+	if err != nil {
+		log.Fatalf("Error during PurgePlaintextHistory RPC: %v", err)
+	}
+	fmt.Printf("Replaced the content of %d history record(s) with a hash\n", resp.PurgedCount)
+}
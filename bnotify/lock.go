@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	lock    = flag.Bool("lock", false, "send: wait for any other bnotify invocation by the same user against the same --host to finish before connecting, e.g. to serialize many cron jobs firing at once")
+	stagger = flag.Duration("stagger", 0, "send: if nonzero, wait a random duration of up to this long before connecting, to spread out invocations started at the same time")
+)
+
+// lockPath returns the path of the lock file serializing --lock invocations
+// against the given host. Lock files live in $XDG_RUNTIME_DIR if set, and
+// otherwise in a per-user directory under the system temporary directory.
+func lockPath(host string) (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "bnotify")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("bnotify-%d", os.Getuid()))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, url.QueryEscape(host)+".lock"), nil
+}
+
+// acquireHostLock blocks until this process holds the lock for the given
+// host, returning the lock file. The lock is released when the file is closed
+// (or the process exits).
+func acquireHostLock(host string) (*os.File, error) {
+	path, err := lockPath(host)
+	if err != nil {
+		return nil, fmt.Errorf("could not create lock directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock %q: %v", path, err)
+	}
+	return f, nil
+}
+
+// beforeConnect applies --stagger & --lock. It returns a function releasing
+// the lock, if any, which should be called once done with bnotifyd.
+func beforeConnect() func() {
+	if *stagger > 0 {
+		rand.Seed(time.Now().UnixNano() ^ int64(os.Getpid()))
+		time.Sleep(time.Duration(rand.Int63n(int64(*stagger))))
+	}
+	if !*lock {
+		return func() {}
+	}
+	f, err := acquireHostLock(*host)
+	if err != nil {
+		log.Fatalf("Error acquiring lock: %v", err)
+	}
+	return func() { f.Close() }
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "../proto"
+)
+
+// clientEnv is set in the environment of client processes started by
+// runClients, which run bnotify rather than the tests.
+const clientEnv = "BNOTIFY_TEST_CLIENT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(clientEnv) != "" {
+		os.Args = append([]string{"bnotify"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeServer is a bnotifyd which accepts notifications, counting them by
+// title & tracking how many SendNotification RPCs run at once.
+type fakeServer struct {
+	pb.NotificationServiceServer // other RPCs are unimplemented
+
+	mu        sync.Mutex // protects all fields below
+	received  map[string]int
+	active    int
+	maxActive int
+}
+
+func (s *fakeServer) SendNotification(ctx context.Context, req *pb.SendNotificationRequest) (*pb.SendNotificationResponse, error) {
+	s.mu.Lock()
+	s.received[req.Notification.Title]++
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	n := len(s.received)
+	s.mu.Unlock()
+
+	// Take long enough that overlapping invocations would be noticed.
+	time.Sleep(20 * time.Millisecond)
+
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return &pb.SendNotificationResponse{NotificationId: fmt.Sprintf("test-%d", n)}, nil
+}
+
+// startFakeServer starts a fakeServer, returning it & its address. The
+// returned function stops it.
+func startFakeServer(t *testing.T) (*fakeServer, string, func()) {
+	fs := &fakeServer{received: map[string]int{}}
+	addr, stop, err := serveFakeServer(fs, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	return fs, addr, stop
+}
+
+// serveFakeServer serves fs on the given address, returning the address it
+// listens on & a function which stops it.
+func serveFakeServer(fs *fakeServer, addr string) (string, func(), error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", nil, err
+	}
+	s := grpc.NewServer()
+	pb.RegisterNotificationServiceServer(s, fs)
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop, nil
+}
+
+// runClients runs n bnotify send processes at once, each sending a
+// notification titled with its index, with the given extra flags. It fails
+// the test if any client fails.
+func runClients(t *testing.T, addr string, n int, flags ...string) {
+	dir, err := ioutil.TempDir("", "bnotify-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		args := append([]string{"send", "--host=" + addr, "--config-dir=" + dir, fmt.Sprintf("--title=%d", i), "--text=text"}, flags...)
+		cmd := exec.Command(os.Args[0], args...)
+		// Lock files are created in XDG_RUNTIME_DIR, so that tests neither
+		// use nor leave behind real lock files.
+		cmd.Env = append(os.Environ(), clientEnv+"=1", "XDG_RUNTIME_DIR="+dir)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("Client %d failed: %v\n%s", i, err, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// checkExactlyOnce checks that the server received each of the n clients'
+// notifications exactly once.
+func checkExactlyOnce(t *testing.T, fs *fakeServer, n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for i := 0; i < n; i++ {
+		if got := fs.received[fmt.Sprint(i)]; got != 1 {
+			t.Errorf("Notification %d received %d times, want 1", i, got)
+		}
+	}
+	if len(fs.received) != n {
+		t.Errorf("Received %d distinct notifications, want %d", len(fs.received), n)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const clients = 20
+	for _, test := range []struct {
+		desc  string
+		flags []string
+	}{
+		{"unserialized", nil},
+		{"staggered", []string{"--stagger=200ms"}},
+		{"locked", []string{"--lock"}},
+		{"locked & staggered", []string{"--lock", "--stagger=200ms"}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			fs, addr, stop := startFakeServer(t)
+			defer stop()
+			runClients(t, addr, clients, test.flags...)
+			checkExactlyOnce(t, fs, clients)
+
+			// --lock serializes invocations against the same host.
+			locked := false
+			for _, f := range test.flags {
+				locked = locked || f == "--lock"
+			}
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			if locked && fs.maxActive != 1 {
+				t.Errorf("Up to %d locked invocations ran at once, want 1", fs.maxActive)
+			}
+		})
+	}
+}
+
+func TestWaitForReadyAcrossRestart(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const clients = 10
+	fs, addr, stop := startFakeServer(t)
+
+	// Kill the server, so that the clients start while it is down, & restart
+	// it on the same address while they wait.
+	stop()
+	restarted := make(chan func(), 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		_, stop, err := serveFakeServer(fs, addr)
+		if err != nil {
+			t.Errorf("Could not restart server: %v", err)
+			stop = func() {}
+		}
+		restarted <- stop
+	}()
+	runClients(t, addr, clients, "--wait-for-ready=10s")
+	defer (<-restarted)()
+	checkExactlyOnce(t, fs, clients)
+}
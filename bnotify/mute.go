@@ -0,0 +1,73 @@
+package main
+
+import (
+	pb "../proto"
+
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+)
+
+var (
+	titlePrefix  = flag.String("title-prefix", "", "mute add: mute notifications whose title has this prefix")
+	titleRegex   = flag.String("title-regex", "", "mute add: mute notifications whose title matches this regular expression")
+	muteDuration = flag.Duration("duration", time.Hour, "mute add: how long the mute rule remains in effect")
+	summarize    = flag.Bool("summarize", false, "mute add: if set, send a summary of muted notifications when the rule expires")
+	muteID       = flag.Uint64("id", 0, "mute remove: ID of the mute rule to remove")
+)
+
+func muteAdd() {
+	action := pb.MuteRule_DROP
+	if *summarize {
+		action = pb.MuteRule_HOLD_AND_SUMMARIZE
+	}
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.AddMute(context.Background(), &pb.AddMuteRequest{
+		Rule: &pb.MuteRule{
+			TitlePrefix: *titlePrefix,
+			TitleRegex:  *titleRegex,
+			Action:      action,
+		},
+		DurationSeconds: int64(muteDuration.Seconds()),
+	})
+	if err != nil {
+		log.Fatalf("Error during AddMute RPC: %v", err)
+	}
+	printMute(resp.Rule)
+}
+
+func muteList() {
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.ListMutes(context.Background(), &pb.ListMutesRequest{})
+	if err != nil {
+		log.Fatalf("Error during ListMutes RPC: %v", err)
+	}
+	for _, rule := range resp.Rules {
+		printMute(rule)
+	}
+}
+
+func muteRemove() {
+	if *muteID == 0 {
+		log.Fatalf("--id is required")
+	}
+	conn, ns := dial()
+	defer conn.Close()
+	if _, err := ns.RemoveMute(context.Background(), &pb.RemoveMuteRequest{Id: *muteID}); err != nil {
+		log.Fatalf("Error during RemoveMute RPC: %v", err)
+	}
+}
+
+func printMute(rule *pb.MuteRule) {
+	expireTime, err := ptypes.Timestamp(rule.ExpireTime)
+	if err != nil {
+		log.Fatalf("Bad expire time in mute rule %d: %v", rule.Id, err)
+	}
+	fmt.Printf("%d\ttitle_prefix=%q title_regex=%q action=%v expires=%v muted=%d\n", rule.Id, rule.TitlePrefix, rule.TitleRegex, rule.Action, expireTime.Local().Format(time.RFC3339), rule.MutedCount)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	pb "../proto"
+
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+)
+
+func pendingList() {
+	conn, ns := dial()
+	defer conn.Close()
+	stream, err := ns.ListPendingNotifications(context.Background(), &pb.ListPendingRequest{AfterSeq: *afterSeq})
+	if err != nil {
+		log.Fatalf("Error during ListPendingNotifications RPC: %v", err)
+	}
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("Error during ListPendingNotifications RPC: %v (resume with --after-seq=%d)", err, *afterSeq)
+		}
+		enqueueTime, err := ptypes.Timestamp(p.EnqueueTime)
+		if err != nil {
+			log.Fatalf("Bad enqueue time in pending notification %d: %v", p.Seq, err)
+		}
+		lastError := ""
+		if p.LastError != "" {
+			lastError = fmt.Sprintf(" last_error=%q", p.LastError)
+		}
+		fmt.Printf("%s\tenqueued=%v attempts=%d size=%d title=%q%s\n", p.NotificationId, enqueueTime.Local().Format(time.RFC3339), p.SendAttempts, p.PayloadSize, p.Title, lastError)
+		*afterSeq = p.Seq
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+// resend asks bnotifyd to send the notification with the ID given by the
+// next argument again.
+func resend() {
+	id := nextArg()
+	if id == "" {
+		log.Fatalf("Usage: bnotify resend NOTIFICATION_ID")
+	}
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.ResendNotification(context.Background(), &pb.ResendRequest{NotificationId: id})
+	if err != nil {
+		log.Fatalf("Error during ResendNotification RPC: %s", describeError(err))
+	}
+	if *verbose {
+		fmt.Printf("Resent as notification %s\n", resp.NotificationId)
+	}
+	if *wait > 0 {
+		waitForSend(ns, resp.NotificationId)
+	}
+}
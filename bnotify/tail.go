@@ -0,0 +1,90 @@
+package main
+
+import (
+	pb "../proto"
+
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+)
+
+var (
+	jsonOutput = flag.Bool("json", false, "tail: print events as JSON, one per line; describe: print flags as a JSON array")
+	tailServer = flag.Bool("server", false, "tail: print server events (queueing, sends, FCM errors, backoff, settings reloads & circuit breaker changes) rather than notification events")
+)
+
+// tail prints notification events as they happen.
+func tail() {
+	if *tailServer {
+		tailServerEvents()
+		return
+	}
+	conn, ns := dial()
+	defer conn.Close()
+	stream, err := ns.WatchNotification(context.Background(), &pb.WatchRequest{})
+	if err != nil {
+		log.Fatalf("Error during WatchNotification RPC: %v", err)
+	}
+	m := &jsonpb.Marshaler{OrigName: true}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("Error during WatchNotification RPC: %v", err)
+		}
+		if *jsonOutput {
+			if err := m.Marshal(os.Stdout, event); err != nil {
+				log.Fatalf("Could not marshal event: %v", err)
+			}
+			fmt.Println()
+			continue
+		}
+		t, err := ptypes.Timestamp(event.Time)
+		if err != nil {
+			log.Fatalf("Bad time in event for seq %d: %v", event.Seq, err)
+		}
+		fmt.Printf("[%s] seq=%d %v title=%q text=%q\n", t.Local().Format("2006-01-02 15:04:05"), event.Seq, event.Status, event.GetNotification().GetTitle(), event.GetNotification().GetText())
+	}
+}
+
+// tailServerEvents prints server events as they happen.
+func tailServerEvents() {
+	conn, ns := dial()
+	defer conn.Close()
+	stream, err := ns.WatchServerEvents(context.Background(), &pb.WatchServerEventsRequest{})
+	if err != nil {
+		log.Fatalf("Error during WatchServerEvents RPC: %v", err)
+	}
+	m := &jsonpb.Marshaler{OrigName: true}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("Error during WatchServerEvents RPC: %v", err)
+		}
+		if *jsonOutput {
+			if err := m.Marshal(os.Stdout, event); err != nil {
+				log.Fatalf("Could not marshal event: %v", err)
+			}
+			fmt.Println()
+			continue
+		}
+		t, err := ptypes.Timestamp(event.Time)
+		if err != nil {
+			log.Fatalf("Bad time in server event: %v", err)
+		}
+		event.Time = nil
+		fmt.Printf("[%s] %s\n", t.Local().Format("2006-01-02 15:04:05"), proto.CompactTextString(event))
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+// testNotification asks bnotifyd to send a canned test notification, and
+// reports whether it was sent.
+func testNotification() {
+	conn, ns := dial()
+	defer conn.Close()
+	resp, err := ns.SendTestNotification(context.Background(), &pb.SendTestNotificationRequest{})
+	if err != nil {
+		log.Fatalf("Error during SendTestNotification RPC: %s", describeError(err))
+	}
+	switch resp.Status {
+	case pb.StatusResponse_SENT, pb.StatusResponse_ACKNOWLEDGED:
+		fmt.Printf("Test notification %s sent; check your device\n", resp.NotificationId)
+	case pb.StatusResponse_FAILED:
+		fmt.Printf("Test notification %s could not be sent\n", resp.NotificationId)
+		os.Exit(1)
+	default:
+		fmt.Printf("Test notification %s is still being sent (status: %v); see bnotify tail\n", resp.NotificationId, resp.Status)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	pb "../proto"
+)
+
+// maxTTL is the maximum time-to-live FCM accepts for a message.
+const maxTTL = 28 * 24 * time.Hour
+
+// validateAndroidConfig verifies that the given Android config, which may be
+// nil, can be sent to FCM.
+func validateAndroidConfig(config *pb.AndroidConfig) error {
+	if config.GetTtl() == nil {
+		return nil
+	}
+	ttl, err := ptypes.Duration(config.Ttl)
+	if err != nil {
+		return fmt.Errorf("bad ttl: %v", err)
+	}
+	if ttl < 0 || ttl > maxTTL {
+		return fmt.Errorf("ttl must be between 0 and %v", maxTTL)
+	}
+	return nil
+}
+
+// mergeAndroidConfig returns the Android config resulting from applying the
+// set fields of override to those of defaults. Either may be nil.
+func mergeAndroidConfig(defaults, override *pb.AndroidConfig) *pb.AndroidConfig {
+	config := &pb.AndroidConfig{}
+	if defaults != nil {
+		config = proto.Clone(defaults).(*pb.AndroidConfig)
+	}
+	if override == nil {
+		return config
+	}
+	// ttl is handled separately, since a zero ttl is meaningful & so should
+	// override the default if it is set.
+	if override.Ttl != nil {
+		config.Ttl = override.Ttl
+	}
+	if override.RestrictedPackageName != "" {
+		config.RestrictedPackageName = override.RestrictedPackageName
+	}
+	if override.DirectBootOk {
+		config.DirectBootOk = true
+	}
+	if n := override.Notification; n != nil {
+		if config.Notification == nil {
+			config.Notification = &pb.AndroidConfig_AndroidNotification{}
+		}
+		if n.ClickAction != "" {
+			config.Notification.ClickAction = n.ClickAction
+		}
+		if n.DefaultSound {
+			config.Notification.DefaultSound = true
+		}
+	}
+	return config
+}
+
+// requestAndroidConfig returns the per-notification Android config for the
+// given request, which may be nil. The notification's package name is used
+// unless the request's Android config specifies one.
+func requestAndroidConfig(req *pb.SendNotificationRequest) *pb.AndroidConfig {
+	packageName := req.Notification.GetPackageName()
+	if packageName == "" || req.AndroidConfig.GetRestrictedPackageName() != "" {
+		return req.AndroidConfig
+	}
+	config := &pb.AndroidConfig{}
+	if req.AndroidConfig != nil {
+		config = proto.Clone(req.AndroidConfig).(*pb.AndroidConfig)
+	}
+	config.RestrictedPackageName = packageName
+	return config
+}
+
+// setAndroidConfigValues sets the FCM request parameters corresponding to
+// the given Android config, falling back to defaultPackageName if the config
+// does not restrict the package name.
+func setAndroidConfigValues(values url.Values, config *pb.AndroidConfig, defaultPackageName string) {
+	values.Set("restricted_package_name", defaultPackageName)
+	if config.RestrictedPackageName != "" {
+		values.Set("restricted_package_name", config.RestrictedPackageName)
+	}
+	if config.Ttl != nil {
+		// Already validated, so the error can be ignored.
+		ttl, _ := ptypes.Duration(config.Ttl)
+		values.Set("time_to_live", strconv.FormatInt(int64(ttl/time.Second), 10))
+	}
+	if config.DirectBootOk {
+		values.Set("direct_boot_ok", "true")
+	}
+	if n := config.Notification; n != nil {
+		if n.ClickAction != "" {
+			values.Set("data.click_action", n.ClickAction)
+		}
+		if n.DefaultSound {
+			values.Set("data.default_sound", "true")
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+
+	pb "../proto"
+)
+
+// apiKeysKey is the key of the API key ring's state in the rate_limiters bucket.
+const apiKeysKey = "api_keys"
+
+// apiKeyRing hands out the configured API keys in turn, skipping keys which
+// FCM reported as out of quota until the quota resets at midnight UTC.
+type apiKeyRing struct {
+	db   *bolt.DB
+	keys []string
+	next uint64 // index of the next key to use, modulo len(keys); accessed atomically
+
+	mu        sync.Mutex           // protects exhausted
+	exhausted map[string]time.Time // by key fingerprint: when the key's quota resets
+}
+
+// newAPIKeyRing returns a ring of the API keys in settings, restoring which
+// keys are out of quota from the state in db.
+func newAPIKeyRing(db *bolt.DB, settings *pb.BNotifySettings) (*apiKeyRing, error) {
+	var keys []string
+	if settings.ApiKey != "" {
+		keys = append(keys, settings.ApiKey)
+	}
+	keys = append(keys, settings.ApiKeys...)
+	if len(keys) == 0 {
+		// Requests will fail, as they always have without an API key.
+		keys = []string{""}
+	}
+	r := &apiKeyRing{db: db, keys: keys, exhausted: map[string]time.Time{}}
+
+	state := &pb.ApiKeyState{}
+	if err := db.View(func(tx *bolt.Tx) error {
+		limitersBucket := tx.Bucket([]byte("rate_limiters"))
+		if limitersBucket == nil {
+			return errors.New("missing rate_limiters bucket")
+		}
+		if stateBytes := limitersBucket.Get([]byte(apiKeysKey)); stateBytes != nil {
+			return proto.Unmarshal(stateBytes, state)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for fp, until := range state.ExhaustedUntil {
+		r.exhausted[fp] = time.Unix(until, 0)
+	}
+	return r, nil
+}
+
+// keyFingerprint identifies an API key in logs & state without revealing it.
+func keyFingerprint(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:4])
+}
+
+// pick returns the next API key to use. If every key is out of quota, keys
+// are still handed out in turn, and FCM will reject the requests.
+func (r *apiKeyRing) pick() string {
+	if len(r.keys) == 1 {
+		return r.keys[0]
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range r.keys {
+		key := r.keys[(atomic.AddUint64(&r.next, 1)-1)%uint64(len(r.keys))]
+		if !now.Before(r.exhausted[keyFingerprint(key)]) {
+			return key
+		}
+	}
+	return r.keys[(atomic.AddUint64(&r.next, 1)-1)%uint64(len(r.keys))]
+}
+
+// exhaust records that FCM reported the given key as out of quota, returning
+// true if another key remains available.
+func (r *apiKeyRing) exhaust(key string) bool {
+	if len(r.keys) == 1 {
+		return false
+	}
+	now := time.Now()
+	reset := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	fp := keyFingerprint(key)
+
+	r.mu.Lock()
+	if !now.Before(r.exhausted[fp]) {
+		log.Printf("Warning: API key %s is out of quota; skipping it until %v", fp, reset.Format(time.RFC3339))
+	}
+	r.exhausted[fp] = reset
+	available := false
+	for _, k := range r.keys {
+		if !now.Before(r.exhausted[keyFingerprint(k)]) {
+			available = true
+		}
+	}
+	state := &pb.ApiKeyState{ExhaustedUntil: map[string]int64{}}
+	for fp, until := range r.exhausted {
+		if now.Before(until) {
+			state.ExhaustedUntil[fp] = until.Unix()
+		}
+	}
+	r.mu.Unlock()
+
+	if err := r.save(state); err != nil {
+		log.Printf("Error saving API key state: %v", err)
+	}
+	return available
+}
+
+func (r *apiKeyRing) save(state *pb.ApiKeyState) error {
+	stateBytes, err := proto.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not marshal API key state: %v", err)
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		limitersBucket := tx.Bucket([]byte("rate_limiters"))
+		if limitersBucket == nil {
+			return errors.New("missing rate_limiters bucket")
+		}
+		return limitersBucket.Put([]byte(apiKeysKey), stateBytes)
+	})
+}
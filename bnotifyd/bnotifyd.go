@@ -2,28 +2,46 @@ package main
 
 import (
 	"bufio"
-	"crypto/aes"
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/boltdb/bolt"
 	"github.com/golang/protobuf/proto"
-	"golang.org/x/crypto/pbkdf2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 
 	pb "../proto"
 )
@@ -34,299 +52,1306 @@ const (
 	aesKeySize         = 16
 	pbkdfIterCount     = 400000
 	serverIDSize       = 16
+
+	// maxLogResponseBytes is the maximum number of bytes of FCM response body read.
+	maxLogResponseBytes = 4096
+
+	// envelopeVersion is the envelope format version emitted by this daemon.
+	// It must be bumped whenever a change is made to the envelope or message
+	// format that older versions of the app cannot handle.
+	envelopeVersion = 0
 )
 
 var (
 	port             = flag.Int("port", 50051, "port to listen for RPCs on")
-	settingsFilename = flag.String("settings", "bnotify.conf", "filename of settings file")
-	stateFilename    = flag.String("state", "bnotify.state", "filename of state file")
+	settingsFilename = flag.String("settings", "", "filename of settings file (default $XDG_CONFIG_HOME/bnotify/settings.conf)")
+	stateFilename    = flag.String("state", "", "filename of state file (default $XDG_STATE_HOME/bnotify/state.db)")
+	printPaths       = flag.Bool("print-paths", false, "if set, print the resolved settings & state filenames and exit")
+	serverIDFilename = flag.String("server-id-file", "", "if set, filename of a hex-encoded server ID (see generate-server-id) to use if the state file has none yet")
+	repairServerID   = flag.Bool("repair-server-id", false, "if set, and the server ID in the state file is corrupt, replace it with a newly generated one (re-encrypting pending messages) rather than refusing to start")
+	maxReplayAge     = flag.Duration("max-replay-age", 0, "if nonzero, messages pending at startup which were enqueued longer ago than this are moved to the dead-letter queue rather than sent")
+	metricsAddr      = flag.String("metrics-addr", "", "if set, address (host:port) to serve Prometheus metrics on at /metrics")
+	pushGatewayURL   = flag.String("push-gateway-url", "", "if set, URL of a Prometheus pushgateway to periodically push metrics to, for deployments which cannot be scraped")
+	pushInterval     = flag.Duration("push-interval", 15*time.Second, "how often to push metrics to --push-gateway-url")
+	recordFilename   = flag.String("record", "", "if set, filename to append FCM requests & responses to as JSON lines, for use as test fixtures; device identifiers & payloads are hashed, and API keys are omitted")
+	echoFilename     = flag.String("echo", "", "if set, notifications are not sent to FCM; instead they are decrypted as the app would and written to this file (- for stdout), for testing")
+	output           = flag.String("output", "", "filename to write output to (used by generate-server-id & config export)")
+	testMode         = flag.Bool("test-mode", false, "if set, run without a settings file or persistent state, sending to a local fake FCM server & listening on a random port (printed to stdout), for smoke testing")
+	replicaFilename  = flag.String("replica", "", "if set, filename to periodically write a snapshot of the state file to (see restore)")
+	replicaInterval  = flag.Duration("replica-interval", time.Minute, "how often to write a snapshot of the state file to --replica")
+	restoreFrom      = flag.String("from", "", "restore: filename of the replica to restore the state file from")
+	pipeMode         = flag.Bool("pipe", false, "if set, rather than serving, read lines from stdin & send them as notifications via the bnotifyd instance listening on --port")
+	pipeTitle        = flag.String("title", "", "title of notifications sent in --pipe mode")
+	logLevel         = flag.String("log-level", "info", "minimum level of log messages to emit (debug or info)")
+	describeJSON     = flag.Bool("json", false, "describe: print flags as a JSON array")
+
+	// categoryRegexp matches valid notification categories (including the empty category).
+	categoryRegexp = regexp.MustCompile(`^[A-Za-z0-9._]*$`)
 
 	waits = []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute}
 )
 
 type notificationService struct {
-	db             *bolt.DB
-	apiKey         string
-	registrationID string
-	gcmCipher      cipher.AEAD
+	db            *bolt.DB
+	apiKeys       *apiKeyRing
+	password      string
+	adminToken    string        // if empty, admin RPCs are disabled
+	totp          *totpVerifier // if non-nil, admin RPCs also require a TOTP code
+	fcmAddress    string
+	echo          *echoReceiver       // if non-nil, payloads are sent here rather than to FCM
+	recorder      *fcmRecorder        // if non-nil, FCM requests & responses are recorded
+	rateQueue     *rateQueue          // if non-nil, limits the rate of sends to FCM
+	inFlight      *semaphore.Weighted // if non-nil, limits the number of messages being sent at once
+	payloadSizes  *sizeSummary
+	sizeWarnBytes int               // if nonzero, payloads larger than this are logged
+	androidConfig *pb.AndroidConfig // default Android config; may be nil
+	packageName   string            // default package name, if not set by the Android config
+	replica       *replicator       // if non-nil, state is replicated
+	events        *eventBroadcaster
+	serverEvents  *serverEventBroadcaster
+	sanitizeHTML  bool
+	clientConfig  *pb.BNotifyClientSettings // served by GetClientConfig
+
+	drainOrder          pb.BNotifySettings_DrainOrder
+	drainOrderThreshold int
+
+	muteRegexps sync.Map // mute rule ID → compiled title regex
+
+	quota           *quotaTracker
+	quotaWarnNotify bool // if set, quota warnings are also sent as notifications
+
+	historyMode pb.BNotifySettings_HistoryMode
+	historySalt []byte // salt for content hashes in history
+
+	activeSenders   int64 // number of running sendPayload goroutines; accessed atomically
+	heldSenders     int64 // number of LOW priority messages held by holdLowPriority; accessed atomically
+	lowPriorityHold int64 // if positive, LOW priority messages wait while more unheld messages than this are active
+	lowPriorityWarn time.Duration
+
+	envelopeProducers []*pb.EnvelopeProducer
+
+	tokens          *tokenMonitor
+	tokenRefreshURL string // if set, called with registration IDs FCM reports as not registered
+
+	breaker *circuitBreaker
+
+	checks []*pb.DeadMansSwitch // dead man's switch checks
+
+	clock clock // if nil, the system clock is used for retry scheduling
+
+	recoveryWeights map[string]int32 // channel weights for recovering a backlog at startup
+
+	senders  sync.WaitGroup // counts running sendPayload goroutines
+	stopping chan struct{}  // closed when the service begins draining
+	startMu  sync.Mutex     // held while adding to senders & while closing stopping
+
+	// rekeyMu is held for writing while the registration ID (and so the
+	// cipher) changes, and for reading by anything which must see pending
+	// payloads & credentials consistently. It must never be acquired inside
+	// a transaction.
+	rekeyMu     sync.RWMutex
+	credentials atomic.Value // *credentials
+
+	mu              sync.RWMutex // protects settings that may be reloaded at runtime
+	validationRules []validationRule
+	localizer       *localizer
+	enrichers       []enricher
 }
 
 func (ns *notificationService) SendNotification(ctx context.Context, req *pb.SendNotificationRequest) (*pb.SendNotificationResponse, error) {
-	// Verify request.
-	if req.Notification.Title == "" {
-		return nil, errors.New("notification missing title")
+	if req.Notification == nil {
+		return nil, badRequest("missing notification", fieldViolation("notification", "required"))
 	}
-	if req.Notification.Text == "" {
-		return nil, errors.New("notification missing text")
+	if err := ns.verifyNotification(req); err != nil {
+		return nil, err
 	}
 
-	// Enqueue request into state.
-	var seq uint64
-	if err := ns.db.Batch(func(tx *bolt.Tx) error {
-		// Read server ID & allocate sequence number.
-		settingsBucket := tx.Bucket([]byte("settings"))
-		if settingsBucket == nil {
-			return errors.New("missing settings bucket")
-		}
-		serverID := settingsBucket.Get([]byte("serverID"))
-		if serverID == nil {
-			return errors.New("missing serverID")
+	if ns.inFlight != nil && !ns.inFlight.TryAcquire(1) {
+		return nil, quotaFailure("too many notifications in flight", "max_in_flight_messages", inFlightRetryDelay)
+	}
+	muteKey, err := ns.admitNotification(req.Notification)
+	if err != nil {
+		ns.releaseInFlight()
+		return nil, err
+	}
+	if muteKey != nil {
+		ns.releaseInFlight()
+		ns.admitted(req.Notification, muteKey)
+		log.Printf("Muted notification %q", req.Notification.Title)
+		return &pb.SendNotificationResponse{}, nil
+	}
+
+	// Enqueue notification, then kick off goroutine to actually send it and return success.
+	seq, pendingPayload, err := ns.enqueue(req)
+	if err != nil {
+		ns.releaseInFlight()
+		if tooLarge, ok := err.(payloadTooLargeError); ok {
+			return nil, badRequest(tooLarge.Error(), fieldViolation("notification", tooLarge.Error()))
 		}
+		log.Printf("Error while posting notification: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	ns.admitted(req.Notification, nil)
+	log.Printf("[%s] Enqueued notification", pendingPayload.NotificationId)
+	if ns.startSenders(1) {
+		go ns.sendPayload(seq)
+	} else {
+		ns.releaseInFlight()
+	}
+	return &pb.SendNotificationResponse{
+		NotificationId: pendingPayload.NotificationId,
+		PayloadSize:    int32(payloadSize(pendingPayload.Payload)),
+	}, nil
+}
 
-		messagesBucket := tx.Bucket([]byte("pending_messages"))
-		if messagesBucket == nil {
-			return errors.New("missing pending_messages bucket")
+// verifyNotification sanitizes & verifies the requested notification, then
+// applies enrichers. Errors are suitable to return from an RPC.
+func (ns *notificationService) verifyNotification(req *pb.SendNotificationRequest) error {
+	// Sanitize & verify request.
+	if title := sanitize(req.Notification.Title, ns.sanitizeHTML); title != req.Notification.Title {
+		log.Printf("Warning: sanitized notification title %q", req.Notification.Title)
+		req.Notification.Title = title
+	}
+	if text := sanitize(req.Notification.Text, ns.sanitizeHTML); text != req.Notification.Text {
+		log.Printf("Warning: sanitized notification text %q", req.Notification.Text)
+		req.Notification.Text = text
+	}
+	if !req.Notification.Silent {
+		// Silent notifications are never displayed, so their title & text
+		// need not be present or follow the validation rules.
+		if req.Notification.Title == "" {
+			return badRequest("notification missing title", fieldViolation("notification.title", "required unless silent"))
 		}
-		theSeq, err := messagesBucket.NextSequence()
-		if err != nil {
-			return fmt.Errorf("could not allocate sequence number: %v", err)
+		if req.Notification.Text == "" {
+			return badRequest("notification missing text", fieldViolation("notification.text", "required unless silent"))
 		}
-		seq = theSeq
-
-		// Marshal request.
-		plaintextMessage, err := proto.Marshal(&pb.Message{
-			ServerId:     serverID,
-			Seq:          seq,
-			Notification: req.Notification,
-		})
-		if err != nil {
-			return fmt.Errorf("could not marshal message proto: %v", err)
+		ns.mu.RLock()
+		validationRules := ns.validationRules
+		ns.mu.RUnlock()
+		if err := validate(validationRules, req.Notification); err != nil {
+			return err
 		}
+	}
+	if err := validateNotificationURL(req.Notification.NotificationUrl); err != nil {
+		return badRequest(fmt.Sprintf("bad notification_url: %v", err), fieldViolation("notification.notification_url", err.Error()))
+	}
+	if !categoryRegexp.MatchString(req.Notification.Category) {
+		return badRequest("bad category: may contain only letters, digits, dots & underscores", fieldViolation("notification.category", "may contain only letters, digits, dots & underscores"))
+	}
+	if err := validateAndroidConfig(req.AndroidConfig); err != nil {
+		return badRequest(fmt.Sprintf("bad android_config: %v", err), fieldViolation("android_config", err.Error()))
+	}
 
-		// Compute nonce = serverID || seq & encrypt.
-		key := make([]byte, binary.Size(seq))
-		binary.BigEndian.PutUint64(key, seq)
-		nonce := append(serverID, key...)
-		message := ns.gcmCipher.Seal(nil, nonce, plaintextMessage, nil)
+	// Apply enrichers.
+	ns.mu.RLock()
+	enrichers := ns.enrichers
+	ns.mu.RUnlock()
+	_, err := enrich(enrichers, req.Notification)
+	return err
+}
 
-		// Fill out final envelope & pending payload protos, then write to storage.
-		payload, err := proto.Marshal(&pb.Envelope{
-			Message: message,
-			Nonce:   nonce,
-		})
+// admitNotification applies mute rules to the given verified notification,
+// returning the key of the rule muting it, or nil if it is not muted. It has
+// no side effects: once the notification has been enqueued (or dropped, if
+// muted), the caller must call admitted. Errors are suitable to return from
+// an RPC.
+func (ns *notificationService) admitNotification(n *pb.Notification) ([]byte, error) {
+	// Silent notifications are not displayed, so they are neither muted nor
+	// counted in mute summaries.
+	if n.Silent {
+		return nil, nil
+	}
+	muteKey, err := ns.findMute(n)
+	if err != nil {
+		log.Printf("Error while applying mute rules: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return muteKey, nil
+}
+
+// admitted applies the side effects of admitting the given notification,
+// muted by the rule with the given key if non-nil: it pings any check the
+// notification names (even if it was muted), & counts it toward its mute
+// rule. These wait until the notification has been enqueued or dropped, so
+// that a rejected request has none.
+func (ns *notificationService) admitted(n *pb.Notification, muteKey []byte) {
+	ns.pingCheckFromNotification(n)
+	if muteKey == nil {
+		return
+	}
+	if err := ns.countMuted(muteKey); err != nil {
+		log.Printf("Warning: could not count muted notification %q toward its mute rule: %v", n.Title, err)
+	}
+}
+
+// enqueue encrypts the requested notification & adds it to the pending messages
+// in state, returning its sequence number & pending payload. The caller is responsible for
+// starting a sendPayload goroutine for the returned sequence number.
+func (ns *notificationService) enqueue(req *pb.SendNotificationRequest) (uint64, *pb.PendingPayload, error) {
+	return ns.enqueueMessage(req, false)
+}
+
+// enqueueMessage is enqueue, additionally flagging test notifications so
+// that they can be told apart in history.
+func (ns *notificationService) enqueueMessage(req *pb.SendNotificationRequest, test bool) (uint64, *pb.PendingPayload, error) {
+	// Batch may run this function more than once, so it must not have side
+	// effects outside of the transaction; seq & pendingPayload are only set once
+	// the function is about to succeed.
+	var seq uint64
+	var pendingPayload *pb.PendingPayload
+	enqueueTime, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return 0, nil, err
+	}
+	// Hold rekeyMu until the payload is written, so that the cipher cannot
+	// change (re-encrypting pending payloads) in the meantime.
+	ns.rekeyMu.RLock()
+	gcmCipher := ns.creds().gcmCipher
+	err = ns.db.Batch(func(tx *bolt.Tx) error {
+		serverID, err := txServerID(tx)
 		if err != nil {
-			return fmt.Errorf("could not marshal envelope proto: %v", err)
+			return err
 		}
-		pendingPayload, err := proto.Marshal(&pb.PendingPayload{
-			Payload: payload,
-		})
+		txSeq, txPendingPayload, err := putMessage(tx, serverID, gcmCipher, req, enqueueTime, test)
 		if err != nil {
-			return fmt.Errorf("could not marshal pending payload proto: %v", err)
+			return err
 		}
-		if err := messagesBucket.Put(key, pendingPayload); err != nil {
-			return fmt.Errorf("could not write message to state: %v", err)
+		seq, pendingPayload = txSeq, txPendingPayload
+		return nil
+	})
+	ns.rekeyMu.RUnlock()
+	if err != nil {
+		return 0, nil, err
+	}
+	ns.recordPayloadSize(payloadSize(pendingPayload.Payload))
+	notificationsEnqueued.WithLabelValues(notificationKind(req.Notification)).Inc()
+	ns.publishEvent(seq, pendingPayload, pb.StatusResponse_PENDING)
+	return seq, pendingPayload, nil
+}
+
+// txServerID reads & checks the server ID within the given transaction.
+func txServerID(tx *bolt.Tx) ([]byte, error) {
+	settingsBucket := tx.Bucket([]byte("settings"))
+	if settingsBucket == nil {
+		return nil, errors.New("missing settings bucket")
+	}
+	serverID := settingsBucket.Get([]byte("serverID"))
+	if err := checkServerID(serverID); err != nil {
+		return nil, err
+	}
+	return serverID, nil
+}
+
+// putMessage allocates a sequence number for the requested notification,
+// encrypts it with gcmCipher & adds it to the pending messages, all within
+// the given transaction. It returns the sequence number & pending payload.
+func putMessage(tx *bolt.Tx, serverID []byte, gcmCipher cipher.AEAD, req *pb.SendNotificationRequest, enqueueTime *timestamp.Timestamp, test bool) (uint64, *pb.PendingPayload, error) {
+	messagesBucket := tx.Bucket([]byte("pending_messages"))
+	if messagesBucket == nil {
+		return 0, nil, errors.New("missing pending_messages bucket")
+	}
+	txSeq, err := messagesBucket.NextSequence()
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not allocate sequence number: %v", err)
+	}
+	counter, err := nextChannelCounter(tx, req.Notification.Category)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Marshal message.
+	plaintextMessage, err := proto.Marshal(&pb.Message{
+		ServerId:     serverID,
+		Seq:          txSeq,
+		Notification: req.Notification,
+		Ordering: &pb.OrderingToken{
+			Channel:     req.Notification.Category,
+			Counter:     counter,
+			EnqueueTime: enqueueTime,
+		},
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not marshal message proto: %v", err)
+	}
+
+	// Compute nonce = serverID || seq & encrypt.
+	nonce := makeNonce(serverID, txSeq)
+	message := gcmCipher.Seal(nil, nonce, plaintextMessage, nil)
+
+	// Fill out final envelope & pending payload protos, then write to storage.
+	payload, err := proto.Marshal(&pb.Envelope{
+		Message: message,
+		Nonce:   nonce,
+		Version: envelopeVersion,
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not marshal envelope proto: %v", err)
+	}
+	if size := payloadSize(payload); size > maxPayloadSize {
+		return 0, nil, payloadTooLargeError{size}
+	}
+	txPendingPayload := &pb.PendingPayload{
+		Payload:        payload,
+		NotificationId: notificationID(serverID, txSeq),
+		EnqueueTime:    enqueueTime,
+		AndroidConfig:  requestAndroidConfig(req),
+		Silent:         req.Notification.GetSilent(),
+		Priority:       req.Priority,
+		DelayWhileIdle: req.Notification.GetDelayWhileIdle(),
+		Channel:        req.Notification.GetCategory(),
+		Test:           test,
+	}
+	ppBytes, err := proto.Marshal(txPendingPayload)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not marshal pending payload proto: %v", err)
+	}
+	if err := messagesBucket.Put(seqKey(txSeq), ppBytes); err != nil {
+		return 0, nil, fmt.Errorf("could not write message to state: %v", err)
+	}
+	return txSeq, txPendingPayload, nil
+}
+
+// sanitize removes control characters (other than newlines & tabs) from s. If
+// escapeHTML is set, HTML special characters are escaped as well.
+func sanitize(s string, escapeHTML bool) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
 		}
+		return r
+	}, s)
+	if escapeHTML {
+		s = html.EscapeString(s)
+	}
+	return s
+}
+
+// validateNotificationURL verifies that u, if set, is an absolute URI which
+// the app can open: either an http(s) URL or a deep link with an app scheme.
+func validateNotificationURL(u string) error {
+	if u == "" {
 		return nil
-	}); err != nil {
-		log.Printf("Error while posting notification: %v", err)
-		return nil, errors.New("internal error")
 	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	switch {
+	case parsed.Scheme == "":
+		return errors.New("missing scheme")
+	case (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host == "":
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// dispatch starts sending the payload with the given sequence number, once
+// the in-flight limit allows. Once the service begins draining, the payload
+// is instead left for drain to send.
+func (ns *notificationService) dispatch(seq uint64) {
+	ns.dispatchThen(seq, nil)
+}
+
+// dispatchThen is dispatch, calling then (if non-nil) once sendPayload
+// returns. then is not called once the service has begun draining, since
+// sendPayload may then have returned leaving the payload pending for drain.
+func (ns *notificationService) dispatchThen(seq uint64, then func()) {
+	if ns.inFlight != nil {
+		ns.inFlight.Acquire(context.Background(), 1)
+	}
+	if !ns.startSenders(1) {
+		ns.releaseInFlight()
+		return
+	}
+	go func() {
+		ns.sendPayload(seq)
+		if then != nil && !ns.isStopping() {
+			then()
+		}
+	}()
+}
+
+func (ns *notificationService) releaseInFlight() {
+	ns.releaseInFlightN(1)
+}
 
-	// Kick off goroutine to actually send notification and return success.
-	go ns.sendPayload(seq)
-	return &pb.SendNotificationResponse{}, nil
+// releaseInFlightN releases n in-flight slots at once.
+func (ns *notificationService) releaseInFlightN(n int) {
+	if ns.inFlight != nil && n > 0 {
+		ns.inFlight.Release(int64(n))
+	}
 }
 
+// sendPayload sends the payload with the given sequence number, retrying as
+// necessary, until it is sent, it runs out of retries, or the service begins
+// draining. The caller must have acquired an in-flight slot, which is
+// released when sendPayload returns, and must have added to ns.senders with
+// startSenders.
 func (ns *notificationService) sendPayload(seq uint64) {
-	key := make([]byte, binary.Size(seq))
-	binary.BigEndian.PutUint64(key, seq)
+	defer ns.senders.Done()
+	defer ns.releaseInFlight()
+	atomic.AddInt64(&ns.activeSenders, 1)
+	defer atomic.AddInt64(&ns.activeSenders, -1)
+	id := fmt.Sprint(seq) // used in log lines; replaced by the notification ID once known
 
+	var retryAfter time.Duration // minimum wait requested by FCM after the previous attempt
 	for {
-		// Read & update payload in state.
-		var payload []byte
-		var sendAttempts int
-		if err := ns.db.Batch(func(tx *bolt.Tx) error {
-			messagesBucket := tx.Bucket([]byte("pending_messages"))
-			if messagesBucket == nil {
-				return errors.New("missing pending_messages bucket")
-			}
-			ppBytes := messagesBucket.Get(key)
-			if ppBytes == nil {
-				return errors.New("pending payload missing from state")
-			}
-			pendingPayload := &pb.PendingPayload{}
-			if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
-				return fmt.Errorf("could not unmarshal pending payload: %v", err)
-			}
-			payload = pendingPayload.Payload
-			sendAttempts = int(pendingPayload.SendAttempts)
-			if sendAttempts < len(waits) {
-				pendingPayload.SendAttempts++
-				ppBytes, err := proto.Marshal(pendingPayload)
-				if err != nil {
-					return fmt.Errorf("could not marshal pending payload: %v", err)
-				}
-				if err := messagesBucket.Put(key, ppBytes); err != nil {
-					return fmt.Errorf("could not write pending payload: %v", err)
-				}
-			} else {
-				// We are out of retries.
-				if err := messagesBucket.Delete(key); err != nil {
-					return fmt.Errorf("could not delete pending payload: %v", err)
-				}
-			}
-			return nil
-		}); err != nil {
+		if ns.isStopping() || !ns.waitForRegistration() {
+			return
+		}
+		pendingPayload, registrationID, err := ns.beginAttempt(seq)
+		if err != nil {
 			// Most/all errors that occur here are unrecoverable, so give up.
-			log.Printf("[%d] Could not read and update payload: %v", seq, err)
+			log.Printf("[%s] Could not read and update payload: %v", id, err)
 			return
 		}
-		if sendAttempts >= len(waits) {
-			log.Printf("[%d] Too many retries, giving up", seq)
+		if pendingPayload.NotificationId != "" {
+			id = pendingPayload.NotificationId
+		}
+		decision := scheduleRetry(int(pendingPayload.SendAttempts), retryAfter)
+		if decision.giveUp {
+			log.Printf("[%s] Too many retries, giving up; moved to dead-letter queue", id)
 			return
 		}
-		waitTime := waits[sendAttempts]
-		if waitTime > 0 {
-			log.Printf("[%d] Waiting %v before retry", seq, waitTime)
-			time.Sleep(waitTime)
+		log.Printf("[%s] Next attempt at %v: %v", id, ns.now().Add(decision.wait).Format(time.RFC3339), decision)
+		if decision.wait > 0 {
+			ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_Backoff{Backoff: &pb.ServerEvent_BackoffStarted{
+				Seq:            seq,
+				NotificationId: pendingPayload.NotificationId,
+				SendAttempts:   pendingPayload.SendAttempts,
+				Wait:           ptypes.DurationProto(decision.wait),
+			}}})
+			select {
+			case <-ns.after(decision.wait):
+			case <-ns.stopping:
+				return
+			}
+		}
+		if !ns.holdLowPriority(pendingPayload) || !ns.breaker.wait(ns.stopping) {
+			return
 		}
 
 		// Post notification.
-		if err := ns.postPayloadToFCM(payload); err != nil {
-			log.Printf("[%d] Could not post notification: %v", seq, err)
+		if err := ns.postPayload(pendingPayload, registrationID); err != nil {
+			log.Printf("[%s] Could not post notification: %v", id, err)
+			ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_GcmError{GcmError: &pb.ServerEvent_GCMError{
+				Seq:            seq,
+				NotificationId: pendingPayload.NotificationId,
+				Error:          err.Error(),
+			}}})
+			if err == errNotRegistered {
+				ns.handleNotRegistered(registrationID)
+			}
+			ns.recordAttemptFailure(seq, err)
+			retryAfter = 0
+			if rae, ok := err.(retryAfterError); ok {
+				retryAfter = rae.retryAfter
+				retryAfterRespected.Inc()
+			}
 			continue
 		}
+		log.Printf("[%s] Sent notification", id)
+		ns.finishSend(seq, pendingPayload)
+		return
+	}
+}
 
-		// Remove sent notification from the pending queue.
-		if err := ns.db.Batch(func(tx *bolt.Tx) error {
-			messagesBucket := tx.Bucket([]byte("pending_messages"))
-			if messagesBucket == nil {
-				return errors.New("missing pending_messages bucket")
-			}
+// beginAttempt reads the pending payload with the given sequence number &
+// records a new send attempt. It returns the payload as it was before the new attempt was
+// recorded, along with the registration ID it is encrypted for. If the
+// payload is out of retries, it is instead moved to the dead-letter queue;
+// callers should check for this with scheduleRetry.
+func (ns *notificationService) beginAttempt(seq uint64) (*pb.PendingPayload, string, error) {
+	key := seqKey(seq)
+	var pendingPayload *pb.PendingPayload
+	attemptTime, err := ptypes.TimestampProto(ns.now())
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create attempt timestamp: %v", err)
+	}
+	ns.rekeyMu.RLock()
+	registrationID := ns.creds().registrationID
+	err = ns.db.Batch(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		ppBytes := messagesBucket.Get(key)
+		if ppBytes == nil {
+			return errors.New("pending payload missing from state")
+		}
+		pendingPayload = &pb.PendingPayload{}
+		if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
+			return fmt.Errorf("could not unmarshal pending payload: %v", err)
+		}
+		if scheduleRetry(int(pendingPayload.SendAttempts), 0).giveUp {
+			// We are out of retries.
 			if err := messagesBucket.Delete(key); err != nil {
-				return fmt.Errorf("error while deleting sent message: %v", err)
+				return fmt.Errorf("could not delete pending payload: %v", err)
 			}
-			return nil
-		}); err != nil {
-			// We'll return; I guess we'll try to clean up again whenever the server restarts.
-			log.Printf("[%d] Could not remove notification: %v", seq, err)
+			return putDeadLetter(tx, seq, pendingPayload, pb.DeadLetter_TOO_MANY_RETRIES)
+		}
+		updatedPayload := proto.Clone(pendingPayload).(*pb.PendingPayload)
+		updatedPayload.SendAttempts++
+		updatedPayload.LastAttemptTime = attemptTime
+		ppBytes, err := proto.Marshal(updatedPayload)
+		if err != nil {
+			return fmt.Errorf("could not marshal pending payload: %v", err)
+		}
+		if err := messagesBucket.Put(key, ppBytes); err != nil {
+			return fmt.Errorf("could not write pending payload: %v", err)
 		}
+		return nil
+	})
+	ns.rekeyMu.RUnlock()
+	if err != nil {
+		return nil, "", err
+	}
+	if scheduleRetry(int(pendingPayload.SendAttempts), 0).giveUp {
+		ns.publishEvent(seq, pendingPayload, pb.StatusResponse_FAILED)
+	}
+	return pendingPayload, registrationID, nil
+}
+
+// recordAttemptFailure records, as the pending payload with the given
+// sequence number's last error, that an attempt to send it just failed with
+// the given error. It is recorded immediately, rather than with the next
+// attempt, so that it is visible while the payload waits to be retried, and
+// survives a restart. Errors are logged rather than returned: the payload
+// is retried regardless.
+func (ns *notificationService) recordAttemptFailure(seq uint64, failure error) {
+	failureTime, err := ptypes.TimestampProto(ns.now())
+	if err != nil {
+		log.Printf("[%d] Warning: could not create failure timestamp: %v", seq, err)
 		return
 	}
+	key := seqKey(seq)
+	if err := ns.db.Batch(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		ppBytes := messagesBucket.Get(key)
+		if ppBytes == nil {
+			// The payload was removed (e.g. cancelled) in the meantime.
+			return nil
+		}
+		pendingPayload := &pb.PendingPayload{}
+		if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
+			return fmt.Errorf("could not unmarshal pending payload: %v", err)
+		}
+		pendingPayload.LastError = failure.Error()
+		pendingPayload.LastErrorTime = failureTime
+		ppBytes, err := proto.Marshal(pendingPayload)
+		if err != nil {
+			return fmt.Errorf("could not marshal pending payload: %v", err)
+		}
+		return messagesBucket.Put(key, ppBytes)
+	}); err != nil {
+		log.Printf("[%d] Warning: could not record failed attempt: %v", seq, err)
+	}
+}
+
+// finishSend moves a sent notification from the pending queue to the history.
+func (ns *notificationService) finishSend(seq uint64, pendingPayload *pb.PendingPayload) {
+	id := pendingPayload.NotificationId
+	sentMessage, err := ns.sentMessage(seq, pendingPayload)
+	if err != nil {
+		log.Printf("[%s] Could not build history record: %v", id, err)
+	}
+	if err := ns.db.Batch(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		if err := messagesBucket.Delete(seqKey(seq)); err != nil {
+			return fmt.Errorf("error while deleting sent message: %v", err)
+		}
+		if sentMessage != nil {
+			return putSentMessage(tx, sentMessage)
+		}
+		return nil
+	}); err != nil {
+		// I guess we'll try to clean up again whenever the server restarts.
+		log.Printf("[%s] Could not remove notification: %v", id, err)
+	}
+	ns.publishEvent(seq, pendingPayload, pb.StatusResponse_SENT)
+}
+
+// postPayload sends a payload to the device with the given registration ID.
+func (ns *notificationService) postPayload(pendingPayload *pb.PendingPayload, registrationID string) error {
+	if ns.echo != nil {
+		return ns.echo.receive(pendingPayload.Payload)
+	}
+	if ns.rateQueue != nil {
+		ns.rateQueue.wait(pendingPayload.Priority)
+	}
+	return ns.postPayloadToFCM(pendingPayload, registrationID)
+}
+
+// postPayloadToFCM sends a payload to FCM, moving on to the next API key if
+// one is out of quota.
+func (ns *notificationService) postPayloadToFCM(pendingPayload *pb.PendingPayload, registrationID string) error {
+	for {
+		apiKey := ns.apiKeys.pick()
+		err := ns.postPayloadWithKey(pendingPayload, registrationID, apiKey)
+		if isGCMError(err, "QuotaExceeded") && ns.apiKeys.exhaust(apiKey) {
+			continue
+		}
+		return err
+	}
 }
 
-func (ns *notificationService) postPayloadToFCM(payload []byte) error {
+func (ns *notificationService) postPayloadWithKey(pendingPayload *pb.PendingPayload, registrationID, apiKey string) error {
 	// Set up request.
 	values := url.Values{}
-	values.Set("restricted_package_name", bnotifyPackageName)
-	values.Set("registration_id", ns.registrationID)
-	values.Set("data.payload", base64.StdEncoding.EncodeToString(payload))
+	setAndroidConfigValues(values, mergeAndroidConfig(ns.androidConfig, pendingPayload.AndroidConfig), ns.packageName)
+	values.Set("registration_id", registrationID)
+	if pendingPayload.Silent || pendingPayload.Priority == pb.Priority_LOW {
+		// FCM expects high priority to be used only for messages which result
+		// in a user-visible notification, so be explicit that this is not one
+		// (or that it is not urgent).
+		values.Set("priority", "normal")
+	}
+	if pendingPayload.DelayWhileIdle {
+		values.Set("delay_while_idle", "true")
+	}
+	values.Set("data.payload", base64.StdEncoding.EncodeToString(pendingPayload.Payload))
 
-	req, err := http.NewRequest("POST", fcmSendAddress, strings.NewReader(values.Encode()))
+	req, err := http.NewRequest("POST", ns.fcmAddress, strings.NewReader(values.Encode()))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
-	req.Header.Add("Authorization", fmt.Sprintf("key=%s", ns.apiKey))
+	req.Header.Add("Authorization", fmt.Sprintf("key=%s", apiKey))
 
 	// Make request to GCM server.
+	ns.recordFCMRequest(registrationID)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		ns.breaker.record(false)
+		if err := ns.recorder.record(ns.fcmAddress, values, nil, nil, err); err != nil {
+			log.Printf("Warning: could not record FCM request: %v", err)
+		}
 		return err
 	}
 	defer resp.Body.Close()
+	ns.breaker.record(resp.StatusCode < 500)
+
+	// Limit the response length to avoid reading unexpectedly large responses into memory.
+	// The full (limited) response is logged if debug logging is enabled, and
+	// recorded if requested.
+	body := io.LimitReader(resp.Body, maxLogResponseBytes)
+	if *logLevel == "debug" || ns.recorder != nil {
+		bodyBytes, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		debugf("FCM response: %v, headers: %v, body: %q", resp.Status, resp.Header, bodyBytes)
+		if err := ns.recorder.record(ns.fcmAddress, values, resp, bodyBytes, nil); err != nil {
+			log.Printf("Warning: could not record FCM response: %v", err)
+		}
+		body = bytes.NewReader(bodyBytes)
+	}
 
 	// Check for HTTP error code.
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("GCM HTTP error: %v", resp.Status)
+		err := withRetryAfter(fmt.Errorf("GCM HTTP error: %v", resp.Status), resp.Header)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			ns.noteThrottled(err)
+		}
+		return err
 	}
 
 	// Read the first line of the response and figure out if it indicates a GCM-level error.
-	bodyReader := bufio.NewReader(resp.Body)
+	bodyReader := bufio.NewReader(body)
 	lineBytes, _, err := bodyReader.ReadLine()
 	if err != nil {
 		return err
 	}
 	line := string(lineBytes)
 	if strings.HasPrefix(line, "Error=") {
-		return fmt.Errorf("GCM error: %v", strings.TrimPrefix(line, "Error="))
+		gcmErr := strings.TrimPrefix(line, "Error=")
+		if gcmErr == "NotRegistered" {
+			return errNotRegistered
+		}
+		err := withRetryAfter(gcmError(gcmErr), resp.Header)
+		if throttlingErrors[gcmErr] {
+			ns.noteThrottled(err)
+		}
+		return err
 	}
 	return nil
 }
 
+// throttlingErrors are the GCM errors indicating that a rate limit was exceeded.
+var throttlingErrors = map[string]bool{
+	"DeviceMessageRateExceeded": true,
+	"TopicsMessageRateExceeded": true,
+	"QuotaExceeded":             true,
+}
+
+// gcmError is an error code returned by GCM in the response body.
+type gcmError string
+
+func (e gcmError) Error() string {
+	return fmt.Sprintf("GCM error: %s", string(e))
+}
+
+// isGCMError returns true if err is (or wraps, with a Retry-After) the given GCM error.
+func isGCMError(err error, code string) bool {
+	if rae, ok := err.(retryAfterError); ok {
+		err = rae.err
+	}
+	return err == gcmError(code)
+}
+
+// noteThrottled records that FCM throttled a request, failing with err.
+func (ns *notificationService) noteThrottled(err error) {
+	var retryAfter time.Duration
+	if rae, ok := err.(retryAfterError); ok {
+		retryAfter = rae.retryAfter
+	}
+	ns.quota.throttled(retryAfter)
+	log.Printf("Warning: FCM throttled requests until %v: %v", time.Now().Add(retryAfter).Format(time.RFC3339), err)
+}
+
+// retryAfterError is an error from FCM which requested that the request not
+// be retried until some time has passed.
+type retryAfterError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.err, e.retryAfter)
+}
+
+// withRetryAfter wraps err in a retryAfterError if the given response headers
+// include a valid Retry-After header; otherwise, err is returned unmodified.
+func withRetryAfter(err error, header http.Header) error {
+	v := header.Get("Retry-After")
+	if v == "" {
+		return err
+	}
+	if secs, parseErr := strconv.Atoi(v); parseErr == nil && secs >= 0 {
+		return retryAfterError{err, time.Duration(secs) * time.Second}
+	}
+	if t, parseErr := http.ParseTime(v); parseErr == nil {
+		retryAfter := time.Until(t)
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		return retryAfterError{err, retryAfter}
+	}
+	return err
+}
+
+// debugf logs a message if debug logging is enabled.
+func debugf(format string, v ...interface{}) {
+	if *logLevel == "debug" {
+		log.Printf(format, v...)
+	}
+}
+
 func main() {
+	// Parse flags & determine subcommand. Flags may be given either before or after the subcommand.
 	flag.Parse()
+	cmd := "serve"
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if *logLevel != "debug" && *logLevel != "info" {
+		log.Fatalf("--log-level must be one of debug, info")
+	}
+
+	if *pipeMode {
+		pipe()
+		return
+	}
+
+	switch cmd {
+	case "serve":
+		serve()
+	case "generate-server-id":
+		generateServerID()
+	case "rotate-server-id":
+		rotateServerIDCmd()
+	case "restore":
+		restore()
+	case "generate-vapid-key":
+		generateVAPIDKey()
+	case "show-vapid-public-key":
+		showVAPIDPublicKey()
+	case "describe":
+		describe()
+	case "config":
+		subcmd := flag.Arg(0)
+		if flag.NArg() > 0 {
+			flag.CommandLine.Parse(flag.Args()[1:])
+		}
+		switch subcmd {
+		case "export":
+			configExport()
+		default:
+			log.Fatalf("Unknown config subcommand %q", subcmd)
+		}
+	default:
+		log.Fatalf("Unknown subcommand %q", cmd)
+	}
+}
+
+// generateServerID writes a new, random, hex-encoded server ID to the file specified by --output.
+func generateServerID() {
+	if *output == "" {
+		log.Fatalf("--output is required")
+	}
+	serverID := make([]byte, serverIDSize)
+	if _, err := rand.Read(serverID); err != nil {
+		log.Fatalf("Error generating server ID: %v", err)
+	}
+	if err := ioutil.WriteFile(*output, []byte(hex.EncodeToString(serverID)+"\n"), 0600); err != nil {
+		log.Fatalf("Error writing server ID: %v", err)
+	}
+}
 
-	// Read settings.
-	settingsBytes, err := ioutil.ReadFile(*settingsFilename)
+// errBadServerID is returned by checkServerID for a server ID of the wrong length.
+var errBadServerID = fmt.Errorf("server ID in state file is not %d bytes; it may be corrupt (restart bnotifyd with --repair-server-id to replace it)", serverIDSize)
+
+// checkServerID verifies that a server ID read from the state file is
+// present & usable in a nonce.
+func checkServerID(serverID []byte) error {
+	if serverID == nil {
+		return errors.New("missing serverID")
+	}
+	if len(serverID) != serverIDSize {
+		return errBadServerID
+	}
+	return nil
+}
+
+// readServerIDFile reads a hex-encoded server ID from the given file.
+func readServerIDFile(filename string) ([]byte, error) {
+	idBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	serverID, err := hex.DecodeString(strings.TrimSpace(string(idBytes)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode server ID: %v", err)
+	}
+	if len(serverID) != serverIDSize {
+		return nil, fmt.Errorf("server ID is %d bytes, expected %d", len(serverID), serverIDSize)
+	}
+	return serverID, nil
+}
+
+func serve() {
+	// Resolve file locations & read settings. In test mode, there is no
+	// settings file & the state file is temporary.
+	var settingsPath, statePath string
+	var settings *pb.BNotifySettings
+	fcmAddress := fcmSendAddress
+	listenPort := *port
+	if *testMode {
+		dir, path, err := testModeStatePath()
+		if err != nil {
+			log.Fatalf("Error creating temporary state directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		statePath = path
+		if settings, err = testModeSettings(); err != nil {
+			log.Fatalf("Error generating test mode settings: %v", err)
+		}
+		fcm := startFakeFCM()
+		defer fcm.Close()
+		fcmAddress = fcm.URL
+		listenPort = 0
+		log.Printf("Test mode: using temporary state file %s & fake FCM server at %s", statePath, fcmAddress)
+	} else {
+		var err error
+		settingsPath, statePath, err = resolvePaths()
+		if err != nil {
+			log.Fatalf("Error resolving file locations: %v", err)
+		}
+		if *printPaths {
+			fmt.Printf("settings: %s\nstate: %s\n", settingsPath, statePath)
+			return
+		}
+		log.Printf("Using settings file %s", settingsPath)
+		log.Printf("Using state file %s", statePath)
+
+		if settings, err = readSettings(settingsPath); err != nil {
+			log.Fatalf("Error reading settings file: %v", err)
+		}
+	}
+	validationRules, err := compileValidationRules(settings.ValidationRules)
+	if err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	localizer, err := newLocalizer(settings.Locale, settings.MessageOverrides)
 	if err != nil {
 		log.Fatalf("Error reading settings file: %v", err)
 	}
-	settings := &pb.BNotifySettings{}
-	err = proto.UnmarshalText(string(settingsBytes), settings)
+	enrichers, err := compileEnrichers(settings.Enrichers)
 	if err != nil {
 		log.Fatalf("Error reading settings file: %v", err)
 	}
+	if err := validateEnvelopeProducers(settings.EnvelopeProducers); err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	if err := validateChecks(settings.Checks); err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	if err := validateWebhooks(settings.Webhooks); err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	if err := validateAndroidConfig(settings.AndroidConfig); err != nil {
+		log.Fatalf("Error reading settings file: bad android_config: %v", err)
+	}
+	drainTimeout := resolveDrainTimeout(settings)
 
 	// Open state database & initialize if need be.
-	db, err := bolt.Open(*stateFilename, 0640, &bolt.Options{Timeout: time.Second})
+	if err := prepareStateDir(statePath); err != nil {
+		log.Fatalf("Error preparing state file: %v", err)
+	}
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		log.Fatalf("Error opening state file: %v", err)
 	}
 	defer db.Close()
 
-	var serverID []byte
-	var pendingSeqs []uint64
-	if err := db.Update(func(tx *bolt.Tx) error {
-		messagesBucket, err := tx.CreateBucketIfNotExists([]byte("pending_messages"))
-		if err != nil {
-			return fmt.Errorf("could not create pending_messages bucket: %v", err)
+	serverID, historySalt, pendingSeqs, err := initState(db, settings)
+	if err != nil {
+		log.Fatalf("Error initializing state file: %v", err)
+	}
+	if *maxReplayAge > 0 {
+		if pendingSeqs, err = dropStaleBacklog(db, pendingSeqs, *maxReplayAge); err != nil {
+			log.Fatalf("Error dropping stale pending messages: %v", err)
 		}
-		messagesBucket.ForEach(func(key, _ []byte) error {
-			pendingSeqs = append(pendingSeqs, binary.BigEndian.Uint64(key))
-			return nil
-		})
+	}
 
-		settingsBucket, err := tx.CreateBucketIfNotExists([]byte("settings"))
+	// Derive key & initialize cipher.
+	gcmCipher, err := newCipher(settings.Password, settings.RegistrationId, len(serverID)+binary.Size(uint64(0)))
+	if err != nil {
+		log.Fatalf("Error initializing cipher: %v", err)
+	}
+
+	// Set up the echo receiver, if requested.
+	var echo *echoReceiver
+	if *echoFilename != "" {
+		out := io.Writer(os.Stdout)
+		if *echoFilename != "-" {
+			f, err := os.OpenFile(*echoFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				log.Fatalf("Error opening echo file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		if echo, err = newEchoReceiver(settings.Password, settings.RegistrationId, out); err != nil {
+			log.Fatalf("Error initializing echo receiver: %v", err)
+		}
+		log.Printf("Echo mode: notifications will be decrypted & written to %s rather than sent", *echoFilename)
+	}
+
+	// Set up the FCM recorder, if requested.
+	var recorder *fcmRecorder
+	if *recordFilename != "" {
+		f, err := os.OpenFile(*recordFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
-			return fmt.Errorf("error creating settings bucket: %v", err)
+			log.Fatalf("Error opening record file: %v", err)
 		}
-		if serverID = settingsBucket.Get([]byte("serverID")); serverID == nil {
-			serverID = make([]byte, serverIDSize)
-			if _, err := rand.Read(serverID); err != nil {
-				return fmt.Errorf("error generating server ID: %v", err)
-			}
-			if err := settingsBucket.Put([]byte("serverID"), serverID); err != nil {
-				return fmt.Errorf("error setting server ID: %v", err)
-			}
+		defer f.Close()
+		recorder = newFCMRecorder(f)
+		log.Printf("Recording FCM requests & responses to %s", *recordFilename)
+	}
+
+	// Set up rate limiting, if requested.
+	var limiter *rate.Limiter
+	if settings.GcmMaxSendsPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(settings.GcmMaxSendsPerSecond), int(math.Max(1, math.Ceil(settings.GcmMaxSendsPerSecond))))
+		if err := restoreLimiterState(db, limiter, time.Now()); err != nil {
+			log.Fatalf("Error restoring rate limiter state: %v", err)
 		}
-		return nil
-	}); err != nil {
-		log.Fatalf("Error initializing state file: %v", err)
 	}
 
-	// Derive key from password & salt (registration ID).
-	key := pbkdf2.Key([]byte(settings.Password), []byte(settings.RegistrationId), pbkdfIterCount, aesKeySize, sha1.New)
+	// Set up the in-flight message limit, if requested.
+	var inFlight *semaphore.Weighted
+	if settings.MaxInFlightMessages > 0 {
+		inFlight = semaphore.NewWeighted(settings.MaxInFlightMessages)
+	}
 
-	// Initialize cipher based on key.
-	blockCipher, err := aes.NewCipher(key)
-	if err != nil {
-		log.Fatalf("Error initializing block cipher: %v", err)
+	// Set up quota tracking.
+	quota := newQuotaTracker(settings)
+	if err := quota.restore(db); err != nil {
+		log.Fatalf("Error restoring quota state: %v", err)
 	}
-	gcmCipher, err := cipher.NewGCMWithNonceSize(blockCipher, len(serverID)+binary.Size(uint64(0)))
+	apiKeys, err := newAPIKeyRing(db, settings)
 	if err != nil {
-		log.Fatalf("Error initializing GCM cipher: %v", err)
+		log.Fatalf("Error restoring API key state: %v", err)
+	}
+
+	// Set up TOTP verification for admin RPCs, if requested.
+	var totp *totpVerifier
+	if settings.TotpSecret != "" {
+		if totp, err = newTOTPVerifier(settings.TotpSecret); err != nil {
+			log.Fatalf("Error reading settings: %v", err)
+		}
 	}
 
 	// Create service, socket, and gRPC server objects.
+	packageName := settings.PackageName
+	if packageName == "" {
+		packageName = bnotifyPackageName
+	}
+	serverEvents := newServerEventBroadcaster()
 	service := &notificationService{
-		db:             db,
-		apiKey:         settings.ApiKey,
-		registrationID: settings.RegistrationId,
-		gcmCipher:      gcmCipher,
+		db:              db,
+		apiKeys:         apiKeys,
+		password:        settings.Password,
+		adminToken:      settings.AdminToken,
+		totp:            totp,
+		fcmAddress:      fcmAddress,
+		echo:            echo,
+		recorder:        recorder,
+		inFlight:        inFlight,
+		payloadSizes:    newSizeSummary(),
+		sizeWarnBytes:   int(settings.PayloadSizeWarnBytes),
+		androidConfig:   settings.AndroidConfig,
+		packageName:     packageName,
+		sanitizeHTML:    settings.SanitizeHtml,
+		validationRules: validationRules,
+		localizer:       localizer,
+		enrichers:       enrichers,
+		stopping:        make(chan struct{}),
+		events:          newEventBroadcaster(),
+		serverEvents:    serverEvents,
+
+		drainOrder:          settings.DrainOrder,
+		drainOrderThreshold: int(settings.DrainOrderThreshold),
+
+		quota:           quota,
+		quotaWarnNotify: settings.QuotaWarnNotify,
+
+		historyMode: settings.HistoryMode,
+		historySalt: historySalt,
+
+		lowPriorityHold: settings.LowPriorityHoldThreshold,
+		lowPriorityWarn: time.Duration(settings.LowPriorityWarnSeconds) * time.Second,
+
+		envelopeProducers: settings.EnvelopeProducers,
+
+		tokens:          newTokenMonitor(),
+		tokenRefreshURL: settings.TokenRefreshWebhookUrl,
+
+		breaker: newCircuitBreaker(settings, serverEvents),
+
+		checks: settings.Checks,
+
+		recoveryWeights: settings.RecoveryChannelWeights,
+	}
+	if limiter != nil {
+		service.rateQueue = newRateQueue(limiter)
 	}
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	service.credentials.Store(&credentials{settings.RegistrationId, gcmCipher})
+	if *replicaFilename != "" {
+		service.replica = newReplicator(db, *replicaFilename, *replicaInterval)
+		log.Printf("Replicating state to %s every %v", *replicaFilename, *replicaInterval)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort))
 	if err != nil {
-		log.Fatalf("Error listening on port %d: %v", *port, err)
+		log.Fatalf("Error listening on port %d: %v", listenPort, err)
 	}
 	defer listener.Close()
-	server := grpc.NewServer()
+	listenPort = listener.Addr().(*net.TCPAddr).Port
+	if service.clientConfig, err = newClientConfig(settings, listenPort); err != nil {
+		log.Fatalf("Error building client configuration: %v", err)
+	}
+	server := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		// Allow the keepalive pings sent by bnotify (every 30s by default).
+		MinTime:             10 * time.Second,
+		PermitWithoutStream: true,
+	}))
 	pb.RegisterNotificationServiceServer(server, service)
 
 	// Begin serving.
-	for _, seq := range pendingSeqs {
-		go service.sendPayload(seq)
+	if settingsPath != "" {
+		go service.reloadSettingsOnSIGHUP(settingsPath)
+	}
+	go service.expireMutes()
+	go monitorClock()
+	go monitorStateFile(db, settings.FreePageWarnRatio)
+	go monitorBuckets(db, time.Duration(settings.DbStatsIntervalSeconds)*time.Second)
+	for _, sink := range settings.Webhooks {
+		// Watch before recovering the backlog, so that no event is missed.
+		go runWebhook(sink, watchWebhook(serverEvents, sink))
+	}
+	go service.recoverBacklog(pendingSeqs)
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	var pusher *push.Pusher
+	if *pushGatewayURL != "" {
+		pusher = newMetricsPusher(*pushGatewayURL, serverID)
+		go pushMetricsPeriodically(pusher, *pushInterval)
+		log.Printf("Pushing metrics to %s every %v", *pushGatewayURL, *pushInterval)
+	}
+	if limiter != nil {
+		go saveLimiterStatePeriodically(db, limiter)
+	}
+	go saveQuotaStatePeriodically(db, quota)
+	if len(settings.Checks) > 0 {
+		go service.monitorChecks()
+	}
+	if settings.TestNotificationIntervalMinutes > 0 {
+		go service.sendTestNotificationsPeriodically(time.Duration(settings.TestNotificationIntervalMinutes) * time.Minute)
+	}
+	if service.replica != nil {
+		go service.replica.run()
+	}
+
+	// Shut down gracefully on SIGINT or SIGTERM.
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		sig := <-ch
+		log.Printf("Received %v, shutting down", sig)
+		server.GracefulStop()
+	}()
+
+	log.Printf("Listening for requests on port %d", listenPort)
+	if *testMode {
+		fmt.Println(listenPort)
+	}
+	if err := server.Serve(listener); err != nil {
+		log.Printf("Error serving: %v", err)
+	}
+	service.drain(settings.DrainPolicy, drainTimeout)
+	if service.replica != nil {
+		if err := service.replica.snapshot(); err != nil {
+			log.Printf("Warning: could not replicate state to %s: %v", *replicaFilename, err)
+		}
 	}
-	log.Printf("Listening for requests on port %d", *port)
-	server.Serve(listener)
+	if limiter != nil {
+		if err := saveLimiterState(db, limiter, time.Now()); err != nil {
+			log.Printf("Error saving rate limiter state: %v", err)
+		}
+	}
+	if err := quota.save(db); err != nil {
+		log.Printf("Error saving quota state: %v", err)
+	}
+	if pusher != nil {
+		if err := pusher.Push(); err != nil {
+			log.Printf("Warning: could not push metrics to %s: %v", *pushGatewayURL, err)
+		}
+	}
+	log.Printf("Shut down")
+}
+
+// initState creates any missing buckets in the given state file & loads (or
+// generates) the server ID & history salt. It returns those, along with the
+// sequence numbers of the pending messages.
+func initState(db *bolt.DB, settings *pb.BNotifySettings) (serverID, historySalt []byte, pendingSeqs []uint64, _ error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		pendingSeqs = nil
+		messagesBucket, err := tx.CreateBucketIfNotExists([]byte("pending_messages"))
+		if err != nil {
+			return fmt.Errorf("could not create pending_messages bucket: %v", err)
+		}
+		messagesBucket.ForEach(func(key, _ []byte) error {
+			pendingSeqs = append(pendingSeqs, binary.BigEndian.Uint64(key))
+			return nil
+		})
+
+		if _, err := tx.CreateBucketIfNotExists([]byte("sent_messages")); err != nil {
+			return fmt.Errorf("could not create sent_messages bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("dead_letter")); err != nil {
+			return fmt.Errorf("could not create dead_letter bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("mutes")); err != nil {
+			return fmt.Errorf("could not create mutes bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("rate_limiters")); err != nil {
+			return fmt.Errorf("could not create rate_limiters bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("subscriptions")); err != nil {
+			return fmt.Errorf("could not create subscriptions bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("envelope_producers")); err != nil {
+			return fmt.Errorf("could not create envelope_producers bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("channel_counters")); err != nil {
+			return fmt.Errorf("could not create channel_counters bucket: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("checks")); err != nil {
+			return fmt.Errorf("could not create checks bucket: %v", err)
+		}
+		if err := initCheckStates(tx, settings.Checks); err != nil {
+			return err
+		}
+
+		settingsBucket, err := tx.CreateBucketIfNotExists([]byte("settings"))
+		if err != nil {
+			return fmt.Errorf("error creating settings bucket: %v", err)
+		}
+		if historySalt, err = loadHistorySalt(tx); err != nil {
+			return err
+		}
+		for _, field := range applyStateSettings(tx, settings) {
+			log.Printf("Warning: %s in the settings file differs from the value bnotifyd stored at runtime; using the stored value (see bnotifyd config export)", field)
+		}
+		var fileServerID []byte
+		if *serverIDFilename != "" {
+			if fileServerID, err = readServerIDFile(*serverIDFilename); err != nil {
+				return fmt.Errorf("error reading server ID file: %v", err)
+			}
+		}
+		// The server ID file only seeds a state file without a server ID: the
+		// stored server ID may since have been rotated, restored or repaired.
+		if serverID = settingsBucket.Get([]byte("serverID")); serverID == nil {
+			if fileServerID != nil {
+				// A fixed server ID may have been used with a previous state
+				// file, so make sure sequence numbers are not reused: seed the
+				// sequence from the clock, which is far above any sequence
+				// plausibly used before.
+				if seq := uint64(time.Now().UnixNano()); seq > messagesBucket.Sequence() {
+					if err := messagesBucket.SetSequence(seq); err != nil {
+						return fmt.Errorf("error seeding sequence number: %v", err)
+					}
+				}
+				serverID = fileServerID
+			} else {
+				serverID = make([]byte, serverIDSize)
+				if _, err := rand.Read(serverID); err != nil {
+					return fmt.Errorf("error generating server ID: %v", err)
+				}
+			}
+			if err := settingsBucket.Put([]byte("serverID"), serverID); err != nil {
+				return fmt.Errorf("error setting server ID: %v", err)
+			}
+		} else if fileServerID != nil && !bytes.Equal(serverID, fileServerID) {
+			log.Printf("Warning: the server ID in --server-id-file differs from the server ID bnotifyd stored (%x); using the stored value", serverID)
+		}
+		if len(serverID) != serverIDSize {
+			if !*repairServerID {
+				return fmt.Errorf("server ID in state file is %d bytes, expected %d; it may be corrupt. To replace it with a new server ID, restart with --repair-server-id (pending messages will be re-encrypted; the app will see notifications from a new server)", len(serverID), serverIDSize)
+			}
+			gcmCipher, err := stateCipher(tx, settings)
+			if err != nil {
+				return fmt.Errorf("error initializing cipher: %v", err)
+			}
+			newServerID, count, err := rotateServerID(tx, gcmCipher)
+			if err != nil {
+				return fmt.Errorf("error repairing server ID: %v", err)
+			}
+			log.Printf("Replaced corrupt %d-byte server ID with %x, re-encrypted %d pending message(s)", len(serverID), newServerID, count)
+			serverID = newServerID
+		}
+		// Values read from bolt are only valid for the life of the transaction.
+		serverID = append([]byte(nil), serverID...)
+		return nil
+	})
+	return serverID, historySalt, pendingSeqs, err
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+func TestSanitize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, test := range []struct {
+		desc       string
+		s          string
+		escapeHTML bool
+		want       string
+	}{
+		{"plain text", "Disk full on host", false, "Disk full on host"},
+		{"newlines & tabs kept", "line 1\n\tline 2", false, "line 1\n\tline 2"},
+		{"null bytes", "dis\x00k full\x00", false, "disk full"},
+		{"other control characters", "a\x07b\x1bc\x7fd\u0085e", false, "abcde"},
+		{"CRLF injection", "title\r\nX-Injected: 1", false, "title\nX-Injected: 1"},
+		{"bare carriage return", "progress\r100%", false, "progress100%"},
+		{"unicode kept", "Température élevée ☀", false, "Température élevée ☀"},
+		{"HTML kept without escaping", "<b>bold</b>", false, "<b>bold</b>"},
+		{"script tag", `<script>alert("x")</script>`, true, "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;"},
+		{"attribute injection", `<img src=x onerror='alert(1)'>`, true, "&lt;img src=x onerror=&#39;alert(1)&#39;&gt;"},
+		{"entity", "AT&T", true, "AT&amp;T"},
+		{"control characters & HTML", "<i>\x00hi\r\n</i>", true, "&lt;i&gt;hi\n&lt;/i&gt;"},
+	} {
+		if got := sanitize(test.s, test.escapeHTML); got != test.want {
+			t.Errorf("%s: sanitize(%q, %v) = %q, want %q", test.desc, test.s, test.escapeHTML, got, test.want)
+		}
+	}
+}
+
+func TestVerifyNotificationSanitizes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	ns.sanitizeHTML = true
+
+	req := testRequest("<script>\x00</script>")
+	req.Notification.Text = "a\r\nb"
+	if err := ns.verifyNotification(req); err != nil {
+		t.Fatalf("verifyNotification: %v", err)
+	}
+	if want := "&lt;script&gt;&lt;/script&gt;"; req.Notification.Title != want {
+		t.Errorf("Got title %q, want %q", req.Notification.Title, want)
+	}
+	if want := "a\nb"; req.Notification.Text != want {
+		t.Errorf("Got text %q, want %q", req.Notification.Text, want)
+	}
+}
+
+func TestEnqueueConcurrent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	gcmCipher := ns.creds().gcmCipher
+
+	// Concurrent enqueues are combined into shared Batch transactions, which
+	// bolt re-runs one at a time if any fails; each run must leave no trace.
+	const goroutines, perGoroutine = 50, 40
+	var mu sync.Mutex
+	seqs := map[uint64]string{} // sequence number → notification ID
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				seq, pendingPayload, err := ns.enqueue(testRequest(fmt.Sprintf("%d/%d", g, i)))
+				if err != nil {
+					t.Errorf("Could not enqueue message: %v", err)
+					return
+				}
+				mu.Lock()
+				if _, ok := seqs[seq]; ok {
+					t.Errorf("Sequence number %d returned twice", seq)
+				}
+				seqs[seq] = pendingPayload.NotificationId
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stored := pendingPayloads(t, ns)
+	if len(stored) != len(seqs) {
+		t.Errorf("Got %d pending messages, want %d", len(stored), len(seqs))
+	}
+	for seq, notificationID := range seqs {
+		pendingPayload, ok := stored[seq]
+		if !ok {
+			t.Errorf("Returned sequence number %d was not stored", seq)
+			continue
+		}
+		if pendingPayload.NotificationId != notificationID {
+			t.Errorf("Message %d has notification ID %q, returned %q", seq, pendingPayload.NotificationId, notificationID)
+		}
+		nonce, message := openTestPayload(t, gcmCipher, pendingPayload.Payload)
+		if message.Seq != seq {
+			t.Errorf("Message %d has sequence number %d", seq, message.Seq)
+		}
+		if len(message.ServerId) != serverIDSize {
+			t.Errorf("Message %d has %d-byte server ID, want %d bytes", seq, len(message.ServerId), serverIDSize)
+		}
+		if !bytes.Equal(nonce, makeNonce(message.ServerId, seq)) {
+			t.Errorf("Message %d has nonce %x, want %x", seq, nonce, makeNonce(message.ServerId, seq))
+		}
+	}
+	for seq := range stored {
+		if _, ok := seqs[seq]; !ok {
+			t.Errorf("Stored sequence number %d was never returned", seq)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "../proto"
+)
+
+// defaultBreakerCooldown is the cool-down used if breaker_cooldown_seconds is unset.
+const defaultBreakerCooldown = time.Minute
+
+var (
+	breakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bnotify_circuit_breaker_state",
+		Help: "State of the circuit breaker around FCM: 0 (closed), 1 (open), or 2 (half-open).",
+	})
+	breakerOpens = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bnotify_circuit_breaker_opens_total",
+		Help: "Number of times the circuit breaker around FCM opened, pausing sends.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(breakerState, breakerOpens)
+}
+
+// circuitBreaker pauses all sends while FCM is unreachable, rather than
+// letting every pending message fail (and log) each of its attempts. A nil
+// *circuitBreaker never pauses sends.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	events    *serverEventBroadcaster // receives state changes
+
+	mu        sync.Mutex // protects all fields below
+	state     pb.GetStatusResponse_CircuitBreaker_State
+	since     time.Time     // when state was entered
+	failures  int           // consecutive transport-level failures
+	probeTime time.Time     // when the current half-open probe was let through, if any
+	changed   chan struct{} // closed & replaced whenever state changes
+}
+
+func newCircuitBreaker(settings *pb.BNotifySettings, events *serverEventBroadcaster) *circuitBreaker {
+	if settings.BreakerFailureThreshold <= 0 {
+		return nil
+	}
+	cooldown := time.Duration(settings.BreakerCooldownSeconds) * time.Second
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: int(settings.BreakerFailureThreshold),
+		cooldown:  cooldown,
+		events:    events,
+		since:     time.Now(),
+		changed:   make(chan struct{}),
+	}
+}
+
+// setState moves the breaker to the given state. The caller must hold cb.mu.
+func (cb *circuitBreaker) setState(state pb.GetStatusResponse_CircuitBreaker_State) {
+	cb.state, cb.since, cb.probeTime = state, time.Now(), time.Time{}
+	close(cb.changed)
+	cb.changed = make(chan struct{})
+	breakerState.Set(float64(state))
+	cb.events.publish(&pb.ServerEvent{Event: &pb.ServerEvent_BreakerStateChanged{BreakerStateChanged: &pb.ServerEvent_CircuitBreakerStateChanged{State: state}}})
+}
+
+// wait blocks until a send may be attempted: immediately while the breaker
+// is closed, or as the single probe once the cool-down ends. (If a probe
+// does not report back within a cool-down, another is let through.) It
+// returns false if stop is closed first.
+func (cb *circuitBreaker) wait(stop <-chan struct{}) bool {
+	if cb == nil {
+		return true
+	}
+	for {
+		cb.mu.Lock()
+		now := time.Now()
+		if cb.state == pb.GetStatusResponse_CircuitBreaker_OPEN && !now.Before(cb.since.Add(cb.cooldown)) {
+			log.Printf("Cool-down ended; probing FCM")
+			cb.setState(pb.GetStatusResponse_CircuitBreaker_HALF_OPEN)
+		}
+		if cb.state == pb.GetStatusResponse_CircuitBreaker_CLOSED {
+			cb.mu.Unlock()
+			return true
+		}
+		if cb.state == pb.GetStatusResponse_CircuitBreaker_HALF_OPEN && (cb.probeTime.IsZero() || !now.Before(cb.probeTime.Add(cb.cooldown))) {
+			cb.probeTime = now
+			cb.mu.Unlock()
+			return true
+		}
+		retry := cb.since.Add(cb.cooldown)
+		if cb.state == pb.GetStatusResponse_CircuitBreaker_HALF_OPEN {
+			retry = cb.probeTime.Add(cb.cooldown)
+		}
+		changed := cb.changed
+		cb.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(time.Until(retry)):
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// record records the transport-level outcome of a request to FCM: ok is true
+// if FCM responded at all, other than with a server error.
+func (cb *circuitBreaker) record(ok bool) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if ok {
+		cb.failures = 0
+		if cb.state != pb.GetStatusResponse_CircuitBreaker_CLOSED {
+			log.Printf("FCM is reachable again; resuming sends")
+			cb.setState(pb.GetStatusResponse_CircuitBreaker_CLOSED)
+		}
+		return
+	}
+	cb.failures++
+	switch cb.state {
+	case pb.GetStatusResponse_CircuitBreaker_HALF_OPEN:
+		log.Printf("Warning: probe could not reach FCM; pausing sends for %v", cb.cooldown)
+		cb.setState(pb.GetStatusResponse_CircuitBreaker_OPEN)
+	case pb.GetStatusResponse_CircuitBreaker_CLOSED:
+		if cb.failures >= cb.threshold {
+			log.Printf("Warning: %d consecutive requests could not reach FCM; pausing sends for %v", cb.failures, cb.cooldown)
+			cb.setState(pb.GetStatusResponse_CircuitBreaker_OPEN)
+			breakerOpens.Inc()
+		}
+	}
+}
+
+// isClosed returns true if sends are not paused.
+func (cb *circuitBreaker) isClosed() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == pb.GetStatusResponse_CircuitBreaker_CLOSED
+}
+
+// status fills in the circuit breaker field of resp.
+func (cb *circuitBreaker) status(resp *pb.GetStatusResponse) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	since, _ := ptypes.TimestampProto(cb.since)
+	resp.CircuitBreaker = &pb.GetStatusResponse_CircuitBreaker{
+		State:               cb.state,
+		Since:               since,
+		ConsecutiveFailures: int32(cb.failures),
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+func (ns *notificationService) GetClientConfig(ctx context.Context, req *pb.GetClientConfigRequest) (*pb.GetClientConfigResponse, error) {
+	if err := ns.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	version := ns.clientConfig.ConfigVersion
+	if req.CurrentVersion == version {
+		return &pb.GetClientConfigResponse{Version: version, Unchanged: true}, nil
+	}
+	return &pb.GetClientConfigResponse{Version: version, Config: ns.clientConfig}, nil
+}
+
+// newClientConfig builds the configuration served to clients from settings
+// & the port bnotifyd is actually listening on. The configuration's version
+// is derived from its content, so it changes exactly when the content does.
+func newClientConfig(settings *pb.BNotifySettings, listenPort int) (*pb.BNotifyClientSettings, error) {
+	cfg := &pb.BNotifyClientSettings{Host: settings.ClientHost}
+	if cfg.Host == "" {
+		cfg.Host = fmt.Sprintf("localhost:%d", listenPort)
+	}
+	cfgBytes, err := proto.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal client config: %v", err)
+	}
+	hash := sha256.Sum256(cfgBytes)
+	cfg.ConfigVersion = hex.EncodeToString(hash[:8])
+	return cfg, nil
+}
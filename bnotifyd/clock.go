@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// clockCheckInterval is how often the wall clock is compared against the monotonic clock.
+	clockCheckInterval = time.Minute
+
+	// clockJumpThreshold is how far the wall clock may drift from the
+	// monotonic clock between checks before a jump is reported.
+	clockJumpThreshold = 10 * time.Second
+)
+
+// clock tells the time & measures durations. It is injected so that tests can
+// simulate clock jumps.
+type clock interface {
+	// Now returns the current wall-clock time.
+	Now() time.Time
+	// After returns a channel receiving once d has elapsed, as measured by a
+	// monotonic clock.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the system's clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// now returns the current time according to the service's clock.
+func (ns *notificationService) now() time.Time {
+	if ns.clock == nil {
+		return time.Now()
+	}
+	return ns.clock.Now()
+}
+
+// after returns a channel receiving once d has elapsed according to the
+// service's clock.
+func (ns *notificationService) after(d time.Duration) <-chan time.Time {
+	if ns.clock == nil {
+		return time.After(d)
+	}
+	return ns.clock.After(d)
+}
+
+// monitorClock periodically compares elapsed wall-clock time against
+// elapsed monotonic time, logging a warning if the wall clock jumps.
+//
+// Retry scheduling is unaffected by jumps, since it sleeps for durations
+// (measured on the monotonic clock) rather than until wall-clock times; the
+// reported time of the next attempt is clamped (see scheduledAttemptTime).
+// The only wall-clock deadline is mute rule expiry, which a jump shifts by at
+// most the size of the jump; restored rate limiter state ignores save times
+// in the future.
+func monitorClock() {
+	last := time.Now()
+	for range time.Tick(clockCheckInterval) {
+		now := time.Now()
+		monotonic := now.Sub(last)
+		wall := now.Round(0).Sub(last.Round(0)) // Round(0) strips the monotonic reading.
+		if jump := wall - monotonic; jump > clockJumpThreshold || jump < -clockJumpThreshold {
+			clockJumps.Inc()
+			log.Printf("Warning: system clock jumped by %v (%v of wall-clock time passed in %v); timestamps recorded around this time may be inaccurate", jump, wall, monotonic)
+		}
+		last = now
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"go.uber.org/goleak"
+)
+
+// fakeClock is a clock whose wall-clock time can jump, & whose monotonic
+// time passes only when advanced.
+type fakeClock struct {
+	mu      sync.Mutex // protects all fields
+	now     time.Time
+	elapsed time.Duration // monotonic time passed
+	timers  []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Duration // elapsed time at which the timer fires
+	c        chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- fc.now
+		return c
+	}
+	fc.timers = append(fc.timers, fakeTimer{fc.elapsed + d, c})
+	return c
+}
+
+// jump moves the wall clock by d, without any monotonic time passing.
+func (fc *fakeClock) jump(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+// advance passes d of time, firing any timers which expire.
+func (fc *fakeClock) advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now, fc.elapsed = fc.now.Add(d), fc.elapsed+d
+	var timers []fakeTimer
+	for _, t := range fc.timers {
+		if t.deadline > fc.elapsed {
+			timers = append(timers, t)
+			continue
+		}
+		t.c <- fc.now
+	}
+	fc.timers = timers
+}
+
+// waiters returns the number of timers yet to fire.
+func (fc *fakeClock) waiters() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.timers)
+}
+
+// startFailingFCM starts a fake FCM which fails the first fail requests, then
+// accepts the rest. The number of requests received is stored in requests.
+func startFailingFCM(fail int64, requests *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt64(requests, 1); n <= fail {
+			fmt.Fprintln(w, "Error=Unavailable")
+			return
+		}
+		fmt.Fprintf(w, "id=0:%d\n", atomic.LoadInt64(requests))
+	}))
+}
+
+func TestRetryAcrossClockJumps(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, jump := range []time.Duration{-time.Hour, time.Hour} {
+		t.Run(fmt.Sprintf("jump %v", jump), func(t *testing.T) {
+			var requests int64
+			fcm := startFailingFCM(2, &requests)
+			defer fcm.Close()
+			ns, cleanup := newTestService(t, testSettings())
+			defer cleanup()
+			ns.fcmAddress = fcm.URL
+			fc := newFakeClock(time.Date(2017, 1, 1, 3, 26, 0, 0, time.UTC))
+			ns.clock = fc
+
+			seq, _, err := ns.enqueue(testRequest("jump"))
+			if err != nil {
+				t.Fatalf("Could not enqueue message: %v", err)
+			}
+			ns.dispatch(seq)
+
+			// The first attempt is immediate & fails; each retry waits for its
+			// backoff to pass on the monotonic clock, however the wall clock
+			// jumps in the meantime.
+			for attempt := 1; attempt <= 2; attempt++ {
+				eventually(t, fmt.Sprintf("retry %d is scheduled", attempt), func() bool {
+					return atomic.LoadInt64(&requests) == int64(attempt) && fc.waiters() == 1
+				})
+				fc.jump(jump)
+				time.Sleep(10 * time.Millisecond)
+				if got := atomic.LoadInt64(&requests); got != int64(attempt) {
+					t.Fatalf("Retry %d was made after the clock jumped by %v, before its backoff passed", attempt, jump)
+				}
+				fc.advance(waits[attempt] - time.Millisecond)
+				time.Sleep(10 * time.Millisecond)
+				if got := atomic.LoadInt64(&requests); got != int64(attempt) {
+					t.Fatalf("Retry %d was made before its backoff of %v passed", attempt, waits[attempt])
+				}
+				fc.advance(time.Millisecond)
+			}
+			ns.senders.Wait()
+
+			if got := atomic.LoadInt64(&requests); got != 3 {
+				t.Errorf("FCM received %d requests, want 3", got)
+			}
+			if pending := pendingPayloads(t, ns); len(pending) != 0 {
+				t.Errorf("Got %d pending messages after sending, want 0", len(pending))
+			}
+		})
+	}
+}
+
+func TestLastErrorRecordedBeforeRetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var requests int64
+	fcm := startFailingFCM(1, &requests)
+	defer fcm.Close()
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	ns.fcmAddress = fcm.URL
+	failTime := time.Date(2017, 1, 1, 3, 26, 0, 0, time.UTC)
+	fc := newFakeClock(failTime)
+	ns.clock = fc
+
+	seq, _, err := ns.enqueue(testRequest("last error"))
+	if err != nil {
+		t.Fatalf("Could not enqueue message: %v", err)
+	}
+	ns.dispatch(seq)
+
+	// While the retry waits out its backoff, the failure is already stored.
+	eventually(t, "retry is scheduled", func() bool {
+		return atomic.LoadInt64(&requests) == 1 && fc.waiters() == 1
+	})
+	pp := pendingPayloads(t, ns)[seq]
+	if pp == nil {
+		t.Fatalf("Message is not pending during backoff")
+	}
+	if want := gcmError("Unavailable").Error(); pp.LastError != want {
+		t.Errorf("LastError = %q, want %q", pp.LastError, want)
+	}
+	if got, err := ptypes.Timestamp(pp.LastErrorTime); err != nil || !got.Equal(failTime) {
+		t.Errorf("LastErrorTime = %v (err %v), want %v", got, err, failTime)
+	}
+
+	fc.advance(waits[1])
+	ns.senders.Wait()
+	if pending := pendingPayloads(t, ns); len(pending) != 0 {
+		t.Errorf("Got %d pending messages after sending, want 0", len(pending))
+	}
+}
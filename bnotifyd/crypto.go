@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/pbkdf2"
+
+	pb "../proto"
+)
+
+// newCipher derives the notification key from the password & salt
+// (registration ID), returning an AEAD cipher using that key which accepts
+// nonces of the given size.
+func newCipher(password, registrationID string, nonceSize int) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(password), []byte(registrationID), pbkdfIterCount, aesKeySize, sha1.New)
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize block cipher: %v", err)
+	}
+	gcmCipher, err := cipher.NewGCMWithNonceSize(blockCipher, nonceSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize GCM cipher: %v", err)
+	}
+	return gcmCipher, nil
+}
+
+// seqKey returns the big-endian encoding of seq, which is used as the key of
+// per-message state.
+func seqKey(seq uint64) []byte {
+	key := make([]byte, binary.Size(seq))
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// makeNonce returns the nonce used to encrypt the message with the given
+// server ID & sequence number: serverID || seq. The result never aliases
+// serverID.
+func makeNonce(serverID []byte, seq uint64) []byte {
+	nonce := make([]byte, 0, len(serverID)+binary.Size(seq))
+	nonce = append(nonce, serverID...)
+	return append(nonce, seqKey(seq)...)
+}
+
+// openPayload decrypts a payload produced by enqueue, returning the message it contains.
+func (ns *notificationService) openPayload(payload []byte) (*pb.Message, error) {
+	envelope := &pb.Envelope{}
+	if err := proto.Unmarshal(payload, envelope); err != nil {
+		return nil, fmt.Errorf("could not unmarshal envelope: %v", err)
+	}
+	plaintextMessage, err := ns.creds().gcmCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt message: %v", err)
+	}
+	message := &pb.Message{}
+	if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+		return nil, fmt.Errorf("could not unmarshal message: %v", err)
+	}
+	return message, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+const (
+	// checkPollInterval is how often dead man's switch checks are checked for missed deadlines.
+	checkPollInterval = 30 * time.Second
+
+	// checkDataKey is the notification data key whose value names a check to ping.
+	checkDataKey = "check"
+)
+
+// errUnknownCheck is returned by pingCheck for checks not configured in settings.
+var errUnknownCheck = errors.New("unknown check")
+
+func validateChecks(checks []*pb.DeadMansSwitch) error {
+	names := map[string]bool{}
+	for _, c := range checks {
+		if c.Name == "" {
+			return errors.New("check missing name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate check %q", c.Name)
+		}
+		names[c.Name] = true
+		if c.IntervalSeconds <= 0 {
+			return fmt.Errorf("check %q: interval_seconds must be positive", c.Name)
+		}
+		if c.GraceSeconds < 0 || c.RepeatSeconds < 0 {
+			return fmt.Errorf("check %q: grace_seconds & repeat_seconds must not be negative", c.Name)
+		}
+	}
+	return nil
+}
+
+// initCheckStates writes an initial state for each of the given checks which
+// has none, so that a newly configured check's interval starts now.
+func initCheckStates(tx *bolt.Tx, checks []*pb.DeadMansSwitch) error {
+	checksBucket := tx.Bucket([]byte("checks"))
+	if checksBucket == nil {
+		return errors.New("missing checks bucket")
+	}
+	now, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, c := range checks {
+		if checksBucket.Get([]byte(c.Name)) != nil {
+			continue
+		}
+		if err := putCheckState(checksBucket, c.Name, &pb.DeadMansSwitchState{LastPing: now}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCheckState(checksBucket *bolt.Bucket, name string) (*pb.DeadMansSwitchState, error) {
+	state := &pb.DeadMansSwitchState{}
+	if err := proto.Unmarshal(checksBucket.Get([]byte(name)), state); err != nil {
+		return nil, fmt.Errorf("could not unmarshal state of check %q: %v", name, err)
+	}
+	return state, nil
+}
+
+func putCheckState(checksBucket *bolt.Bucket, name string, state *pb.DeadMansSwitchState) error {
+	stateBytes, err := proto.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not marshal state of check %q: %v", name, err)
+	}
+	if err := checksBucket.Put([]byte(name), stateBytes); err != nil {
+		return fmt.Errorf("could not write state of check %q: %v", name, err)
+	}
+	return nil
+}
+
+// checkDeadline returns when the given check was last pinged, and when it
+// will be considered missed.
+func checkDeadline(c *pb.DeadMansSwitch, state *pb.DeadMansSwitchState) (lastPing, deadline time.Time) {
+	// A state without a (valid) last ping is treated as pinged at the epoch,
+	// so that it is considered missed.
+	lastPing, _ = ptypes.Timestamp(state.LastPing)
+	return lastPing, lastPing.Add(time.Duration(c.IntervalSeconds+c.GraceSeconds) * time.Second)
+}
+
+// pingCheck records that the named check is alive, returning when it must
+// next be pinged.
+func (ns *notificationService) pingCheck(name string) (time.Time, error) {
+	var c *pb.DeadMansSwitch
+	for _, check := range ns.checks {
+		if check.Name == name {
+			c = check
+		}
+	}
+	if c == nil {
+		return time.Time{}, errUnknownCheck
+	}
+	now := time.Now()
+	nowProto, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var resumed bool
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		checksBucket := tx.Bucket([]byte("checks"))
+		if checksBucket == nil {
+			return errors.New("missing checks bucket")
+		}
+		state, err := getCheckState(checksBucket, name)
+		if err != nil {
+			return err
+		}
+		_, deadline := checkDeadline(c, state)
+		resumed = now.After(deadline)
+		return putCheckState(checksBucket, name, &pb.DeadMansSwitchState{LastPing: nowProto})
+	}); err != nil {
+		return time.Time{}, err
+	}
+	if resumed {
+		log.Printf("Check %q resumed after missing its deadline", name)
+	}
+	return now.Add(time.Duration(c.IntervalSeconds) * time.Second), nil
+}
+
+func (ns *notificationService) PingCheck(ctx context.Context, req *pb.PingCheckRequest) (*pb.PingCheckResponse, error) {
+	nextPingDue, err := ns.pingCheck(req.Name)
+	if err == errUnknownCheck {
+		return nil, status.Errorf(codes.NotFound, "no check named %q is configured", req.Name)
+	}
+	if err != nil {
+		log.Printf("Error while pinging check %q: %v", req.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	nextPingDueProto, err := ptypes.TimestampProto(nextPingDue)
+	if err != nil {
+		log.Printf("Error while pinging check %q: %v", req.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return &pb.PingCheckResponse{NextPingDue: nextPingDueProto}, nil
+}
+
+// pingCheckFromNotification pings the check named by the notification's
+// check data value, if any.
+func (ns *notificationService) pingCheckFromNotification(n *pb.Notification) {
+	name := n.Data[checkDataKey]
+	if name == "" {
+		return
+	}
+	if _, err := ns.pingCheck(name); err != nil {
+		log.Printf("Warning: could not ping check %q named by notification %q: %v", name, n.Title, err)
+	}
+}
+
+// missedCheck describes a check which missed its deadline, for the
+// missed-check notification.
+type missedCheck struct {
+	Name string
+	Ago  string // time since the last ping
+}
+
+// monitorChecks sends a notification whenever a check misses its deadline,
+// repeating it as configured while the check remains missed, until the
+// service begins draining.
+func (ns *notificationService) monitorChecks() {
+	ticker := time.NewTicker(checkPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ns.stopping:
+			return
+		}
+		ns.alertMissedChecks(time.Now())
+	}
+}
+
+// alertMissedChecks sends a notification for each check which has missed
+// its deadline as of now, unless one was already sent (& is not yet due to
+// be repeated).
+func (ns *notificationService) alertMissedChecks(now time.Time) {
+	var missed []missedCheck
+	nowProto, err := ptypes.TimestampProto(now)
+	if err != nil {
+		log.Printf("Error while monitoring checks: %v", err)
+		return
+	}
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		checksBucket := tx.Bucket([]byte("checks"))
+		if checksBucket == nil {
+			return errors.New("missing checks bucket")
+		}
+		for _, c := range ns.checks {
+			state, err := getCheckState(checksBucket, c.Name)
+			if err != nil {
+				return err
+			}
+			lastPing, deadline := checkDeadline(c, state)
+			if !now.After(deadline) {
+				continue
+			}
+			if lastAlert, err := ptypes.Timestamp(state.LastAlert); err == nil && lastAlert.After(deadline) {
+				// Already notified of this miss; repeat if requested.
+				if c.RepeatSeconds <= 0 || now.Before(lastAlert.Add(time.Duration(c.RepeatSeconds)*time.Second)) {
+					continue
+				}
+			}
+			missed = append(missed, missedCheck{c.Name, roughDuration(now.Sub(lastPing))})
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Error while monitoring checks: %v", err)
+		return
+	}
+
+	for _, m := range missed {
+		log.Printf("Warning: check %q missed its deadline; last pinged %s ago", m.Name, m.Ago)
+		ns.mu.RLock()
+		localizer := ns.localizer
+		ns.mu.RUnlock()
+		seq, _, err := ns.enqueue(&pb.SendNotificationRequest{
+			Notification: &pb.Notification{
+				Title: localizer.format(msgCheckMissedTitle, m),
+				Text:  localizer.format(msgCheckMissedText, m),
+			},
+			Priority: pb.Priority_HIGH,
+		})
+		if err != nil {
+			// The alert is not recorded, so it is retried at the next poll.
+			log.Printf("Error while sending missed-check notification: %v", err)
+			continue
+		}
+		if err := ns.recordCheckAlert(m.Name, nowProto); err != nil {
+			log.Printf("Warning: could not record alert for check %q, so it may be repeated early: %v", m.Name, err)
+		}
+		// Don't wait for an in-flight slot here, so that a full in-flight
+		// limit does not hold up alerts for other checks.
+		go ns.dispatch(seq)
+	}
+}
+
+// recordCheckAlert records that a missed-check notification for the named
+// check was enqueued at the given time.
+func (ns *notificationService) recordCheckAlert(name string, alertTime *timestamp.Timestamp) error {
+	return ns.db.Batch(func(tx *bolt.Tx) error {
+		checksBucket := tx.Bucket([]byte("checks"))
+		if checksBucket == nil {
+			return errors.New("missing checks bucket")
+		}
+		state, err := getCheckState(checksBucket, name)
+		if err != nil {
+			return err
+		}
+		state.LastAlert = alertTime
+		return putCheckState(checksBucket, name, state)
+	})
+}
+
+// roughDuration formats the given duration to the minute, e.g. "26h" or "1h5m".
+func roughDuration(d time.Duration) string {
+	h, m := d/time.Hour, d%time.Hour/time.Minute
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case h == 0:
+		return fmt.Sprintf("%dm", m)
+	case m == 0:
+		return fmt.Sprintf("%dh", h)
+	default:
+		return fmt.Sprintf("%dh%dm", h, m)
+	}
+}
+
+// checkStatus fills in the checks field of resp.
+func (ns *notificationService) checkStatus(tx *bolt.Tx, resp *pb.GetStatusResponse) error {
+	if len(ns.checks) == 0 {
+		return nil
+	}
+	checksBucket := tx.Bucket([]byte("checks"))
+	if checksBucket == nil {
+		return errors.New("missing checks bucket")
+	}
+	now := time.Now()
+	for _, c := range ns.checks {
+		state, err := getCheckState(checksBucket, c.Name)
+		if err != nil {
+			return err
+		}
+		_, deadline := checkDeadline(c, state)
+		deadlineProto, err := ptypes.TimestampProto(deadline)
+		if err != nil {
+			return err
+		}
+		resp.Checks = append(resp.Checks, &pb.GetStatusResponse_Check{
+			Name:     c.Name,
+			LastPing: state.LastPing,
+			Deadline: deadlineProto,
+			Missed:   now.After(deadline),
+		})
+	}
+	return nil
+}
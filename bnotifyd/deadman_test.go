@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// checkSettings returns the test settings with a single daily check.
+func checkSettings() *pb.BNotifySettings {
+	settings := testSettings()
+	settings.Checks = []*pb.DeadMansSwitch{{Name: "backup", IntervalSeconds: 24 * 3600}}
+	return settings
+}
+
+// checkState returns the stored state of the named check.
+func checkState(t *testing.T, ns *notificationService, name string) *pb.DeadMansSwitchState {
+	var state *pb.DeadMansSwitchState
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		var err error
+		state, err = getCheckState(tx.Bucket([]byte("checks")), name)
+		return err
+	}); err != nil {
+		t.Fatalf("Could not read state of check %q: %v", name, err)
+	}
+	return state
+}
+
+func TestRejectedNotificationDoesNotPingCheck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, checkSettings())
+	defer cleanup()
+	initial := checkState(t, ns, "backup").LastPing
+
+	// The notification passes verification, but is too large to enqueue.
+	req := testRequest("backup done")
+	req.Notification.Text = strings.Repeat("x", maxPayloadSize)
+	req.Notification.Data = map[string]string{checkDataKey: "backup"}
+	if _, err := ns.SendNotification(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("SendNotification with oversized notification = %v, want InvalidArgument", err)
+	}
+	if got := checkState(t, ns, "backup").LastPing; !proto.Equal(got, initial) {
+		t.Errorf("Rejected notification pinged check: last ping %v, want %v", got, initial)
+	}
+
+	req = testRequest("backup done")
+	req.Notification.Data = map[string]string{checkDataKey: "backup"}
+	if _, err := ns.SendNotification(context.Background(), req); err != nil {
+		t.Fatalf("SendNotification: %v", err)
+	}
+	if got := checkState(t, ns, "backup").LastPing; proto.Equal(got, initial) {
+		t.Errorf("Enqueued notification did not ping check")
+	}
+	ns.senders.Wait()
+}
+
+func TestAlertMissedChecksRetriesFailedEnqueue(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, checkSettings())
+	defer cleanup()
+	fcm := startRecordingFCM(t, ns.creds().gcmCipher)
+	defer fcm.Close()
+	ns.fcmAddress = fcm.URL
+	missedAt := time.Now().Add(48 * time.Hour)
+
+	// Make enqueueing fail.
+	if err := ns.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("pending_messages")) }); err != nil {
+		t.Fatalf("Could not delete pending_messages bucket: %v", err)
+	}
+	ns.alertMissedChecks(missedAt)
+	if state := checkState(t, ns, "backup"); state.LastAlert != nil {
+		t.Errorf("Alert was recorded, though its notification could not be enqueued")
+	}
+
+	// The next poll retries the alert, which is then recorded, so that the
+	// following poll does not repeat it.
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("pending_messages"))
+		return err
+	}); err != nil {
+		t.Fatalf("Could not recreate pending_messages bucket: %v", err)
+	}
+	ns.alertMissedChecks(missedAt)
+	if state := checkState(t, ns, "backup"); state.LastAlert == nil {
+		t.Errorf("Alert was not recorded once its notification was enqueued")
+	}
+	eventually(t, "the alert is sent", func() bool { return len(fcm.received()) == 1 })
+	ns.alertMissedChecks(missedAt.Add(time.Minute))
+	ns.senders.Wait()
+	if got := len(fcm.received()); got != 1 {
+		t.Errorf("FCM received %d alerts, want 1", got)
+	}
+}
+
+func TestAlertMissedChecksWithFullInFlightLimit(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, checkSettings())
+	defer cleanup()
+	fcm := startRecordingFCM(t, ns.creds().gcmCipher)
+	defer fcm.Close()
+	ns.fcmAddress = fcm.URL
+	ns.inFlight = semaphore.NewWeighted(1)
+	if !ns.inFlight.TryAcquire(1) {
+		t.Fatalf("Could not fill in-flight limit")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ns.alertMissedChecks(time.Now().Add(48 * time.Hour))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("alertMissedChecks blocked on the in-flight limit")
+	}
+
+	// The alert is sent once a slot is free.
+	ns.releaseInFlight()
+	eventually(t, "the alert is sent", func() bool { return len(fcm.received()) == 1 })
+	ns.senders.Wait()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+)
+
+// flagDescription describes a flag, for describe --json.
+type flagDescription struct {
+	Name    string `json:"name"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// describe prints all flags & their defaults: as a JSON array if --json is
+// given, for tooling wrapping bnotifyd, and otherwise as in --help.
+func describe() {
+	if !*describeJSON {
+		flag.CommandLine.SetOutput(os.Stdout)
+		flag.PrintDefaults()
+		return
+	}
+	flags := []flagDescription{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, flagDescription{f.Name, f.DefValue, f.Usage})
+	})
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(flags); err != nil {
+		log.Fatalf("Error writing flags: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	pb "../proto"
+)
+
+const (
+	// defaultDrainTimeout is the drain deadline used if drain_timeout_seconds is unset.
+	defaultDrainTimeout = 30 * time.Second
+
+	// drainPassInterval is how long a FULL drain waits between passes over the pending messages.
+	drainPassInterval = time.Second
+)
+
+func (ns *notificationService) isStopping() bool {
+	select {
+	case <-ns.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// startSenders adds n to ns.senders, unless the service has begun draining,
+// returning true if it did. If it returns false, the caller must not start
+// any senders: the messages are left pending for drain (or the next run) to
+// send. drain closes ns.stopping while holding the same lock, so it waits for
+// every sender started by a call which returned true.
+func (ns *notificationService) startSenders(n int) bool {
+	ns.startMu.Lock()
+	defer ns.startMu.Unlock()
+	if ns.isStopping() {
+		return false
+	}
+	ns.senders.Add(n)
+	return true
+}
+
+// drain attempts to send pending messages before shutdown, according to the
+// given policy, giving up at the given timeout. It must be called only once,
+// after the RPC server has stopped.
+func (ns *notificationService) drain(policy pb.BNotifySettings_DrainPolicy, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	// Stop the usual senders, waiting for any in-progress attempts to finish
+	// (whatever the policy) so that no message is left pending after being
+	// sent, to be sent again by drain or on the next start. No more senders
+	// start once stopping is closed (see startSenders).
+	ns.startMu.Lock()
+	close(ns.stopping)
+	ns.startMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		ns.senders.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("Warning: timed out waiting for in-progress sends to finish")
+	}
+
+	flushed := 0
+	if policy != pb.BNotifySettings_NONE {
+		log.Printf("Draining pending messages (policy %v, deadline %v)", policy, deadline.Format(time.RFC3339))
+
+	passes:
+		for {
+			seqs, err := ns.pendingSeqs()
+			if err != nil {
+				log.Printf("Error while draining: %v", err)
+				break
+			}
+			seqs = ns.orderBacklog(seqs)
+			deferred := map[uint64]bool{}
+			for i := 0; i < len(seqs); i++ {
+				seq := seqs[i]
+				if !time.Now().Before(deadline) {
+					break passes
+				}
+				// A group summary waits for its notifications, which may come
+				// later in the pass (e.g. newest first); if they are still
+				// pending at the end of the pass, it waits for the next.
+				if pending, err := ns.groupMembersPending(seq); err != nil {
+					log.Printf("Warning: could not check group of message %d: %v", seq, err)
+				} else if pending {
+					if !deferred[seq] {
+						deferred[seq] = true
+						seqs = append(seqs, seq)
+					}
+					continue
+				}
+				if ns.drainOne(seq) {
+					flushed++
+				}
+			}
+			if len(seqs) == 0 || policy == pb.BNotifySettings_BOUNDED || time.Now().Add(drainPassInterval).After(deadline) {
+				break
+			}
+			time.Sleep(drainPassInterval)
+		}
+	}
+
+	remaining, err := ns.pendingSeqs()
+	if err != nil {
+		log.Printf("Flushed %d message(s) while draining; could not count remaining messages: %v", flushed, err)
+		return
+	}
+	log.Printf("Flushed %d message(s) while draining; %d message(s) left pending", flushed, len(remaining))
+}
+
+// drainOne makes a single attempt, without backoff, to send the pending
+// message with the given sequence number, returning true if it was sent.
+func (ns *notificationService) drainOne(seq uint64) bool {
+	if _, invalid := ns.tokens.check(ns.creds().registrationID); invalid || !ns.breaker.isClosed() {
+		return false
+	}
+	pendingPayload, registrationID, err := ns.beginAttempt(seq)
+	if err != nil {
+		log.Printf("[%d] Could not read and update payload: %v", seq, err)
+		return false
+	}
+	id := pendingPayload.NotificationId
+	if scheduleRetry(int(pendingPayload.SendAttempts), 0).giveUp {
+		log.Printf("[%s] Too many retries, giving up; moved to dead-letter queue", id)
+		return false
+	}
+	if err := ns.postPayload(pendingPayload, registrationID); err != nil {
+		log.Printf("[%s] Could not post notification while draining: %v", id, err)
+		ns.recordAttemptFailure(seq, err)
+		return false
+	}
+	log.Printf("[%s] Sent notification while draining", id)
+	ns.finishSend(seq, pendingPayload)
+	return true
+}
+
+// pendingSeqs returns the sequence numbers of all pending messages.
+func (ns *notificationService) pendingSeqs() ([]uint64, error) {
+	var seqs []uint64
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		return messagesBucket.ForEach(func(key, _ []byte) error {
+			seqs = append(seqs, binary.BigEndian.Uint64(key))
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return seqs, nil
+}
+
+// orderBacklog reorders the given sequence numbers of pending messages,
+// which must be in increasing order, into the order they should be sent
+// according to the drain_order settings. The slice is modified in place.
+// (drain sends in exactly this order; recoverBacklog only starts sends in
+// it.)
+func (ns *notificationService) orderBacklog(seqs []uint64) []uint64 {
+	if ns.drainOrder != pb.BNotifySettings_NEWEST_FIRST || len(seqs) <= ns.drainOrderThreshold {
+		return seqs
+	}
+	for i, j := 0, len(seqs)-1; i < j; i, j = i+1, j-1 {
+		seqs[i], seqs[j] = seqs[j], seqs[i]
+	}
+	return seqs
+}
+
+// resolveDrainTimeout returns the drain deadline from the given settings, warning
+// if it exceeds the time systemd allows for the service to stop.
+func resolveDrainTimeout(settings *pb.BNotifySettings) time.Duration {
+	timeout := defaultDrainTimeout
+	if settings.DrainTimeoutSeconds > 0 {
+		timeout = time.Duration(settings.DrainTimeoutSeconds) * time.Second
+	}
+	if settings.DrainPolicy == pb.BNotifySettings_NONE {
+		return timeout
+	}
+	if stopTimeout, err := systemdStopTimeout(); err != nil {
+		debugf("Could not determine systemd stop timeout: %v", err)
+	} else if stopTimeout > 0 && timeout >= stopTimeout {
+		log.Printf("Warning: drain timeout (%v) is not less than systemd's TimeoutStopSec (%v); systemd may kill bnotifyd while it is draining", timeout, stopTimeout)
+	}
+	return timeout
+}
+
+// systemdStopTimeout returns the TimeoutStopSec of the systemd service
+// bnotifyd is running as, or 0 if there is no limit. It returns an error if
+// bnotifyd is not running under systemd or the timeout cannot be determined.
+func systemdStopTimeout() (time.Duration, error) {
+	if os.Getenv("INVOCATION_ID") == "" {
+		return 0, errors.New("not running under systemd")
+	}
+	unit, err := systemdUnit()
+	if err != nil {
+		return 0, err
+	}
+	out, err := exec.Command("systemctl", "show", "--property=TimeoutStopUSec", "--value", unit).Output()
+	if err != nil {
+		// User services are managed by the user instance of systemd.
+		if out, err = exec.Command("systemctl", "--user", "show", "--property=TimeoutStopUSec", "--value", unit).Output(); err != nil {
+			return 0, fmt.Errorf("could not query systemctl: %v", err)
+		}
+	}
+	return parseSystemdTimespan(strings.TrimSpace(string(out)))
+}
+
+// systemdUnit returns the name of the systemd service containing this process, from its cgroup.
+func systemdUnit() (string, error) {
+	cgroup, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(cgroup), "\n") {
+		parts := strings.Split(line, "/")
+		for i := len(parts) - 1; i >= 0; i-- {
+			if strings.HasSuffix(parts[i], ".service") {
+				return parts[i], nil
+			}
+		}
+	}
+	return "", errors.New("no service found in cgroup")
+}
+
+var timespanComponentRE = regexp.MustCompile(`^(\d+)(us|ms|s|min|h|d)$`)
+
+// parseSystemdTimespan parses a time span as formatted by systemctl show,
+// e.g. "1min 30s". "infinity" is returned as 0.
+func parseSystemdTimespan(s string) (time.Duration, error) {
+	if s == "infinity" {
+		return 0, nil
+	}
+	units := map[string]time.Duration{
+		"us":  time.Microsecond,
+		"ms":  time.Millisecond,
+		"s":   time.Second,
+		"min": time.Minute,
+		"h":   time.Hour,
+		"d":   24 * time.Hour,
+	}
+	var d time.Duration
+	for _, component := range strings.Fields(s) {
+		m := timespanComponentRE.FindStringSubmatch(component)
+		if m == nil {
+			return 0, fmt.Errorf("could not parse time span %q", s)
+		}
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse time span %q: %v", s, err)
+		}
+		d += time.Duration(n) * units[m[2]]
+	}
+	if d == 0 {
+		return 0, fmt.Errorf("could not parse time span %q", s)
+	}
+	return d, nil
+}
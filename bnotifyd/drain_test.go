@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/sync/semaphore"
+
+	pb "../proto"
+)
+
+func TestDrainStopsDispatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+
+	before, _, err := ns.enqueue(testRequest("before drain"))
+	if err != nil {
+		t.Fatalf("Could not enqueue message: %v", err)
+	}
+	ns.drain(pb.BNotifySettings_BOUNDED, time.Second)
+	if pending := pendingPayloads(t, ns); len(pending) != 0 {
+		t.Fatalf("Got %d pending messages after draining, want 0", len(pending))
+	}
+
+	// Producers such as dead man's switch checks may still dispatch messages
+	// once draining has begun; these must be left pending, rather than sent
+	// by senders drain does not wait for.
+	after, _, err := ns.enqueue(testRequest("after drain"))
+	if err != nil {
+		t.Fatalf("Could not enqueue message: %v", err)
+	}
+	ns.dispatch(after)
+	ns.senders.Wait()
+	pending := pendingPayloads(t, ns)
+	if _, ok := pending[after]; !ok || len(pending) != 1 {
+		t.Errorf("Got pending messages %v, want only %d", pending, after)
+	}
+	if _, ok := pending[before]; ok {
+		t.Errorf("Message %d enqueued before draining is still pending", before)
+	}
+}
+
+func TestOrderBacklog(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, test := range []struct {
+		desc      string
+		order     pb.BNotifySettings_DrainOrder
+		threshold int
+		want      []uint64
+	}{
+		{"oldest first", pb.BNotifySettings_OLDEST_FIRST, 0, []uint64{1, 2, 3, 4}},
+		{"newest first", pb.BNotifySettings_NEWEST_FIRST, 0, []uint64{4, 3, 2, 1}},
+		{"newest first, above threshold", pb.BNotifySettings_NEWEST_FIRST, 3, []uint64{4, 3, 2, 1}},
+		{"newest first, at threshold", pb.BNotifySettings_NEWEST_FIRST, 4, []uint64{1, 2, 3, 4}},
+	} {
+		ns := &notificationService{drainOrder: test.order, drainOrderThreshold: test.threshold}
+		if got := ns.orderBacklog([]uint64{1, 2, 3, 4}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: orderBacklog = %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestDrainNewestFirst(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	fcm := startRecordingFCM(t, ns.creds().gcmCipher)
+	defer fcm.Close()
+	ns.fcmAddress = fcm.URL
+	ns.drainOrder = pb.BNotifySettings_NEWEST_FIRST
+
+	var seqs []uint64
+	for i := 0; i < 5; i++ {
+		seq, _, err := ns.enqueue(testRequest(fmt.Sprintf("message %d", i)))
+		if err != nil {
+			t.Fatalf("Could not enqueue message: %v", err)
+		}
+		seqs = append([]uint64{seq}, seqs...)
+	}
+	ns.drain(pb.BNotifySettings_BOUNDED, 5*time.Second)
+
+	// Draining sends one message at a time, so FCM receives exactly the
+	// drain order; the sequence numbers themselves are unchanged.
+	if got := fcm.receivedSeqs(); !reflect.DeepEqual(got, seqs) {
+		t.Errorf("FCM received %v, want %v", got, seqs)
+	}
+}
+
+func TestRecoverBacklogNewestFirstSingleInFlight(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	fcm := startRecordingFCM(t, ns.creds().gcmCipher)
+	defer fcm.Close()
+	ns.fcmAddress = fcm.URL
+	ns.drainOrder = pb.BNotifySettings_NEWEST_FIRST
+	ns.inFlight = semaphore.NewWeighted(1)
+
+	var seqs, want []uint64
+	for i := 0; i < 5; i++ {
+		seq, _, err := ns.enqueue(testRequest(fmt.Sprintf("message %d", i)))
+		if err != nil {
+			t.Fatalf("Could not enqueue message: %v", err)
+		}
+		seqs, want = append(seqs, seq), append([]uint64{seq}, want...)
+	}
+	// Recovery only starts sends in order; with one message in flight at a
+	// time, they also reach FCM in order.
+	ns.recoverBacklog(seqs)
+	ns.senders.Wait()
+	if got := fcm.receivedSeqs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FCM received %v, want %v", got, want)
+	}
+}
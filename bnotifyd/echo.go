@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "../proto"
+)
+
+// echoReceiver stands in for FCM & the app when testing: it decrypts payloads
+// the same way the app does, and writes the resulting messages to out.
+type echoReceiver struct {
+	mu        sync.Mutex // protects all fields
+	gcmCipher cipher.AEAD
+	out       io.Writer
+}
+
+func newEchoReceiver(password, registrationID string, out io.Writer) (*echoReceiver, error) {
+	gcmCipher, err := newCipher(password, registrationID, serverIDSize+binary.Size(uint64(0)))
+	if err != nil {
+		return nil, err
+	}
+	return &echoReceiver{
+		gcmCipher: gcmCipher,
+		out:       out,
+	}, nil
+}
+
+func (er *echoReceiver) receive(payload []byte) error {
+	envelope := &pb.Envelope{}
+	if err := proto.Unmarshal(payload, envelope); err != nil {
+		return fmt.Errorf("could not unmarshal envelope: %v", err)
+	}
+	er.mu.Lock()
+	gcmCipher := er.gcmCipher
+	er.mu.Unlock()
+	plaintextMessage, err := gcmCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+	if err != nil {
+		return fmt.Errorf("could not decrypt message: %v", err)
+	}
+	message := &pb.Message{}
+	if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+		return fmt.Errorf("could not unmarshal message: %v", err)
+	}
+
+	// The nonce must be serverID || seq.
+	if !bytes.Equal(envelope.Nonce, makeNonce(message.ServerId, message.Seq)) {
+		return errors.New("nonce does not match message server ID & sequence number")
+	}
+
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	_, err = fmt.Fprintf(er.out, "server_id: %x seq: %d version: %d notification: <%s>\n", message.ServerId, message.Seq, envelope.Version, proto.CompactTextString(message.Notification))
+	return err
+}
+
+// setCipher changes the cipher used to decrypt payloads, e.g. when the
+// registration ID changes.
+func (er *echoReceiver) setCipher(gcmCipher cipher.AEAD) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.gcmCipher = gcmCipher
+}
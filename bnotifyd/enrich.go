@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// enricher is a compiled form of an Enricher from the settings.
+type enricher struct {
+	name       string
+	field      string          // "title", "text", or "data.KEY"
+	categories map[string]bool // if non-empty, the categories the enricher applies to
+	transform  func(n *pb.Notification, v string) (string, error)
+}
+
+func compileEnrichers(enrichers []*pb.Enricher) ([]enricher, error) {
+	var compiled []enricher
+	for i, e := range enrichers {
+		name := e.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if e.Field != "title" && e.Field != "text" && (!strings.HasPrefix(e.Field, "data.") || e.Field == "data.") {
+			return nil, fmt.Errorf("enricher %q: unknown field %q", name, e.Field)
+		}
+		en := enricher{name: name, field: e.Field}
+		if len(e.Categories) > 0 {
+			en.categories = map[string]bool{}
+			for _, c := range e.Categories {
+				en.categories[c] = true
+			}
+		}
+		value := e.Value
+		switch e.Type {
+		case pb.Enricher_PREFIX:
+			en.transform = func(_ *pb.Notification, v string) (string, error) { return value + v, nil }
+
+		case pb.Enricher_SUFFIX:
+			en.transform = func(_ *pb.Notification, v string) (string, error) { return v + value, nil }
+
+		case pb.Enricher_REGEX_REPLACE:
+			re, err := regexp.Compile(e.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("enricher %q: bad pattern: %v", name, err)
+			}
+			en.transform = func(_ *pb.Notification, v string) (string, error) { return re.ReplaceAllString(v, value), nil }
+
+		case pb.Enricher_TEMPLATE:
+			tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("enricher %q: bad template: %v", name, err)
+			}
+			en.transform = func(n *pb.Notification, _ string) (string, error) {
+				var buf bytes.Buffer
+				if err := tmpl.Execute(&buf, n); err != nil {
+					return "", err
+				}
+				return buf.String(), nil
+			}
+
+		case pb.Enricher_MAP:
+			mapping := e.Mapping
+			en.transform = func(_ *pb.Notification, v string) (string, error) {
+				if r, ok := mapping[v]; ok {
+					return r, nil
+				}
+				return v, nil
+			}
+
+		default:
+			return nil, fmt.Errorf("enricher %q: unknown type %v", name, e.Type)
+		}
+		compiled = append(compiled, en)
+	}
+	return compiled, nil
+}
+
+// enrich applies the given enrichers, in order, to the given notification,
+// returning the names of those which applied. If an enricher fails, an
+// InvalidArgument error naming it is returned & the notification may have
+// been partially enriched.
+func enrich(enrichers []enricher, n *pb.Notification) ([]string, error) {
+	var applied []string
+	for _, e := range enrichers {
+		if e.categories != nil && !e.categories[n.Category] {
+			continue
+		}
+		var v string
+		switch e.field {
+		case "title":
+			v = n.Title
+		case "text":
+			v = n.Text
+		default:
+			v = n.Data[strings.TrimPrefix(e.field, "data.")]
+		}
+		v, err := e.transform(n, v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "enricher %q failed: %v", e.name, err)
+		}
+		switch e.field {
+		case "title":
+			n.Title = v
+		case "text":
+			n.Text = v
+		default:
+			if n.Data == nil {
+				n.Data = map[string]string{}
+			}
+			n.Data[strings.TrimPrefix(e.field, "data.")] = v
+		}
+		applied = append(applied, e.name)
+	}
+	return applied, nil
+}
+
+func (ns *notificationService) PreviewEnrichment(ctx context.Context, req *pb.PreviewEnrichmentRequest) (*pb.PreviewEnrichmentResponse, error) {
+	if req.Notification == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing notification")
+	}
+	ns.mu.RLock()
+	enrichers := ns.enrichers
+	ns.mu.RUnlock()
+	n := proto.Clone(req.Notification).(*pb.Notification)
+	applied, err := enrich(enrichers, n)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PreviewEnrichmentResponse{Notification: n, Applied: applied}, nil
+}
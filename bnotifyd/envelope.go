@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+const (
+	// producerTokenMetadataKey is the gRPC metadata key carrying an envelope producer's token.
+	producerTokenMetadataKey = "bnotify-producer-token"
+
+	// minProducerSeq is the lowest sequence number an envelope producer may
+	// be assigned. bnotifyd allocates sequence numbers counting up from 1, so
+	// it will never reach this.
+	minProducerSeq = 1 << 63
+)
+
+// validateEnvelopeProducers checks that the configured envelope producers
+// have unique names & tokens, and disjoint sequence number ranges outside of
+// those allocated by bnotifyd.
+func validateEnvelopeProducers(producers []*pb.EnvelopeProducer) error {
+	names, tokens := map[string]bool{}, map[string]bool{}
+	for _, p := range producers {
+		if p.Name == "" {
+			return errors.New("envelope producer missing name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate envelope producer %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.Token == "" {
+			return fmt.Errorf("envelope producer %q missing token", p.Name)
+		}
+		if tokens[p.Token] {
+			return fmt.Errorf("envelope producer %q reuses another producer's token", p.Name)
+		}
+		tokens[p.Token] = true
+		if p.SeqStart < minProducerSeq {
+			return fmt.Errorf("envelope producer %q: seq_start must be at least %d", p.Name, uint64(minProducerSeq))
+		}
+		if p.SeqEnd <= p.SeqStart {
+			return fmt.Errorf("envelope producer %q: seq_end must be greater than seq_start", p.Name)
+		}
+	}
+
+	sorted := append([]*pb.EnvelopeProducer(nil), producers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SeqStart < sorted[j].SeqStart })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].SeqStart < sorted[i-1].SeqEnd {
+			return fmt.Errorf("envelope producers %q & %q have overlapping sequence number ranges", sorted[i-1].Name, sorted[i].Name)
+		}
+	}
+	return nil
+}
+
+// envelopeProducer returns the envelope producer authenticated by the request
+// metadata.
+func (ns *notificationService) envelopeProducer(ctx context.Context) (*pb.EnvelopeProducer, error) {
+	if len(ns.envelopeProducers) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "SendEnvelope is disabled; configure envelope_producers in settings to enable it")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md[producerTokenMetadataKey]
+	if len(tokens) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "missing producer token")
+	}
+	var producer *pb.EnvelopeProducer
+	for _, p := range ns.envelopeProducers {
+		// Check every token, so that timing does not reveal which matched.
+		if subtle.ConstantTimeCompare([]byte(tokens[0]), []byte(p.Token)) == 1 {
+			producer = p
+		}
+	}
+	if producer == nil {
+		return nil, status.Error(codes.Unauthenticated, "incorrect producer token")
+	}
+	return producer, nil
+}
+
+func (ns *notificationService) SendEnvelope(ctx context.Context, req *pb.SendEnvelopeRequest) (*pb.SendNotificationResponse, error) {
+	producer, err := ns.envelopeProducer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAndroidConfig(req.AndroidConfig); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad android_config: %v", err)
+	}
+	if ns.inFlight != nil && !ns.inFlight.TryAcquire(1) {
+		return nil, quotaFailure("too many notifications in flight", "max_in_flight_messages", inFlightRetryDelay)
+	}
+	seq, pendingPayload, err := ns.enqueueEnvelope(producer, req)
+	if err != nil {
+		ns.releaseInFlight()
+		if _, ok := status.FromError(err); ok {
+			log.Printf("Warning: rejected envelope from producer %q: %v", producer.Name, err)
+			return nil, err
+		}
+		log.Printf("Error while posting envelope from producer %q: %v", producer.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("[%s] Enqueued envelope from producer %q", pendingPayload.NotificationId, producer.Name)
+	if ns.startSenders(1) {
+		go ns.sendPayload(seq)
+	} else {
+		ns.releaseInFlight()
+	}
+	return &pb.SendNotificationResponse{
+		NotificationId: pendingPayload.NotificationId,
+		PayloadSize:    int32(payloadSize(pendingPayload.Payload)),
+	}, nil
+}
+
+// enqueueEnvelope checks the requested envelope against the contract
+// documented on SendEnvelopeRequest & adds it to the pending messages in
+// state, returning its sequence number & pending payload. Envelopes breaking
+// the contract are rejected with a gRPC status error.
+func (ns *notificationService) enqueueEnvelope(producer *pb.EnvelopeProducer, req *pb.SendEnvelopeRequest) (uint64, *pb.PendingPayload, error) {
+	envelope := req.Envelope
+	if envelope == nil {
+		return 0, nil, status.Error(codes.InvalidArgument, "missing envelope")
+	}
+	if envelope.Version != envelopeVersion {
+		return 0, nil, status.Errorf(codes.InvalidArgument, "unsupported envelope version %d", envelope.Version)
+	}
+	if len(envelope.Nonce) != serverIDSize+binary.Size(uint64(0)) {
+		return 0, nil, status.Errorf(codes.InvalidArgument, "nonce is %d bytes, expected %d", len(envelope.Nonce), serverIDSize+binary.Size(uint64(0)))
+	}
+	seq := binary.BigEndian.Uint64(envelope.Nonce[serverIDSize:])
+	if seq < producer.SeqStart || seq >= producer.SeqEnd {
+		return 0, nil, status.Errorf(codes.InvalidArgument, "seq %d is outside of the producer's range [%d, %d)", seq, producer.SeqStart, producer.SeqEnd)
+	}
+	payload, err := proto.Marshal(envelope)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not marshal envelope proto: %v", err)
+	}
+	if size := payloadSize(payload); size > maxPayloadSize {
+		return 0, nil, status.Error(codes.InvalidArgument, payloadTooLargeError{size}.Error())
+	}
+	enqueueTime, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Batch may run this function more than once, so it must not have side
+	// effects outside of the transaction.
+	var pendingPayload *pb.PendingPayload
+	var notification *pb.Notification
+	ns.rekeyMu.RLock()
+	gcmCipher := ns.creds().gcmCipher
+	err = ns.db.Batch(func(tx *bolt.Tx) error {
+		settingsBucket := tx.Bucket([]byte("settings"))
+		if settingsBucket == nil {
+			return errors.New("missing settings bucket")
+		}
+		serverID := settingsBucket.Get([]byte("serverID"))
+		if err := checkServerID(serverID); err != nil {
+			return err
+		}
+		if !bytes.Equal(envelope.Nonce[:serverIDSize], serverID) {
+			return status.Errorf(codes.FailedPrecondition, "nonce prefix %x does not match the current server ID %x", envelope.Nonce[:serverIDSize], serverID)
+		}
+
+		// Sequence numbers must increase, so that no nonce is ever reused.
+		producersBucket := tx.Bucket([]byte("envelope_producers"))
+		if producersBucket == nil {
+			return errors.New("missing envelope_producers bucket")
+		}
+		if last := producersBucket.Get([]byte(producer.Name)); last != nil && seq <= binary.BigEndian.Uint64(last) {
+			return status.Errorf(codes.AlreadyExists, "seq %d is not greater than the producer's last seq %d", seq, binary.BigEndian.Uint64(last))
+		}
+
+		// Check that the message is what the app will expect.
+		plaintextMessage, err := gcmCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, "could not decrypt envelope; is it encrypted with the current key?")
+		}
+		message := &pb.Message{}
+		if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+			return status.Errorf(codes.InvalidArgument, "could not unmarshal message: %v", err)
+		}
+		if !bytes.Equal(message.ServerId, serverID) || message.Seq != seq {
+			return status.Error(codes.InvalidArgument, "message server_id & seq do not match the nonce")
+		}
+
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		txPendingPayload := &pb.PendingPayload{
+			Payload:        payload,
+			NotificationId: notificationID(serverID, seq),
+			EnqueueTime:    enqueueTime,
+			AndroidConfig:  requestAndroidConfig(&pb.SendNotificationRequest{Notification: message.Notification, AndroidConfig: req.AndroidConfig}),
+			Silent:         message.Notification.GetSilent(),
+			Priority:       req.Priority,
+			DelayWhileIdle: message.Notification.GetDelayWhileIdle(),
+			Channel:        message.Notification.GetCategory(),
+		}
+		ppBytes, err := proto.Marshal(txPendingPayload)
+		if err != nil {
+			return fmt.Errorf("could not marshal pending payload proto: %v", err)
+		}
+		if err := messagesBucket.Put(seqKey(seq), ppBytes); err != nil {
+			return fmt.Errorf("could not write message to state: %v", err)
+		}
+		if err := producersBucket.Put([]byte(producer.Name), seqKey(seq)); err != nil {
+			return fmt.Errorf("could not record producer's last seq: %v", err)
+		}
+		pendingPayload, notification = txPendingPayload, message.Notification
+		return nil
+	})
+	ns.rekeyMu.RUnlock()
+	if err != nil {
+		return 0, nil, err
+	}
+	ns.recordPayloadSize(payloadSize(pendingPayload.Payload))
+	notificationsEnqueued.WithLabelValues(notificationKind(notification)).Inc()
+	ns.publishEvent(seq, pendingPayload, pb.StatusResponse_PENDING)
+	return seq, pendingPayload, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// inFlightRetryDelay is the retry delay suggested to clients rejected because
+// too many notifications are in flight.
+const inFlightRetryDelay = time.Second
+
+// statusWithDetails returns a gRPC status error with the given code, message
+// & details. If the details cannot be attached, the error is returned without
+// them.
+func statusWithDetails(code codes.Code, msg string, details ...proto.Message) error {
+	st := status.New(code, msg)
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// badRequest returns an InvalidArgument error with a BadRequest detail
+// listing the given violations.
+func badRequest(msg string, violations ...*errdetails.BadRequest_FieldViolation) error {
+	return statusWithDetails(codes.InvalidArgument, msg, &errdetails.BadRequest{FieldViolations: violations})
+}
+
+// fieldViolation describes why the request field at the given path (e.g.
+// "notification.title") is invalid.
+func fieldViolation(field, desc string) *errdetails.BadRequest_FieldViolation {
+	return &errdetails.BadRequest_FieldViolation{Field: field, Description: desc}
+}
+
+// quotaFailure returns a ResourceExhausted error with a QuotaFailure detail
+// for the given subject, and a RetryInfo detail suggesting the given delay.
+func quotaFailure(msg, subject string, retryDelay time.Duration) error {
+	return statusWithDetails(codes.ResourceExhausted, msg,
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{Subject: subject, Description: msg}}},
+		&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(retryDelay)})
+}
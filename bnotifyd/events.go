@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// eventBufferSize is the number of events buffered per watcher. Events are
+// dropped for watchers which fall further behind than this, so that a slow
+// watcher never holds up sending.
+const eventBufferSize = 64
+
+// eventBroadcaster distributes notification events to watchers.
+type eventBroadcaster struct {
+	mu       sync.Mutex
+	watchers map[chan *pb.NotificationEvent]struct{}
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{watchers: map[chan *pb.NotificationEvent]struct{}{}}
+}
+
+// watch returns a channel of future events, and a function which must be
+// called to stop watching.
+func (b *eventBroadcaster) watch() (<-chan *pb.NotificationEvent, func()) {
+	ch := make(chan *pb.NotificationEvent, eventBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watchers[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.watchers, ch)
+	}
+}
+
+func (b *eventBroadcaster) hasWatchers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.watchers) > 0
+}
+
+func (b *eventBroadcaster) publish(event *pb.NotificationEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.watchers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Warning: dropped event for seq %d for slow watcher", event.Seq)
+		}
+	}
+}
+
+// publishEvent publishes an event for the given pending payload, if anyone is
+// watching, along with the corresponding server event.
+func (ns *notificationService) publishEvent(seq uint64, pendingPayload *pb.PendingPayload, status pb.StatusResponse_Status) {
+	ns.publishStatusServerEvent(seq, pendingPayload, status)
+	if !ns.events.hasWatchers() {
+		return
+	}
+	message, err := ns.openPayload(pendingPayload.Payload)
+	if err != nil {
+		log.Printf("[%s] Could not decrypt payload for watchers: %v", pendingPayload.NotificationId, err)
+		return
+	}
+	now, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		log.Printf("[%s] Could not build event for watchers: %v", pendingPayload.NotificationId, err)
+		return
+	}
+	ns.events.publish(&pb.NotificationEvent{
+		Seq:            seq,
+		NotificationId: pendingPayload.NotificationId,
+		Status:         status,
+		Notification:   message.Notification,
+		Time:           now,
+	})
+}
+
+func (ns *notificationService) WatchNotification(req *pb.WatchRequest, stream pb.NotificationService_WatchNotificationServer) error {
+	events, stop := ns.events.watch()
+	defer stop()
+	if req.Seq != 0 {
+		// The notification may have been sent or failed before the watch
+		// began, in which case no further event will come. (This check must
+		// follow watch, so that an event published in between is not missed.)
+		var s pb.StatusResponse_Status
+		if err := ns.db.View(func(tx *bolt.Tx) error {
+			var err error
+			s, err = notificationStatus(tx, req.Seq, "")
+			return err
+		}); err != nil {
+			log.Printf("Error while getting notification status: %v", err)
+			return status.Error(codes.Internal, "internal error")
+		}
+		if isTerminalStatus(s) {
+			return stream.Send(&pb.NotificationEvent{Seq: req.Seq, Status: s})
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event := <-events:
+			if req.Seq != 0 && event.Seq != req.Seq {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+			if req.Seq != 0 && isTerminalStatus(event.Status) {
+				return nil
+			}
+		}
+	}
+}
+
+// isTerminalStatus returns true if a notification with the given status will
+// have no further events.
+func isTerminalStatus(s pb.StatusResponse_Status) bool {
+	return s == pb.StatusResponse_SENT || s == pb.StatusResponse_ACKNOWLEDGED || s == pb.StatusResponse_FAILED
+}
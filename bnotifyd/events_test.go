@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "../proto"
+)
+
+// watchStream receives the events streamed by WatchNotification on c.
+type watchStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	c   chan *pb.NotificationEvent
+}
+
+func (s watchStream) Context() context.Context { return s.ctx }
+
+func (s watchStream) Send(event *pb.NotificationEvent) error {
+	s.c <- event
+	return nil
+}
+
+func TestWatchNotificationAlreadyFinished(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	seq, _, err := ns.enqueue(testRequest("sent before watching"))
+	if err != nil {
+		t.Fatalf("Could not enqueue message: %v", err)
+	}
+	ns.dispatch(seq)
+	ns.senders.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := watchStream{ctx: ctx, c: make(chan *pb.NotificationEvent, 1)}
+	done := make(chan error, 1)
+	go func() { done <- ns.WatchNotification(&pb.WatchRequest{Seq: seq}, stream) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WatchNotification: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WatchNotification did not return for a notification which was already sent")
+	}
+	select {
+	case event := <-stream.c:
+		if event.Seq != seq || event.Status != pb.StatusResponse_SENT {
+			t.Errorf("Got event %v, want seq %d with status SENT", event, seq)
+		}
+	default:
+		t.Errorf("WatchNotification sent no event")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// groupSummary is the data of the group summary title message.
+type groupSummary struct {
+	Count int64
+}
+
+func (ns *notificationService) SendGroupNotification(ctx context.Context, req *pb.GroupRequest) (*pb.GroupResponse, error) {
+	// Verify request. Every notification is verified before any is muted, so
+	// that a bad request has no effect.
+	if req.ThreadId == "" {
+		return nil, badRequest("missing thread_id", fieldViolation("thread_id", "required"))
+	}
+	if len(req.Notifications) == 0 {
+		return nil, badRequest("missing notifications", fieldViolation("notifications", "required"))
+	}
+	reqs := make([]*pb.SendNotificationRequest, len(req.Notifications))
+	titles := make([]string, len(req.Notifications)) // as requested, for the summary, which is sanitized itself
+	for i, n := range req.Notifications {
+		field := fmt.Sprintf("notifications[%d]", i)
+		switch {
+		case n.ThreadId != "" && n.ThreadId != req.ThreadId:
+			return nil, badRequest(fmt.Sprintf("notification %d has thread_id %q, not the group's", i, n.ThreadId), fieldViolation(field+".thread_id", "must be unset or equal to the group's thread_id"))
+		case n.Silent:
+			return nil, badRequest(fmt.Sprintf("notification %d is silent", i), fieldViolation(field+".silent", "silent notifications cannot be grouped"))
+		case n.GroupSummary:
+			return nil, badRequest(fmt.Sprintf("notification %d is a group summary", i), fieldViolation(field+".group_summary", "the group summary is added automatically"))
+		case n.PackageName != req.Notifications[0].PackageName:
+			return nil, badRequest(fmt.Sprintf("notification %d has a different package_name", i), fieldViolation(field+".package_name", "must be the same for every notification in the group"))
+		}
+		n.ThreadId = req.ThreadId
+		titles[i] = n.Title
+		reqs[i] = &pb.SendNotificationRequest{Notification: n, AndroidConfig: req.AndroidConfig, Priority: req.Priority}
+		if err := ns.verifyNotification(reqs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Reserve in-flight slots for the whole group & its summary, then admit
+	// each notification. Slots for muted notifications are released once
+	// admission is done. Admission's side effects (pinging checks, counting
+	// mutes) wait until the group has been enqueued, so that a rejected group
+	// has none.
+	reserved := len(reqs) + 1
+	if ns.inFlight != nil && !ns.inFlight.TryAcquire(int64(reserved)) {
+		return nil, quotaFailure("too many notifications in flight", "max_in_flight_messages", inFlightRetryDelay)
+	}
+	muteKeys := make([][]byte, len(reqs))
+	var admitted []*pb.SendNotificationRequest
+	var admittedTitles []string
+	for i, r := range reqs {
+		muteKey, err := ns.admitNotification(r.Notification)
+		if err != nil {
+			ns.releaseInFlightN(reserved)
+			return nil, err
+		}
+		muteKeys[i] = muteKey
+		if muteKey == nil {
+			admitted, admittedTitles = append(admitted, r), append(admittedTitles, titles[i])
+		}
+	}
+	admitAll := func() {
+		for i, r := range reqs {
+			ns.admitted(r.Notification, muteKeys[i])
+			if muteKeys[i] != nil {
+				log.Printf("Muted notification %q", r.Notification.Title)
+			}
+		}
+	}
+	if len(admitted) == 0 {
+		ns.releaseInFlightN(reserved)
+		admitAll()
+		return &pb.GroupResponse{}, nil
+	}
+	summary, err := ns.groupSummaryRequest(req, admitted, admittedTitles)
+	if err != nil {
+		ns.releaseInFlightN(reserved)
+		return nil, err
+	}
+	group := append(admitted, summary)
+	ns.releaseInFlightN(reserved - len(group))
+
+	// Enqueue the group, then kick off a goroutine to send it.
+	seqs, pendingPayloads, err := ns.enqueueGroup(group)
+	if err != nil {
+		ns.releaseInFlightN(len(group))
+		if tooLarge, ok := err.(payloadTooLargeError); ok {
+			return nil, badRequest(tooLarge.Error(), fieldViolation("notifications", tooLarge.Error()))
+		}
+		log.Printf("Error while posting notification group %q: %v", req.ThreadId, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	admitAll()
+	resp := &pb.GroupResponse{}
+	for _, pendingPayload := range pendingPayloads[:len(pendingPayloads)-1] {
+		log.Printf("[%s] Enqueued notification in group %q", pendingPayload.NotificationId, req.ThreadId)
+		resp.NotificationIds = append(resp.NotificationIds, pendingPayload.NotificationId)
+	}
+	resp.SummaryNotificationId = pendingPayloads[len(pendingPayloads)-1].NotificationId
+	log.Printf("[%s] Enqueued summary of group %q", resp.SummaryNotificationId, req.ThreadId)
+	if ns.startSenders(len(seqs)) {
+		go ns.sendGroup(seqs)
+	} else {
+		ns.releaseInFlightN(len(seqs))
+	}
+	return resp, nil
+}
+
+// groupSummaryRequest returns a request for the summary of the given group,
+// whose unmuted notifications are requested by reqs, with the given titles
+// (as requested, before sanitization). The summary's title counts the
+// notifications, and its text lists their titles: as many as fit in a
+// payload, followed by an ellipsis if any are left out. It has the
+// notifications' category if they share one. The summary is verified like
+// any other notification; errors are suitable to return from an RPC.
+func (ns *notificationService) groupSummaryRequest(req *pb.GroupRequest, reqs []*pb.SendNotificationRequest, titles []string) (*pb.SendNotificationRequest, error) {
+	ns.mu.RLock()
+	localizer := ns.localizer
+	ns.mu.RUnlock()
+	category := reqs[0].Notification.Category
+	for _, r := range reqs {
+		if r.Notification.Category != category {
+			category = ""
+		}
+	}
+	summary := &pb.SendNotificationRequest{
+		Notification: &pb.Notification{
+			Title:        localizer.format(msgGroupSummaryTitle, groupSummary{int64(len(reqs))}),
+			Text:         strings.Join(titles, "\n"),
+			PackageName:  reqs[0].Notification.PackageName,
+			Category:     category,
+			ThreadId:     req.ThreadId,
+			GroupSummary: true,
+		},
+		AndroidConfig: req.AndroidConfig,
+		Priority:      req.Priority,
+	}
+	if err := ns.verifyNotification(summary); err != nil {
+		return nil, err
+	}
+
+	// Drop lines from the end of the (verified) text until the summary fits.
+	// Whole lines are dropped, so that no escape sequence is cut in two.
+	lines := strings.Split(summary.Notification.Text, "\n")
+	overhead := ns.creds().gcmCipher.Overhead()
+	var sizeErr error
+	tooLarge := sort.Search(len(lines)+1, func(k int) bool {
+		n := proto.Clone(summary.Notification).(*pb.Notification)
+		n.Text = groupSummaryText(lines, k)
+		size, err := maxNotificationPayloadSize(n, overhead)
+		if err != nil {
+			sizeErr = err
+		}
+		return err != nil || size > maxPayloadSize
+	})
+	if sizeErr != nil {
+		log.Printf("Error while sizing summary of group %q: %v", req.ThreadId, sizeErr)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if tooLarge == 0 {
+		const msg = "the group's summary would exceed the maximum payload size"
+		return nil, badRequest(msg, fieldViolation("thread_id", msg))
+	}
+	summary.Notification.Text = groupSummaryText(lines, tooLarge-1)
+	return summary, nil
+}
+
+// groupSummaryText returns the first k of the given lines of a group
+// summary's text, followed by an ellipsis if any are left out.
+func groupSummaryText(lines []string, k int) string {
+	if k == len(lines) {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(append(lines[:k:k], "…"), "\n")
+}
+
+// enqueueGroup is enqueue for several notifications, which are added to the
+// pending messages in a single transaction: either all are enqueued, or none
+// are. Their sequence numbers follow request order. The last is the group's
+// summary, whose pending payload records the others as its members.
+func (ns *notificationService) enqueueGroup(reqs []*pb.SendNotificationRequest) ([]uint64, []*pb.PendingPayload, error) {
+	var seqs []uint64
+	var pendingPayloads []*pb.PendingPayload
+	enqueueTime, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	ns.rekeyMu.RLock()
+	gcmCipher := ns.creds().gcmCipher
+	err = ns.db.Batch(func(tx *bolt.Tx) error {
+		// Batch may run this function more than once.
+		seqs, pendingPayloads = nil, nil
+		serverID, err := txServerID(tx)
+		if err != nil {
+			return err
+		}
+		for _, req := range reqs {
+			seq, pendingPayload, err := putMessage(tx, serverID, gcmCipher, req, enqueueTime, false)
+			if err != nil {
+				return err
+			}
+			seqs, pendingPayloads = append(seqs, seq), append(pendingPayloads, pendingPayload)
+		}
+
+		// Record the summary's members, so that it is still sent after them
+		// if it is recovered or drained.
+		last := len(seqs) - 1
+		pendingPayloads[last].GroupMemberSeqs = append([]uint64(nil), seqs[:last]...)
+		ppBytes, err := proto.Marshal(pendingPayloads[last])
+		if err != nil {
+			return fmt.Errorf("could not marshal pending payload proto: %v", err)
+		}
+		return tx.Bucket([]byte("pending_messages")).Put(seqKey(seqs[last]), ppBytes)
+	})
+	ns.rekeyMu.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, req := range reqs {
+		ns.recordPayloadSize(payloadSize(pendingPayloads[i].Payload))
+		notificationsEnqueued.WithLabelValues(notificationKind(req.Notification)).Inc()
+		ns.publishEvent(seqs[i], pendingPayloads[i], pb.StatusResponse_PENDING)
+	}
+	return seqs, pendingPayloads, nil
+}
+
+// sendGroup sends the payloads with the given sequence numbers, the last of
+// which is the group's summary: it is sent only once the others have been
+// (or have given up), so that the app never shows a summary of notifications
+// it has not received. (recoverBacklog & drain keep this order too, using the
+// summary's group_member_seqs.) The caller must have added len(seqs) to
+// ns.senders (see startSenders).
+func (ns *notificationService) sendGroup(seqs []uint64) {
+	var group sync.WaitGroup
+	for _, seq := range seqs[:len(seqs)-1] {
+		group.Add(1)
+		go func(seq uint64) {
+			defer group.Done()
+			ns.sendPayload(seq)
+		}(seq)
+	}
+	group.Wait()
+	ns.sendPayload(seqs[len(seqs)-1])
+}
+
+// groupMembersPending returns true if the pending message with the given
+// sequence number is a group summary, some of whose notifications are still
+// pending.
+func (ns *notificationService) groupMembersPending(seq uint64) (bool, error) {
+	var pending bool
+	err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		ppBytes := messagesBucket.Get(seqKey(seq))
+		if ppBytes == nil {
+			return nil
+		}
+		pendingPayload := &pb.PendingPayload{}
+		if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
+			return fmt.Errorf("could not unmarshal pending payload %d: %v", seq, err)
+		}
+		for _, member := range pendingPayload.GroupMemberSeqs {
+			if messagesBucket.Get(seqKey(member)) != nil {
+				pending = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// backlogGroup is a group summary in a recovered backlog, held until those
+// of its notifications in the backlog have been sent (or have given up).
+type backlogGroup struct {
+	summary uint64
+	pending int32 // notifications not yet finished; accessed atomically
+}
+
+// backlogGroups finds the group summaries among the given pending messages
+// which must wait for others among them. It returns the groups by the
+// sequence numbers of their pending notifications, and the set of held
+// summaries.
+func (ns *notificationService) backlogGroups(seqs []uint64) (map[uint64]*backlogGroup, map[uint64]bool, error) {
+	inBacklog := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		inBacklog[seq] = true
+	}
+	groups, held := map[uint64]*backlogGroup{}, map[uint64]bool{}
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		for _, seq := range seqs {
+			pendingPayload := &pb.PendingPayload{}
+			if err := proto.Unmarshal(messagesBucket.Get(seqKey(seq)), pendingPayload); err != nil {
+				return fmt.Errorf("could not unmarshal pending payload %d: %v", seq, err)
+			}
+			g := &backlogGroup{summary: seq}
+			for _, member := range pendingPayload.GroupMemberSeqs {
+				if inBacklog[member] {
+					groups[member] = g
+					g.pending++
+				}
+			}
+			if g.pending > 0 {
+				held[seq] = true
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return groups, held, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// enqueueTestGroup enqueues a group of n notifications & its summary, without
+// sending them, returning their sequence numbers (the summary's last).
+func enqueueTestGroup(t *testing.T, ns *notificationService, n int) []uint64 {
+	var reqs []*pb.SendNotificationRequest
+	var titles []string
+	for i := 0; i < n; i++ {
+		req := testRequest(fmt.Sprintf("member %d", i))
+		req.Notification.ThreadId = "thread"
+		reqs, titles = append(reqs, req), append(titles, req.Notification.Title)
+	}
+	summary, err := ns.groupSummaryRequest(&pb.GroupRequest{ThreadId: "thread"}, reqs, titles)
+	if err != nil {
+		t.Fatalf("Could not build group summary: %v", err)
+	}
+	seqs, _, err := ns.enqueueGroup(append(reqs, summary))
+	if err != nil {
+		t.Fatalf("Could not enqueue group: %v", err)
+	}
+	return seqs
+}
+
+func TestEnqueueGroupRecordsMembers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	seqs := enqueueTestGroup(t, ns, 3)
+
+	pending := pendingPayloads(t, ns)
+	summary := seqs[len(seqs)-1]
+	if got, want := pending[summary].GroupMemberSeqs, seqs[:len(seqs)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Summary's group_member_seqs = %v, want %v", got, want)
+	}
+	for _, seq := range seqs[:len(seqs)-1] {
+		if got := pending[seq].GroupMemberSeqs; len(got) != 0 {
+			t.Errorf("Member %d has group_member_seqs %v, want none", seq, got)
+		}
+	}
+}
+
+// TestRecoverBacklogGroupSummaryLast recovers a group newest first, which
+// would otherwise dispatch the summary before its notifications.
+func TestRecoverBacklogGroupSummaryLast(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	fcm := startRecordingFCM(t, ns.creds().gcmCipher)
+	defer fcm.Close()
+	ns.fcmAddress = fcm.URL
+	ns.drainOrder = pb.BNotifySettings_NEWEST_FIRST
+	seqs := enqueueTestGroup(t, ns, 3)
+
+	ns.recoverBacklog(append([]uint64(nil), seqs...))
+	eventually(t, "the whole group is sent", func() bool { return len(fcm.receivedSeqs()) == len(seqs) })
+	ns.senders.Wait()
+	got := fcm.receivedSeqs()
+	if summary := seqs[len(seqs)-1]; got[len(got)-1] != summary {
+		t.Errorf("FCM received %v, want summary %d last", got, summary)
+	}
+}
+
+func TestDrainGroupSummaryLast(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	fcm := startRecordingFCM(t, ns.creds().gcmCipher)
+	defer fcm.Close()
+	ns.fcmAddress = fcm.URL
+	ns.drainOrder = pb.BNotifySettings_NEWEST_FIRST
+	seqs := enqueueTestGroup(t, ns, 3)
+
+	// A single bounded pass, newest first, reaches the summary first: it must
+	// be deferred until its notifications are sent, not left pending.
+	ns.drain(pb.BNotifySettings_BOUNDED, 5*time.Second)
+	want := []uint64{seqs[2], seqs[1], seqs[0], seqs[3]}
+	if got := fcm.receivedSeqs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FCM received %v, want %v", got, want)
+	}
+	if pending := pendingPayloads(t, ns); len(pending) != 0 {
+		t.Errorf("Got %d pending messages after draining, want 0", len(pending))
+	}
+}
+
+// mutedCount returns the number of notifications muted by ns's only mute rule.
+func mutedCount(t *testing.T, ns *notificationService) int64 {
+	resp, err := ns.ListMutes(context.Background(), &pb.ListMutesRequest{})
+	if err != nil || len(resp.Rules) != 1 {
+		t.Fatalf("ListMutes = %v, %v; want one rule", resp, err)
+	}
+	return resp.Rules[0].MutedCount
+}
+
+func TestSendGroupNotificationReservesBeforeAdmitting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	if _, err := ns.AddMute(context.Background(), &pb.AddMuteRequest{
+		Rule:            &pb.MuteRule{TitlePrefix: "muted"},
+		DurationSeconds: 3600,
+	}); err != nil {
+		t.Fatalf("Could not add mute rule: %v", err)
+	}
+	group := func() *pb.GroupRequest {
+		return &pb.GroupRequest{
+			ThreadId: "thread",
+			Notifications: []*pb.Notification{
+				{Title: "muted 1", Text: "text"},
+				{Title: "muted 2", Text: "text"},
+			},
+		}
+	}
+
+	// Two notifications & a summary need three slots: the group is rejected
+	// before any notification is counted as muted.
+	ns.inFlight = semaphore.NewWeighted(2)
+	if _, err := ns.SendGroupNotification(context.Background(), group()); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("SendGroupNotification with too few slots = %v, want ResourceExhausted", err)
+	}
+	if got := mutedCount(t, ns); got != 0 {
+		t.Errorf("Rejected group muted %d notification(s), want 0", got)
+	}
+
+	// With room, both are muted, & every reserved slot is released.
+	ns.inFlight = semaphore.NewWeighted(3)
+	resp, err := ns.SendGroupNotification(context.Background(), group())
+	if err != nil {
+		t.Fatalf("SendGroupNotification: %v", err)
+	}
+	if resp.SummaryNotificationId != "" {
+		t.Errorf("Got summary %q for fully muted group, want none", resp.SummaryNotificationId)
+	}
+	if got := mutedCount(t, ns); got != 2 {
+		t.Errorf("Group muted %d notification(s), want 2", got)
+	}
+	if !ns.inFlight.TryAcquire(3) {
+		t.Errorf("In-flight slots were not released after muting the group")
+	}
+}
+
+// summaryOf returns the notification in the pending summary of the group
+// whose notification IDs are given by resp.
+func summaryOf(t *testing.T, ns *notificationService, resp *pb.GroupResponse) *pb.Notification {
+	for _, pp := range pendingPayloads(t, ns) {
+		if pp.NotificationId == resp.SummaryNotificationId {
+			_, message := openTestPayload(t, ns.creds().gcmCipher, pp.Payload)
+			return message.Notification
+		}
+	}
+	t.Fatalf("Summary %q is not pending", resp.SummaryNotificationId)
+	return nil
+}
+
+func TestGroupSummaryFitsPayload(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	ns.fcmAddress = "http://127.0.0.1:0" // unreachable, so that the group stays pending
+
+	// Each notification is well within the limit, but their titles together
+	// are not.
+	req := &pb.GroupRequest{ThreadId: "thread"}
+	for i := 0; i < 40; i++ {
+		req.Notifications = append(req.Notifications, &pb.Notification{Title: fmt.Sprintf("%03d %s", i, strings.Repeat("t", 200)), Text: "text"})
+	}
+	resp, err := ns.SendGroupNotification(context.Background(), req)
+	if err != nil {
+		t.Fatalf("SendGroupNotification: %v", err)
+	}
+	summary := summaryOf(t, ns, resp)
+	lines := strings.Split(summary.Text, "\n")
+	if len(lines) < 2 || len(lines) > len(req.Notifications) || lines[len(lines)-1] != "…" {
+		t.Errorf("Summary lists %d line(s) ending %q; want a truncated list ending with an ellipsis", len(lines), lines[len(lines)-1])
+	}
+	for i, line := range lines[:len(lines)-1] {
+		if !strings.HasPrefix(line, fmt.Sprintf("%03d ", i)) {
+			t.Errorf("Summary line %d is %q, want title %d", i, line, i)
+		}
+	}
+	for seq, pp := range pendingPayloads(t, ns) {
+		_, message := openTestPayload(t, ns.creds().gcmCipher, pp.Payload)
+		bound, err := maxNotificationPayloadSize(message.Notification, ns.creds().gcmCipher.Overhead())
+		if err != nil {
+			t.Fatalf("maxNotificationPayloadSize: %v", err)
+		}
+		if size := payloadSize(pp.Payload); size > bound || size > maxPayloadSize {
+			t.Errorf("Message %d has payload size %d, bound %d; want at most the bound & %d", seq, size, bound, maxPayloadSize)
+		}
+	}
+	ns.drain(pb.BNotifySettings_NONE, time.Second)
+}
+
+func TestGroupSummarySanitizedOnce(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	ns.fcmAddress = "http://127.0.0.1:0"
+	ns.sanitizeHTML = true
+
+	resp, err := ns.SendGroupNotification(context.Background(), &pb.GroupRequest{
+		ThreadId: "thread",
+		Notifications: []*pb.Notification{
+			{Title: "fish & chips", Text: "text"},
+			{Title: "<b>bold</b>", Text: "text"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SendGroupNotification: %v", err)
+	}
+	if got, want := summaryOf(t, ns, resp).Text, "fish &amp; chips\n&lt;b&gt;bold&lt;/b&gt;"; got != want {
+		t.Errorf("Summary text = %q, want %q", got, want)
+	}
+	ns.drain(pb.BNotifySettings_NONE, time.Second)
+}
+
+func TestRejectedGroupHasNoSideEffects(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, checkSettings())
+	defer cleanup()
+	if _, err := ns.AddMute(context.Background(), &pb.AddMuteRequest{
+		Rule:            &pb.MuteRule{TitlePrefix: "muted"},
+		DurationSeconds: 3600,
+	}); err != nil {
+		t.Fatalf("Could not add mute rule: %v", err)
+	}
+	initial := checkState(t, ns, "backup").LastPing
+
+	// The group passes verification, but its second notification is too
+	// large to enqueue.
+	_, err := ns.SendGroupNotification(context.Background(), &pb.GroupRequest{
+		ThreadId: "thread",
+		Notifications: []*pb.Notification{
+			{Title: "muted", Text: "text"},
+			{Title: "backup done", Text: strings.Repeat("x", maxPayloadSize), Data: map[string]string{checkDataKey: "backup"}},
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("SendGroupNotification with oversized notification = %v, want InvalidArgument", err)
+	}
+	if got := mutedCount(t, ns); got != 0 {
+		t.Errorf("Rejected group muted %d notification(s), want 0", got)
+	}
+	if got := checkState(t, ns, "backup").LastPing; !proto.Equal(got, initial) {
+		t.Errorf("Rejected group pinged check: last ping %v, want %v", got, initial)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// testSendWait is how long SendTestNotification waits for its notification
+// to be sent.
+const testSendWait = 10 * time.Second
+
+var (
+	testNotificationsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bnotify_test_notifications_sent_total",
+		Help: "Number of periodic test notifications sent to FCM.",
+	})
+	testNotificationsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bnotify_test_notifications_failed_total",
+		Help: "Number of periodic test notifications which could not be enqueued or were not sent to FCM within the test interval.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(testNotificationsSent, testNotificationsFailed)
+}
+
+// sendTestNotificationsPeriodically sends a test notification at the given
+// interval until the service begins draining, to check that the delivery
+// pipeline works end-to-end.
+func (ns *notificationService) sendTestNotificationsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ns.stopping:
+			return
+		}
+		ns.mu.RLock()
+		localizer := ns.localizer
+		ns.mu.RUnlock()
+		n := &pb.Notification{
+			Title: localizer.format(msgTestNotificationTitle, nil),
+			Text:  localizer.format(msgTestNotificationText, struct{ Time string }{time.Now().Format(time.RFC3339)}),
+		}
+		switch _, _, s := ns.sendTestAndWait(n, interval); s {
+		case pb.StatusResponse_SENT:
+			testNotificationsSent.Inc()
+		default:
+			log.Printf("Warning: test notification was not sent within %v (status: %v)", interval, s)
+			testNotificationsFailed.Inc()
+		}
+	}
+}
+
+// sendTestAndWait enqueues & sends the given test notification, bypassing
+// enrichment & mute rules, and waits up to timeout for it to be sent. It
+// returns the notification's sequence number & ID, and its last known status,
+// which is UNKNOWN if it could not be enqueued.
+func (ns *notificationService) sendTestAndWait(n *pb.Notification, timeout time.Duration) (uint64, string, pb.StatusResponse_Status) {
+	// Start watching before enqueueing, so that no event is missed.
+	events, stop := ns.events.watch()
+	defer stop()
+	seq, pendingPayload, err := ns.enqueueMessage(&pb.SendNotificationRequest{Notification: n}, true)
+	if err != nil {
+		log.Printf("Error while enqueueing test notification: %v", err)
+		return 0, "", pb.StatusResponse_UNKNOWN
+	}
+	ns.dispatch(seq)
+	id := pendingPayload.NotificationId
+
+	status := pb.StatusResponse_PENDING
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-events:
+			if event.Seq != seq {
+				continue
+			}
+			status = event.Status
+			if status == pb.StatusResponse_SENT || status == pb.StatusResponse_FAILED {
+				return seq, id, status
+			}
+		case <-deadline:
+			return seq, id, status
+		case <-ns.stopping:
+			return seq, id, status
+		}
+	}
+}
+
+func (ns *notificationService) SendTestNotification(ctx context.Context, req *pb.SendTestNotificationRequest) (*pb.SendTestNotificationResponse, error) {
+	ns.mu.RLock()
+	localizer := ns.localizer
+	ns.mu.RUnlock()
+	n := &pb.Notification{
+		Title: localizer.format(msgTestSendTitle, nil),
+		Text:  localizer.format(msgTestSendText, struct{ Time string }{time.Now().Format("15:04")}),
+	}
+	seq, id, status := ns.sendTestAndWait(n, testSendWait)
+	if status == pb.StatusResponse_UNKNOWN {
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("[%s] Sent test notification (status: %v)", id, status)
+	return &pb.SendTestNotificationResponse{
+		Seq:            seq,
+		NotificationId: id,
+		Status:         status,
+	}, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+
+	pb "../proto"
+)
+
+// testSettings returns the settings used by tests, which send to a fake FCM.
+func testSettings() *pb.BNotifySettings {
+	return &pb.BNotifySettings{
+		ApiKey:         "test-api-key",
+		RegistrationId: "test-registration-id",
+		Password:       "test-password",
+	}
+}
+
+// testCipher returns a cipher with a fixed key. (newCipher is deliberately
+// slow, which would make tests slow too.)
+func testCipher(t *testing.T) cipher.AEAD {
+	block, err := aes.NewCipher(make([]byte, aesKeySize))
+	if err != nil {
+		t.Fatalf("Could not create block cipher: %v", err)
+	}
+	gcmCipher, err := cipher.NewGCMWithNonceSize(block, serverIDSize+binary.Size(uint64(0)))
+	if err != nil {
+		t.Fatalf("Could not create GCM cipher: %v", err)
+	}
+	return gcmCipher
+}
+
+// testStatePath returns the path of a state file in a new temporary
+// directory, along with a function removing the directory.
+func testStatePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bnotifyd-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	return filepath.Join(dir, "state.db"), func() { os.RemoveAll(dir) }
+}
+
+// openTestState opens the state file at statePath, initializing it the same
+// way serve does. It returns the sequence numbers of the pending messages.
+func openTestState(t *testing.T, statePath string, settings *pb.BNotifySettings) (*bolt.DB, []uint64) {
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Could not open state file: %v", err)
+	}
+	_, _, pendingSeqs, err := initState(db, settings)
+	if err != nil {
+		db.Close()
+		t.Fatalf("Could not initialize state file: %v", err)
+	}
+	return db, pendingSeqs
+}
+
+// newTestServiceForDB returns a notificationService using the given state
+// file, which sends to fcmAddress.
+func newTestServiceForDB(t *testing.T, db *bolt.DB, settings *pb.BNotifySettings, fcmAddress string) *notificationService {
+	apiKeys, err := newAPIKeyRing(db, settings)
+	if err != nil {
+		t.Fatalf("Could not initialize API keys: %v", err)
+	}
+	localizer, err := newLocalizer("", nil)
+	if err != nil {
+		t.Fatalf("Could not initialize localizer: %v", err)
+	}
+	ns := &notificationService{
+		db:           db,
+		apiKeys:      apiKeys,
+		password:     settings.Password,
+		fcmAddress:   fcmAddress,
+		payloadSizes: newSizeSummary(),
+		localizer:    localizer,
+		stopping:     make(chan struct{}),
+		events:       newEventBroadcaster(),
+		serverEvents: newServerEventBroadcaster(),
+
+		quota: newQuotaTracker(settings),
+
+		tokens: newTokenMonitor(),
+		checks: settings.Checks,
+	}
+	ns.credentials.Store(&credentials{settings.RegistrationId, testCipher(t)})
+	return ns
+}
+
+// newTestService returns a notificationService backed by a new state file,
+// which sends to a fake FCM. The returned function must be called once the
+// test is done with the service; it stops the service's senders, so it may
+// be called whether or not the test drained the service.
+func newTestService(t *testing.T, settings *pb.BNotifySettings) (*notificationService, func()) {
+	statePath, removeState := testStatePath(t)
+	db, _ := openTestState(t, statePath, settings)
+	fcm := startFakeFCM()
+	ns := newTestServiceForDB(t, db, settings, fcm.URL)
+	return ns, func() {
+		stopTestService(ns)
+		fcm.Close()
+		db.Close()
+		removeState()
+	}
+}
+
+// stopTestService stops ns's senders (as drain does, without draining),
+// waiting for them to return, unless ns has already been drained.
+func stopTestService(ns *notificationService) {
+	ns.startMu.Lock()
+	if !ns.isStopping() {
+		close(ns.stopping)
+	}
+	ns.startMu.Unlock()
+	ns.senders.Wait()
+}
+
+// eventually polls cond until it is true, failing the test if it does not
+// become true within a few seconds.
+func eventually(t *testing.T, desc string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting until %s", desc)
+		}
+	}
+}
+
+// testRequest returns a request for a notification with the given title.
+func testRequest(title string) *pb.SendNotificationRequest {
+	return &pb.SendNotificationRequest{
+		Notification: &pb.Notification{Title: title, Text: "text"},
+	}
+}
+
+// pendingPayloads returns the pending messages in ns's state file, keyed by
+// sequence number.
+func pendingPayloads(t *testing.T, ns *notificationService) map[uint64]*pb.PendingPayload {
+	pendingPayloads := map[uint64]*pb.PendingPayload{}
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("pending_messages")).ForEach(func(key, ppBytes []byte) error {
+			pendingPayload := &pb.PendingPayload{}
+			if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
+				return err
+			}
+			pendingPayloads[binary.BigEndian.Uint64(key)] = pendingPayload
+			return nil
+		})
+	}); err != nil {
+		t.Fatalf("Could not read pending messages: %v", err)
+	}
+	return pendingPayloads
+}
+
+// openTestPayload decrypts the given payload with gcmCipher, returning its
+// nonce & message.
+func openTestPayload(t *testing.T, gcmCipher cipher.AEAD, payload []byte) ([]byte, *pb.Message) {
+	envelope := &pb.Envelope{}
+	if err := proto.Unmarshal(payload, envelope); err != nil {
+		t.Fatalf("Could not unmarshal envelope: %v", err)
+	}
+	plaintextMessage, err := gcmCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+	if err != nil {
+		t.Fatalf("Could not decrypt message: %v", err)
+	}
+	message := &pb.Message{}
+	if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+		t.Fatalf("Could not unmarshal message: %v", err)
+	}
+	return envelope.Nonce, message
+}
+
+// recordingFCM is a fake FCM which decrypts the messages it accepts, so that
+// tests can check what was sent, & in what order.
+type recordingFCM struct {
+	*httptest.Server
+
+	mu       sync.Mutex // protects messages
+	messages []*pb.Message
+}
+
+// startRecordingFCM starts a recordingFCM, which decrypts with gcmCipher.
+func startRecordingFCM(t *testing.T, gcmCipher cipher.AEAD) *recordingFCM {
+	rf := &recordingFCM{}
+	rf.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := base64.StdEncoding.DecodeString(r.PostFormValue("data.payload"))
+		if err != nil {
+			t.Errorf("Fake FCM could not decode payload: %v", err)
+			fmt.Fprintln(w, "Error=InvalidDataKey")
+			return
+		}
+		envelope := &pb.Envelope{}
+		if err := proto.Unmarshal(payload, envelope); err != nil {
+			t.Errorf("Fake FCM could not unmarshal envelope: %v", err)
+			fmt.Fprintln(w, "Error=InvalidDataKey")
+			return
+		}
+		plaintextMessage, err := gcmCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+		if err != nil {
+			t.Errorf("Fake FCM could not decrypt message: %v", err)
+			fmt.Fprintln(w, "Error=InvalidDataKey")
+			return
+		}
+		message := &pb.Message{}
+		if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+			t.Errorf("Fake FCM could not unmarshal message: %v", err)
+			fmt.Fprintln(w, "Error=InvalidDataKey")
+			return
+		}
+		rf.mu.Lock()
+		rf.messages = append(rf.messages, message)
+		n := len(rf.messages)
+		rf.mu.Unlock()
+		fmt.Fprintf(w, "id=0:%d\n", n)
+	}))
+	return rf
+}
+
+// received returns the messages received so far, in the order received.
+func (rf *recordingFCM) received() []*pb.Message {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return append([]*pb.Message(nil), rf.messages...)
+}
+
+// receivedSeqs returns the sequence numbers of the messages received so far,
+// in the order received.
+func (rf *recordingFCM) receivedSeqs() []uint64 {
+	var seqs []uint64
+	for _, message := range rf.received() {
+		seqs = append(seqs, message.Seq)
+	}
+	return seqs
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// notificationID returns the globally unique ID of the message with the given
+// server ID & sequence number.
+func notificationID(serverID []byte, seq uint64) string {
+	return fmt.Sprintf("%x-%d", serverID, seq)
+}
+
+// parseNotificationID parses a notification ID as returned by notificationID.
+func parseNotificationID(id string) (serverID []byte, seq uint64, _ error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("malformed notification ID %q", id)
+	}
+	serverID, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed server ID in notification ID %q: %v", id, err)
+	}
+	seq, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed sequence number in notification ID %q: %v", id, err)
+	}
+	return serverID, seq, nil
+}
+
+// sentMessage builds the history record for the given just-sent payload.
+func (ns *notificationService) sentMessage(seq uint64, pendingPayload *pb.PendingPayload) (*pb.SentMessage, error) {
+	message, err := ns.openPayload(pendingPayload.Payload)
+	if err != nil {
+		return nil, err
+	}
+	sentTime, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sentMessage := &pb.SentMessage{
+		NotificationId: pendingPayload.NotificationId,
+		Seq:            seq,
+		Notification:   message.Notification,
+		EnqueueTime:    pendingPayload.EnqueueTime,
+		SentTime:       sentTime,
+		SendAttempts:   pendingPayload.SendAttempts + 1,
+		Test:           pendingPayload.Test,
+		AndroidConfig:  pendingPayload.AndroidConfig,
+		Priority:       pendingPayload.Priority,
+	}
+	if ns.historyMode == pb.BNotifySettings_HASH_ONLY {
+		hashContent(ns.historySalt, sentMessage)
+	}
+	return sentMessage, nil
+}
+
+// putSentMessage writes a history record to the sent_messages bucket.
+func putSentMessage(tx *bolt.Tx, sentMessage *pb.SentMessage) error {
+	sentBucket := tx.Bucket([]byte("sent_messages"))
+	if sentBucket == nil {
+		return errors.New("missing sent_messages bucket")
+	}
+	smBytes, err := proto.Marshal(sentMessage)
+	if err != nil {
+		return fmt.Errorf("could not marshal sent message: %v", err)
+	}
+	return sentBucket.Put(seqKey(sentMessage.Seq), smBytes)
+}
+
+// putDeadLetter writes a message which could not be sent to the dead_letter bucket.
+func putDeadLetter(tx *bolt.Tx, seq uint64, pendingPayload *pb.PendingPayload, reason pb.DeadLetter_Reason) error {
+	deadLetterBucket := tx.Bucket([]byte("dead_letter"))
+	if deadLetterBucket == nil {
+		return errors.New("missing dead_letter bucket")
+	}
+	now, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return err
+	}
+	dlBytes, err := proto.Marshal(&pb.DeadLetter{
+		PendingPayload: pendingPayload,
+		Reason:         reason,
+		Time:           now,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal dead letter: %v", err)
+	}
+	return deadLetterBucket.Put(seqKey(seq), dlBytes)
+}
+
+// ExportHistory walks history in sequence (that is, enqueue) order, merging
+// the sent_messages & dead_letter buckets, so that a single sequence number
+// serves as the resumption cursor & nothing need be held in memory beyond one
+// batch of records. Consumers wanting finish-time order should sort by
+// finish_time themselves.
+func (ns *notificationService) ExportHistory(req *pb.ExportHistoryRequest, stream pb.NotificationService_ExportHistoryServer) error {
+	var since time.Time
+	if req.Since != nil {
+		t, err := ptypes.Timestamp(req.Since)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "bad since: %v", err)
+		}
+		since = t
+	}
+
+	cursor := req.AfterSeq
+	for cursor < math.MaxUint64 {
+		records, err := ns.historyRecords(cursor+1, streamBatchSize)
+		if err != nil {
+			log.Printf("Error while exporting history: %v", err)
+			return status.Error(codes.Internal, "internal error")
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, r := range records {
+			cursor = r.Seq
+			if !since.IsZero() {
+				enqueueTime, err := ptypes.Timestamp(r.EnqueueTime)
+				if err != nil || enqueueTime.Before(since) {
+					continue
+				}
+			}
+			if req.RedactTitles {
+				r.Title = ""
+			}
+			if err := stream.Send(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// historyRecords returns up to n history records with sequence numbers of at
+// least startSeq, in sequence order. Records are read from both the
+// sent_messages & dead_letter buckets.
+func (ns *notificationService) historyRecords(startSeq uint64, n int) ([]*pb.HistoryRecord, error) {
+	var records []*pb.HistoryRecord
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		sentBucket := tx.Bucket([]byte("sent_messages"))
+		if sentBucket == nil {
+			return errors.New("missing sent_messages bucket")
+		}
+		deadLetterBucket := tx.Bucket([]byte("dead_letter"))
+		if deadLetterBucket == nil {
+			return errors.New("missing dead_letter bucket")
+		}
+
+		// Merge the two buckets, whose keys are both big-endian sequence numbers.
+		sentCursor, deadLetterCursor := sentBucket.Cursor(), deadLetterBucket.Cursor()
+		sk, sv := sentCursor.Seek(seqKey(startSeq))
+		dk, dv := deadLetterCursor.Seek(seqKey(startSeq))
+		for len(records) < n && (sk != nil || dk != nil) {
+			if dk == nil || (sk != nil && bytes.Compare(sk, dk) <= 0) {
+				r, err := sentHistoryRecord(sv)
+				if err != nil {
+					return fmt.Errorf("could not read sent message %x: %v", sk, err)
+				}
+				records = append(records, r)
+				sk, sv = sentCursor.Next()
+				continue
+			}
+			r, err := ns.deadLetterHistoryRecord(binary.BigEndian.Uint64(dk), dv)
+			if err != nil {
+				return fmt.Errorf("could not read dead letter %x: %v", dk, err)
+			}
+			records = append(records, r)
+			dk, dv = deadLetterCursor.Next()
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func sentHistoryRecord(smBytes []byte) (*pb.HistoryRecord, error) {
+	sentMessage := &pb.SentMessage{}
+	if err := proto.Unmarshal(smBytes, sentMessage); err != nil {
+		return nil, err
+	}
+	return &pb.HistoryRecord{
+		Seq:            sentMessage.Seq,
+		NotificationId: sentMessage.NotificationId,
+		Title:          sentMessage.GetNotification().GetTitle(),
+		EnqueueTime:    sentMessage.EnqueueTime,
+		FinishTime:     sentMessage.SentTime,
+		SendAttempts:   sentMessage.SendAttempts,
+		Status:         pb.StatusResponse_SENT,
+		LatencyMs:      latencyMillis(sentMessage.EnqueueTime, sentMessage.SentTime),
+		ContentHashed:  sentMessage.ContentHash != nil,
+		Test:           sentMessage.Test,
+	}, nil
+}
+
+func (ns *notificationService) deadLetterHistoryRecord(seq uint64, dlBytes []byte) (*pb.HistoryRecord, error) {
+	deadLetter := &pb.DeadLetter{}
+	if err := proto.Unmarshal(dlBytes, deadLetter); err != nil {
+		return nil, err
+	}
+	pendingPayload := deadLetter.GetPendingPayload()
+	r := &pb.HistoryRecord{
+		Seq:            seq,
+		NotificationId: pendingPayload.GetNotificationId(),
+		EnqueueTime:    pendingPayload.GetEnqueueTime(),
+		FinishTime:     deadLetter.Time,
+		SendAttempts:   pendingPayload.GetSendAttempts(),
+		Status:         pb.StatusResponse_FAILED,
+		LatencyMs:      latencyMillis(pendingPayload.GetEnqueueTime(), deadLetter.Time),
+		Test:           pendingPayload.GetTest(),
+	}
+	// The title is only available by decrypting the payload. Failure to do so
+	// should not prevent the rest of the record from being exported.
+	if message, err := ns.openPayload(pendingPayload.GetPayload()); err != nil {
+		log.Printf("Warning: could not decrypt dead letter %s: %v", r.NotificationId, err)
+	} else {
+		r.Title = message.GetNotification().GetTitle()
+	}
+	return r, nil
+}
+
+// latencyMillis returns the time between the given timestamps in
+// milliseconds, or 0 if either timestamp is missing or invalid, or if end is
+// before start (e.g. due to a clock jump).
+func latencyMillis(start, end *timestamp.Timestamp) int64 {
+	startTime, err := ptypes.Timestamp(start)
+	if err != nil {
+		return 0
+	}
+	endTime, err := ptypes.Timestamp(end)
+	if err != nil {
+		return 0
+	}
+	if endTime.Before(startTime) {
+		return 0
+	}
+	return int64(endTime.Sub(startTime) / time.Millisecond)
+}
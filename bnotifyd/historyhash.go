@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// historySaltSize is the size of the salt used to hash history content, in bytes.
+const historySaltSize = 32
+
+// loadHistorySalt returns the salt used to hash history content, generating &
+// storing one if the state has none yet.
+func loadHistorySalt(tx *bolt.Tx) ([]byte, error) {
+	settingsBucket := tx.Bucket([]byte("settings"))
+	if settingsBucket == nil {
+		return nil, errors.New("missing settings bucket")
+	}
+	if salt := settingsBucket.Get([]byte("historySalt")); salt != nil {
+		return append([]byte(nil), salt...), nil
+	}
+	salt := make([]byte, historySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("could not generate history salt: %v", err)
+	}
+	if err := settingsBucket.Put([]byte("historySalt"), salt); err != nil {
+		return nil, fmt.Errorf("could not store history salt: %v", err)
+	}
+	return salt, nil
+}
+
+// contentHash returns the salted hash of a notification's title & text.
+func contentHash(salt []byte, title, text string) []byte {
+	mac := hmac.New(sha256.New, salt)
+	// The title is length-prefixed so that the boundary with the text is unambiguous.
+	fmt.Fprintf(mac, "%d:%s%s", len(title), title, text)
+	return mac.Sum(nil)
+}
+
+// hashContent replaces the notification in the given history record with a
+// hash of its content.
+func hashContent(salt []byte, sentMessage *pb.SentMessage) {
+	n := sentMessage.Notification
+	sentMessage.ContentHash = contentHash(salt, n.GetTitle(), n.GetText())
+	sentMessage.ContentLength = int32(len(n.GetTitle()) + len(n.GetText()))
+	sentMessage.Notification = nil
+}
+
+func (ns *notificationService) CheckHistory(ctx context.Context, req *pb.CheckHistoryRequest) (*pb.CheckHistoryResponse, error) {
+	hash := contentHash(ns.historySalt, req.Title, req.Text)
+	resp := &pb.CheckHistoryResponse{}
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		sentBucket := tx.Bucket([]byte("sent_messages"))
+		if sentBucket == nil {
+			return errors.New("missing sent_messages bucket")
+		}
+		return sentBucket.ForEach(func(key, smBytes []byte) error {
+			sentMessage := &pb.SentMessage{}
+			if err := proto.Unmarshal(smBytes, sentMessage); err != nil {
+				return fmt.Errorf("could not unmarshal sent message %x: %v", key, err)
+			}
+			var match bool
+			if n := sentMessage.Notification; n != nil {
+				match = n.Title == req.Title && n.Text == req.Text
+			} else {
+				match = hmac.Equal(sentMessage.ContentHash, hash)
+			}
+			if match {
+				resp.Matches = append(resp.Matches, &pb.CheckHistoryResponse_Match{
+					Seq:            sentMessage.Seq,
+					NotificationId: sentMessage.NotificationId,
+					SentTime:       sentMessage.SentTime,
+				})
+			}
+			return nil
+		})
+	}); err != nil {
+		log.Printf("Error while checking history: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return resp, nil
+}
+
+func (ns *notificationService) PurgePlaintextHistory(ctx context.Context, req *pb.PurgePlaintextHistoryRequest) (*pb.PurgePlaintextHistoryResponse, error) {
+	if err := ns.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	var count int
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		sentBucket := tx.Bucket([]byte("sent_messages"))
+		if sentBucket == nil {
+			return errors.New("missing sent_messages bucket")
+		}
+		updated := map[string][]byte{}
+		if err := sentBucket.ForEach(func(key, smBytes []byte) error {
+			sentMessage := &pb.SentMessage{}
+			if err := proto.Unmarshal(smBytes, sentMessage); err != nil {
+				return fmt.Errorf("could not unmarshal sent message %x: %v", key, err)
+			}
+			if sentMessage.Notification == nil {
+				return nil
+			}
+			hashContent(ns.historySalt, sentMessage)
+			smBytes, err := proto.Marshal(sentMessage)
+			if err != nil {
+				return fmt.Errorf("could not marshal sent message %x: %v", key, err)
+			}
+			updated[string(key)] = smBytes
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// Buckets may not be modified while iterating over them, so write back afterwards.
+		for key, smBytes := range updated {
+			if err := sentBucket.Put([]byte(key), smBytes); err != nil {
+				return fmt.Errorf("could not write sent message: %v", err)
+			}
+		}
+		count = len(updated)
+		return nil
+	}); err != nil {
+		log.Printf("Error while purging plaintext history: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("Purged plaintext content of %d history record(s)", count)
+	return &pb.PurgePlaintextHistoryResponse{PurgedCount: int32(count)}, nil
+}
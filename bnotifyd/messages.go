@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"text/template"
+)
+
+// Keys of daemon-generated, user-visible messages.
+const (
+	msgMuteSummaryTitle  = "mute_summary_title"
+	msgMuteSummaryText   = "mute_summary_text"
+	msgQuotaWarningTitle = "quota_warning_title"
+	msgQuotaWarningText  = "quota_warning_text"
+
+	msgTestNotificationTitle = "test_notification_title"
+	msgTestNotificationText  = "test_notification_text"
+	msgTestSendTitle         = "test_send_title"
+	msgTestSendText          = "test_send_text"
+
+	msgCheckMissedTitle = "check_missed_title"
+	msgCheckMissedText  = "check_missed_text"
+
+	msgGroupSummaryTitle = "group_summary_title"
+)
+
+// defaultLocale is the locale used if none is specified in settings.
+const defaultLocale = "en"
+
+// catalogs maps each supported locale to its messages. Messages are
+// text/template templates; the plural function selects among its arguments
+// according to the locale's plural rule, e.g. {{plural .Count "one" "many"}}.
+var catalogs = map[string]map[string]string{
+	"en": {
+		msgMuteSummaryTitle:  "Muted notifications",
+		msgMuteSummaryText:   `{{.Count}} {{plural .Count "notification" "notifications"}} matching {{if .TitlePrefix}}title prefix {{printf "%q" .TitlePrefix}}{{end}}{{if and .TitlePrefix .TitleRegex}} and {{end}}{{if .TitleRegex}}title regex {{printf "%q" .TitleRegex}}{{end}} {{plural .Count "was" "were"}} muted`,
+		msgQuotaWarningTitle: "FCM quota nearly exhausted",
+		msgQuotaWarningText:  `{{.Count}} of {{.Limit}} FCM requests allowed per {{.Window}} ({{.Scope}}) have been used`,
+
+		msgTestNotificationTitle: "bnotifyd health check",
+		msgTestNotificationText:  "Delivery pipeline OK at {{.Time}}",
+		msgTestSendTitle:         "Test notification",
+		msgTestSendText:          "Test from bnotifyd at {{.Time}}, press and hold to dismiss",
+
+		msgCheckMissedTitle: "{{.Name}} check missed",
+		msgCheckMissedText:  "{{.Name}} check missed, last seen {{.Ago}} ago",
+
+		msgGroupSummaryTitle: `{{.Count}} new {{plural .Count "notification" "notifications"}}`,
+	},
+	"de": {
+		msgMuteSummaryTitle:  "Stummgeschaltete Benachrichtigungen",
+		msgMuteSummaryText:   `{{.Count}} {{plural .Count "Benachrichtigung" "Benachrichtigungen"}} mit {{if .TitlePrefix}}Titelpräfix {{printf "%q" .TitlePrefix}}{{end}}{{if and .TitlePrefix .TitleRegex}} und {{end}}{{if .TitleRegex}}Titel-Regex {{printf "%q" .TitleRegex}}{{end}} {{plural .Count "wurde" "wurden"}} stummgeschaltet`,
+		msgQuotaWarningTitle: "FCM-Kontingent fast erschöpft",
+		msgQuotaWarningText:  `{{.Count}} von {{.Limit}} FCM-Anfragen pro {{if eq .Window "minute"}}Minute{{else if eq .Window "hour"}}Stunde{{else}}Tag{{end}} ({{if eq .Scope "device"}}Gerät{{else}}Projekt{{end}}) wurden verwendet`,
+
+		msgTestNotificationTitle: "bnotifyd-Zustandsprüfung",
+		msgTestNotificationText:  "Zustellung funktioniert, Stand {{.Time}}",
+		msgTestSendTitle:         "Testbenachrichtigung",
+		msgTestSendText:          "Test von bnotifyd um {{.Time}}, zum Schließen gedrückt halten",
+
+		msgCheckMissedTitle: "Prüfung {{.Name}} ausgeblieben",
+		msgCheckMissedText:  "Prüfung {{.Name}} ausgeblieben, zuletzt vor {{.Ago}} gemeldet",
+
+		msgGroupSummaryTitle: `{{.Count}} neue {{plural .Count "Benachrichtigung" "Benachrichtigungen"}}`,
+	},
+}
+
+// pluralRules maps each supported locale to a function returning the index
+// of the plural form to use for a given count.
+var pluralRules = map[string]func(n int64) int{
+	"en": oneOther,
+	"de": oneOther,
+}
+
+// oneOther is the plural rule for languages distinguishing only between one & other.
+func oneOther(n int64) int {
+	if n == 1 {
+		return 0
+	}
+	return 1
+}
+
+func init() {
+	// Every locale must provide every message & a plural rule.
+	for locale, catalog := range catalogs {
+		if _, ok := pluralRules[locale]; !ok {
+			panic(fmt.Sprintf("locale %q has no plural rule", locale))
+		}
+		for key := range catalogs[defaultLocale] {
+			if _, ok := catalog[key]; !ok {
+				panic(fmt.Sprintf("locale %q is missing message %q", locale, key))
+			}
+		}
+		if _, err := newLocalizer(locale, nil); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// localizer formats daemon-generated messages for a single locale.
+type localizer struct {
+	templates map[string]*template.Template
+}
+
+// newLocalizer returns a localizer for the given locale, with individual
+// messages replaced by those in overrides.
+func newLocalizer(locale string, overrides map[string]string) (*localizer, error) {
+	if locale == "" {
+		locale = defaultLocale
+	}
+	catalog, ok := catalogs[locale]
+	if !ok {
+		return nil, fmt.Errorf("unsupported locale %q", locale)
+	}
+	pluralRule := pluralRules[locale]
+	funcs := template.FuncMap{
+		"plural": func(n int64, forms ...string) (string, error) {
+			i := pluralRule(n)
+			if i >= len(forms) {
+				return "", fmt.Errorf("plural needs at least %d forms in locale %q", i+1, locale)
+			}
+			return forms[i], nil
+		},
+	}
+
+	l := &localizer{templates: map[string]*template.Template{}}
+	for key, msg := range catalog {
+		if override, ok := overrides[key]; ok {
+			msg = override
+		}
+		tmpl, err := template.New(key).Funcs(funcs).Parse(msg)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse message %q: %v", key, err)
+		}
+		l.templates[key] = tmpl
+	}
+	for key := range overrides {
+		if _, ok := catalog[key]; !ok {
+			return nil, fmt.Errorf("unknown message %q in message_overrides", key)
+		}
+	}
+	return l, nil
+}
+
+// format returns the message with the given key, filled in with data. If the
+// message cannot be formatted, the key is returned instead.
+func (l *localizer) format(key string, data interface{}) string {
+	var buf bytes.Buffer
+	if err := l.templates[key].Execute(&buf, data); err != nil {
+		log.Printf("Warning: could not format message %q: %v", key, err)
+		return key
+	}
+	return buf.String()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	pb "../proto"
+)
+
+var (
+	retryAfterRespected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bnotify_retry_after_respected_total",
+		Help: "Number of times a retry was delayed due to a Retry-After header from FCM.",
+	})
+	payloadSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bnotify_payload_size_bytes",
+		Help:    "Encoded size of enqueued payloads, as counted against the FCM payload size limit.",
+		Buckets: payloadSizeBuckets,
+	})
+	notificationsEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bnotify_notifications_enqueued_total",
+		Help: "Number of notifications enqueued, by kind (visible or silent).",
+	}, []string{"kind"})
+	clockJumps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bnotify_clock_jumps_total",
+		Help: "Number of times the system clock was detected to jump relative to the monotonic clock.",
+	})
+	stateFileSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bnotify_state_file_size_bytes",
+		Help: "Size of the state file.",
+	})
+	stateFilePages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bnotify_state_file_pages",
+		Help: "Number of pages in the state file, by state (used, free, or pending, i.e. waiting to become free).",
+	}, []string{"state"})
+	stateFileFreelistBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bnotify_state_file_freelist_bytes",
+		Help: "Size of the state file's freelist.",
+	})
+	fcmRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bnotify_fcm_requests",
+		Help: "Number of requests made to FCM in the last minute, hour, or day, by scope (project or device) & window.",
+	}, []string{"scope", "window"})
+	stateFileTransactions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bnotify_state_file_read_transactions",
+		Help: "Number of read transactions on the state file started since startup.",
+	})
+	stateBucketKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bnotify_state_bucket_keys",
+		Help: "Number of keys in each state file bucket.",
+	}, []string{"bucket"})
+	stateBucketBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bnotify_state_bucket_bytes",
+		Help: "Bytes of each state file bucket's pages, by page type (leaf or branch) & usage (inuse or alloc, i.e. in use or allocated).",
+	}, []string{"bucket", "type", "usage"})
+)
+
+func init() {
+	prometheus.MustRegister(retryAfterRespected, payloadSizeBytes, notificationsEnqueued, clockJumps)
+	prometheus.MustRegister(stateFileSizeBytes, stateFilePages, stateFileFreelistBytes, stateFileTransactions)
+	prometheus.MustRegister(stateBucketKeys, stateBucketBytes)
+	prometheus.MustRegister(fcmRequests)
+}
+
+// serveMetrics serves Prometheus metrics on the given address.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error serving metrics: %v", err)
+	}
+}
+
+// newMetricsPusher returns a pusher of all registered metrics to the
+// pushgateway at the given URL, labeled with the server ID as of startup.
+func newMetricsPusher(url string, serverID []byte) *push.Pusher {
+	return push.New(url, "bnotifyd").Gatherer(prometheus.DefaultGatherer).Grouping("instance", hex.EncodeToString(serverID))
+}
+
+// pushMetricsPeriodically pushes metrics with the given pusher forever.
+func pushMetricsPeriodically(pusher *push.Pusher, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := pusher.Push(); err != nil {
+			log.Printf("Warning: could not push metrics: %v", err)
+		}
+	}
+}
+
+// notificationKind returns the value of the "kind" label for the given notification.
+func notificationKind(n *pb.Notification) string {
+	if n.GetSilent() {
+		return "silent"
+	}
+	return "visible"
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// muteExpiryInterval is how often expired mute rules are garbage-collected.
+const muteExpiryInterval = time.Minute
+
+func (ns *notificationService) AddMute(ctx context.Context, req *pb.AddMuteRequest) (*pb.AddMuteResponse, error) {
+	// Verify request.
+	rule := req.Rule
+	if rule == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing rule")
+	}
+	if rule.TitlePrefix == "" && rule.TitleRegex == "" {
+		return nil, status.Error(codes.InvalidArgument, "rule has no matchers")
+	}
+	var titleRegexp *regexp.Regexp
+	if rule.TitleRegex != "" {
+		var err error
+		if titleRegexp, err = regexp.Compile(rule.TitleRegex); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad title_regex: %v", err)
+		}
+	}
+	if req.DurationSeconds <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "duration_seconds must be positive")
+	}
+	expireTime, err := ptypes.TimestampProto(time.Now().Add(time.Duration(req.DurationSeconds) * time.Second))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad duration_seconds: %v", err)
+	}
+
+	// Store rule.
+	rule = &pb.MuteRule{
+		TitlePrefix: rule.TitlePrefix,
+		TitleRegex:  rule.TitleRegex,
+		ExpireTime:  expireTime,
+		Action:      rule.Action,
+	}
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		mutesBucket := tx.Bucket([]byte("mutes"))
+		if mutesBucket == nil {
+			return errors.New("missing mutes bucket")
+		}
+		id, err := mutesBucket.NextSequence()
+		if err != nil {
+			return fmt.Errorf("could not allocate rule ID: %v", err)
+		}
+		rule.Id = id
+		ruleBytes, err := proto.Marshal(rule)
+		if err != nil {
+			return fmt.Errorf("could not marshal mute rule: %v", err)
+		}
+		return mutesBucket.Put(seqKey(id), ruleBytes)
+	}); err != nil {
+		log.Printf("Error while adding mute rule: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if titleRegexp != nil {
+		ns.muteRegexps.Store(rule.Id, titleRegexp)
+	}
+	log.Printf("Added mute rule %d (%s)", rule.Id, describeMute(rule))
+	return &pb.AddMuteResponse{Rule: rule}, nil
+}
+
+func (ns *notificationService) ListMutes(ctx context.Context, req *pb.ListMutesRequest) (*pb.ListMutesResponse, error) {
+	resp := &pb.ListMutesResponse{}
+	now := time.Now()
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		mutesBucket := tx.Bucket([]byte("mutes"))
+		if mutesBucket == nil {
+			return errors.New("missing mutes bucket")
+		}
+		return mutesBucket.ForEach(func(_, ruleBytes []byte) error {
+			rule := &pb.MuteRule{}
+			if err := proto.Unmarshal(ruleBytes, rule); err != nil {
+				return fmt.Errorf("could not unmarshal mute rule: %v", err)
+			}
+			if !muteExpired(rule, now) {
+				resp.Rules = append(resp.Rules, rule)
+			}
+			return nil
+		})
+	}); err != nil {
+		log.Printf("Error while listing mute rules: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return resp, nil
+}
+
+func (ns *notificationService) RemoveMute(ctx context.Context, req *pb.RemoveMuteRequest) (*pb.RemoveMuteResponse, error) {
+	found := false
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		mutesBucket := tx.Bucket([]byte("mutes"))
+		if mutesBucket == nil {
+			return errors.New("missing mutes bucket")
+		}
+		key := seqKey(req.Id)
+		found = mutesBucket.Get(key) != nil
+		return mutesBucket.Delete(key)
+	}); err != nil {
+		log.Printf("Error while removing mute rule: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	ns.muteRegexps.Delete(req.Id)
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "no mute rule with ID %d", req.Id)
+	}
+	log.Printf("Removed mute rule %d", req.Id)
+	return &pb.RemoveMuteResponse{}, nil
+}
+
+// findMute returns the key of an unexpired mute rule matching the given
+// notification, or nil if it is not muted. The rule's count of muted
+// notifications is not updated; see countMuted.
+func (ns *notificationService) findMute(n *pb.Notification) ([]byte, error) {
+	// Find a matching rule in a read-only transaction, since most notifications are not muted.
+	var ruleKey []byte
+	now := time.Now()
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		mutesBucket := tx.Bucket([]byte("mutes"))
+		if mutesBucket == nil {
+			return errors.New("missing mutes bucket")
+		}
+		c := mutesBucket.Cursor()
+		for key, ruleBytes := c.First(); key != nil; key, ruleBytes = c.Next() {
+			rule := &pb.MuteRule{}
+			if err := proto.Unmarshal(ruleBytes, rule); err != nil {
+				return fmt.Errorf("could not unmarshal mute rule: %v", err)
+			}
+			if !muteExpired(rule, now) && muteMatches(rule, ns.muteRegexp(rule), n) {
+				ruleKey = append([]byte(nil), key...)
+				return nil
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ruleKey, nil
+}
+
+// countMuted updates the count of muted notifications of the mute rule with
+// the given key (from findMute). The rule may have been removed in the
+// meantime, which is fine.
+func (ns *notificationService) countMuted(ruleKey []byte) error {
+	return ns.db.Batch(func(tx *bolt.Tx) error {
+		mutesBucket := tx.Bucket([]byte("mutes"))
+		if mutesBucket == nil {
+			return errors.New("missing mutes bucket")
+		}
+		ruleBytes := mutesBucket.Get(ruleKey)
+		if ruleBytes == nil {
+			return nil
+		}
+		rule := &pb.MuteRule{}
+		if err := proto.Unmarshal(ruleBytes, rule); err != nil {
+			return fmt.Errorf("could not unmarshal mute rule: %v", err)
+		}
+		rule.MutedCount++
+		ruleBytes, err := proto.Marshal(rule)
+		if err != nil {
+			return fmt.Errorf("could not marshal mute rule: %v", err)
+		}
+		return mutesBucket.Put(ruleKey, ruleBytes)
+	})
+}
+
+// muteSummary holds the values available to the mute summary message template.
+type muteSummary struct {
+	Count       int64
+	TitlePrefix string
+	TitleRegex  string
+}
+
+// expireMutes periodically removes expired mute rules, sending a summary
+// notification for expired HOLD_AND_SUMMARIZE rules which muted anything.
+func (ns *notificationService) expireMutes() {
+	for range time.Tick(muteExpiryInterval) {
+		var expired []*pb.MuteRule
+		now := time.Now()
+		if err := ns.db.Update(func(tx *bolt.Tx) error {
+			expired = nil
+			mutesBucket := tx.Bucket([]byte("mutes"))
+			if mutesBucket == nil {
+				return errors.New("missing mutes bucket")
+			}
+			var expiredKeys [][]byte
+			if err := mutesBucket.ForEach(func(key, ruleBytes []byte) error {
+				rule := &pb.MuteRule{}
+				if err := proto.Unmarshal(ruleBytes, rule); err != nil {
+					return fmt.Errorf("could not unmarshal mute rule: %v", err)
+				}
+				if muteExpired(rule, now) {
+					expired = append(expired, rule)
+					expiredKeys = append(expiredKeys, key)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, key := range expiredKeys {
+				if err := mutesBucket.Delete(key); err != nil {
+					return fmt.Errorf("could not delete mute rule: %v", err)
+				}
+			}
+			return nil
+		}); err != nil {
+			log.Printf("Error while expiring mute rules: %v", err)
+			continue
+		}
+
+		for _, rule := range expired {
+			ns.muteRegexps.Delete(rule.Id)
+			log.Printf("Mute rule %d (%s) expired after muting %d notification(s)", rule.Id, describeMute(rule), rule.MutedCount)
+			if rule.Action != pb.MuteRule_HOLD_AND_SUMMARIZE || rule.MutedCount == 0 {
+				continue
+			}
+			ns.mu.RLock()
+			localizer := ns.localizer
+			ns.mu.RUnlock()
+			seq, _, err := ns.enqueue(&pb.SendNotificationRequest{
+				Notification: &pb.Notification{
+					Title: localizer.format(msgMuteSummaryTitle, nil),
+					Text:  localizer.format(msgMuteSummaryText, muteSummary{rule.MutedCount, rule.TitlePrefix, rule.TitleRegex}),
+				},
+			})
+			if err != nil {
+				log.Printf("Error while sending mute summary: %v", err)
+				continue
+			}
+			ns.dispatch(seq)
+		}
+	}
+}
+
+func muteExpired(rule *pb.MuteRule, now time.Time) bool {
+	expireTime, err := ptypes.Timestamp(rule.ExpireTime)
+	return err != nil || !now.Before(expireTime)
+}
+
+// muteRegexp returns the compiled title regex of the given rule, or nil if it
+// has none or its regex is invalid. Each rule's regex is compiled once, when
+// the rule is added or first loaded from state.
+func (ns *notificationService) muteRegexp(rule *pb.MuteRule) *regexp.Regexp {
+	if rule.TitleRegex == "" {
+		return nil
+	}
+	if re, ok := ns.muteRegexps.Load(rule.Id); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(rule.TitleRegex)
+	if err != nil {
+		// AddMute rejects bad regexes, so this can only be a corrupt rule.
+		log.Printf("Warning: mute rule %d has bad title_regex: %v", rule.Id, err)
+		return nil
+	}
+	ns.muteRegexps.Store(rule.Id, re)
+	return re
+}
+
+// muteMatches returns true if the given notification matches the given rule,
+// whose compiled title regex (if any) is titleRegexp.
+func muteMatches(rule *pb.MuteRule, titleRegexp *regexp.Regexp, n *pb.Notification) bool {
+	if rule.TitlePrefix != "" && !strings.HasPrefix(n.Title, rule.TitlePrefix) {
+		return false
+	}
+	if rule.TitleRegex != "" && (titleRegexp == nil || !titleRegexp.MatchString(n.Title)) {
+		return false
+	}
+	return true
+}
+
+// describeMute returns a human-readable description of a mute rule's matchers.
+func describeMute(rule *pb.MuteRule) string {
+	var matchers []string
+	if rule.TitlePrefix != "" {
+		matchers = append(matchers, fmt.Sprintf("title prefix %q", rule.TitlePrefix))
+	}
+	if rule.TitleRegex != "" {
+		matchers = append(matchers, fmt.Sprintf("title regex %q", rule.TitleRegex))
+	}
+	return strings.Join(matchers, " and ")
+}
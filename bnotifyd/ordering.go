@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// nextChannelCounter allocates the next ordering counter for the given
+// channel. Counters are stored in the channel_counters bucket, so they are
+// allocated in the same transaction as the message itself: a message which
+// fails to enqueue does not use up a counter value.
+func nextChannelCounter(tx *bolt.Tx, channel string) (uint64, error) {
+	countersBucket := tx.Bucket([]byte("channel_counters"))
+	if countersBucket == nil {
+		return 0, errors.New("missing channel_counters bucket")
+	}
+	// Bolt keys may not be empty, so the key is prefixed.
+	key := []byte("channel:" + channel)
+	var counter uint64
+	if v := countersBucket.Get(key); v != nil {
+		counter = binary.BigEndian.Uint64(v)
+	}
+	counter++
+	if err := countersBucket.Put(key, seqKey(counter)); err != nil {
+		return 0, fmt.Errorf("could not write channel counter: %v", err)
+	}
+	return counter, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"go.uber.org/goleak"
+
+	pb "../proto"
+)
+
+// channelRequest returns a request for a notification in the given channel.
+func channelRequest(channel string, i int) *pb.SendNotificationRequest {
+	req := testRequest(fmt.Sprintf("%s %d", channel, i))
+	req.Notification.Category = channel
+	return req
+}
+
+// checkChannelCounters checks that, for each channel, the counters of the
+// pending messages in ns's state file increase with sequence number, without
+// gaps, from 1 to the given count.
+func checkChannelCounters(t *testing.T, ns *notificationService, want map[string]int) {
+	gcmCipher := ns.creds().gcmCipher
+	var seqs []uint64
+	pending := pendingPayloads(t, ns)
+	for seq := range pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	counters := map[string]uint64{} // channel → last counter seen
+	for _, seq := range seqs {
+		_, message := openTestPayload(t, gcmCipher, pending[seq].Payload)
+		ordering := message.Ordering
+		if ordering == nil {
+			t.Errorf("Message %d has no ordering token", seq)
+			continue
+		}
+		if ordering.Channel != message.Notification.Category {
+			t.Errorf("Message %d has channel %q, want %q", seq, ordering.Channel, message.Notification.Category)
+		}
+		if last := counters[ordering.Channel]; ordering.Counter != last+1 {
+			t.Errorf("Message %d in channel %q has counter %d, want %d", seq, ordering.Channel, ordering.Counter, last+1)
+		}
+		counters[ordering.Channel] = ordering.Counter
+	}
+	for channel, n := range want {
+		if counters[channel] != uint64(n) {
+			t.Errorf("Channel %q reached counter %d, want %d", channel, counters[channel], n)
+		}
+	}
+}
+
+func TestChannelCountersConcurrent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	settings := testSettings()
+	statePath, removeState := testStatePath(t)
+	defer removeState()
+	db, _ := openTestState(t, statePath, settings)
+	ns := newTestServiceForDB(t, db, settings, "")
+
+	// Enqueue to several channels at once, singly & in groups (which
+	// allocate several counters in one transaction).
+	channels := []string{"", "alerts", "backups", "builds"}
+	const perChannel = 30
+	enqueueAll := func() {
+		var wg sync.WaitGroup
+		for _, channel := range channels {
+			wg.Add(2)
+			go func(channel string) {
+				defer wg.Done()
+				for i := 0; i < perChannel; i++ {
+					if _, _, err := ns.enqueue(channelRequest(channel, i)); err != nil {
+						t.Errorf("Could not enqueue message: %v", err)
+						return
+					}
+				}
+			}(channel)
+			go func(channel string) {
+				defer wg.Done()
+				for i := 0; i < perChannel; i += 3 {
+					reqs := []*pb.SendNotificationRequest{channelRequest(channel, i), channelRequest(channel, i+1), channelRequest(channel, i+2)}
+					if _, _, err := ns.enqueueGroup(reqs); err != nil {
+						t.Errorf("Could not enqueue group: %v", err)
+						return
+					}
+				}
+			}(channel)
+		}
+		wg.Wait()
+	}
+	enqueueAll()
+	want := map[string]int{}
+	for _, channel := range channels {
+		want[channel] = 2 * perChannel
+	}
+	checkChannelCounters(t, ns, want)
+
+	// Counters continue where they left off after a restart.
+	db.Close()
+	db, _ = openTestState(t, statePath, settings)
+	defer db.Close()
+	ns = newTestServiceForDB(t, db, settings, "")
+	enqueueAll()
+	for _, channel := range channels {
+		want[channel] = 4 * perChannel
+	}
+	checkChannelCounters(t, ns, want)
+}
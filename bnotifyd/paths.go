@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolvePaths determines the settings & state filenames to use. Filenames
+// not specified by flag default to XDG-compliant locations. The returned
+// paths are absolute.
+func resolvePaths() (settingsPath, statePath string, _ error) {
+	settingsPath, statePath = *settingsFilename, *stateFilename
+	if settingsPath == "" {
+		dir, err := xdgDir("XDG_CONFIG_HOME", ".config")
+		if err != nil {
+			return "", "", err
+		}
+		settingsPath = filepath.Join(dir, "bnotify", "settings.conf")
+	}
+	if statePath == "" {
+		dir, err := xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+		if err != nil {
+			return "", "", err
+		}
+		statePath = filepath.Join(dir, "bnotify", "state.db")
+	}
+
+	settingsPath, err := filepath.Abs(settingsPath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not resolve settings path: %v", err)
+	}
+	statePath, err = filepath.Abs(statePath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not resolve state path: %v", err)
+	}
+	return settingsPath, statePath, nil
+}
+
+// xdgDir returns the value of the given XDG environment variable, or the given
+// default directory (relative to the user's home directory) if it is unset.
+func xdgDir(envVar, homeRelativeDefault string) (string, error) {
+	if dir := os.Getenv(envVar); dir != "" {
+		return dir, nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", fmt.Errorf("neither $%s nor $HOME is set", envVar)
+	}
+	return filepath.Join(home, homeRelativeDefault), nil
+}
+
+// prepareStateDir creates the parent directory of the state file if needed,
+// and verifies that the state file can be written.
+func prepareStateDir(statePath string) error {
+	dir := filepath.Dir(statePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create state directory: %v", err)
+	}
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		if err == unix.EROFS {
+			return fmt.Errorf("state directory %q is on a read-only filesystem", dir)
+		}
+		return fmt.Errorf("state directory %q is not writable: %v", dir, err)
+	}
+	if err := unix.Access(statePath, unix.W_OK); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("state file %q is not writable: %v", statePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// streamBatchSize is the number of entries read per transaction by streaming
+// RPCs. Entries are read in batches & the transaction is closed before any are
+// sent, so that a slow client neither holds a transaction open nor causes
+// the whole bucket to be read into memory.
+const streamBatchSize = 100
+
+func (ns *notificationService) ListPendingNotifications(req *pb.ListPendingRequest, stream pb.NotificationService_ListPendingNotificationsServer) error {
+	cursor := req.AfterSeq
+	for cursor < math.MaxUint64 {
+		pending, err := ns.pendingNotifications(cursor+1, streamBatchSize)
+		if err != nil {
+			log.Printf("Error while listing pending notifications: %v", err)
+			return status.Error(codes.Internal, "internal error")
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, p := range pending {
+			cursor = p.Seq
+			if err := stream.Send(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pendingNotifications returns up to n pending notifications with sequence
+// numbers of at least startSeq, in sequence order.
+func (ns *notificationService) pendingNotifications(startSeq uint64, n int) ([]*pb.PendingNotification, error) {
+	var pending []*pb.PendingNotification
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		c := messagesBucket.Cursor()
+		for k, v := c.Seek(seqKey(startSeq)); k != nil && len(pending) < n; k, v = c.Next() {
+			seq := binary.BigEndian.Uint64(k)
+			pendingPayload := &pb.PendingPayload{}
+			if err := proto.Unmarshal(v, pendingPayload); err != nil {
+				return fmt.Errorf("could not unmarshal pending payload %d: %v", seq, err)
+			}
+			p := &pb.PendingNotification{
+				Seq:            seq,
+				NotificationId: pendingPayload.NotificationId,
+				EnqueueTime:    pendingPayload.EnqueueTime,
+				SendAttempts:   pendingPayload.SendAttempts,
+				PayloadSize:    int32(payloadSize(pendingPayload.Payload)),
+				LastError:      pendingPayload.LastError,
+				LastErrorTime:  pendingPayload.LastErrorTime,
+			}
+			if message, err := ns.openPayload(pendingPayload.Payload); err != nil {
+				log.Printf("Warning: could not decrypt pending payload %d: %v", seq, err)
+			} else {
+				p.Title = message.GetNotification().GetTitle()
+			}
+			pending = append(pending, p)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (ns *notificationService) GetPendingNotification(ctx context.Context, req *pb.GetPendingRequest) (*pb.GetPendingResponse, error) {
+	if req.Seq == 0 {
+		return nil, status.Error(codes.InvalidArgument, "seq is required")
+	}
+	var pendingPayload *pb.PendingPayload
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		ppBytes := messagesBucket.Get(seqKey(req.Seq))
+		if ppBytes == nil {
+			return nil
+		}
+		pendingPayload = &pb.PendingPayload{}
+		if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
+			return fmt.Errorf("could not unmarshal pending payload %d: %v", req.Seq, err)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Error while getting pending notification: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if pendingPayload == nil {
+		return nil, status.Errorf(codes.NotFound, "no pending notification with seq %d", req.Seq)
+	}
+
+	message, err := ns.openPayload(pendingPayload.Payload)
+	if err != nil {
+		log.Printf("Error while decrypting pending payload %d: %v", req.Seq, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	nextRetryTime, err := scheduledAttemptTime(pendingPayload, ns.now())
+	if err != nil {
+		log.Printf("Error while computing next retry time for pending payload %d: %v", req.Seq, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return &pb.GetPendingResponse{
+		Notification:  message.Notification,
+		SendAttempts:  pendingPayload.SendAttempts,
+		EnqueueTime:   pendingPayload.EnqueueTime,
+		NextRetryTime: nextRetryTime,
+		LastError:     pendingPayload.LastError,
+		LastErrorTime: pendingPayload.LastErrorTime,
+	}, nil
+}
+
+// scheduledAttemptTime determines when the most recently scheduled attempt to
+// send the given payload will be made, from the backoff schedule. The wait
+// before an attempt is determined by the number of attempts made before it, &
+// begins once the attempt is recorded. (If the returned time has passed, the
+// attempt is in progress.) It returns nil if the time cannot be determined.
+//
+// The wait is measured on a monotonic clock, so a wall clock which has since
+// jumped backwards can make the recorded start appear to be in the future;
+// such a start is clamped to now, so that the attempt is reported no more
+// than its wait away rather than hours off.
+func scheduledAttemptTime(pendingPayload *pb.PendingPayload, now time.Time) (*timestamp.Timestamp, error) {
+	attempts := int(pendingPayload.SendAttempts)
+	start := pendingPayload.EnqueueTime
+	if attempts > 0 {
+		attempts--
+		start = pendingPayload.LastAttemptTime
+	}
+	if start == nil {
+		// Payloads written by older versions do not record attempt times.
+		return nil, nil
+	}
+	decision := scheduleRetry(attempts, 0)
+	if decision.giveUp {
+		return nil, nil
+	}
+	startTime, err := ptypes.Timestamp(start)
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp: %v", err)
+	}
+	if startTime.After(now) {
+		startTime = now
+	}
+	return ptypes.TimestampProto(startTime.Add(decision.wait))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/ptypes"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+
+	pb "../proto"
+)
+
+// fillPending adds n small pending messages to ns's state file directly, in
+// a few large transactions (much faster than enqueueing each).
+func fillPending(t *testing.T, ns *notificationService, n int) {
+	enqueueTime, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		t.Fatalf("Could not convert time: %v", err)
+	}
+	gcmCipher := ns.creds().gcmCipher
+	const perTx = 10000
+	for i := 0; i < n; i += perTx {
+		if err := ns.db.Update(func(tx *bolt.Tx) error {
+			serverID, err := txServerID(tx)
+			if err != nil {
+				return err
+			}
+			for j := i; j < i+perTx && j < n; j++ {
+				if _, _, err := putMessage(tx, serverID, gcmCipher, testRequest(fmt.Sprintf("message %d", j)), enqueueTime, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("Could not add pending messages: %v", err)
+		}
+	}
+}
+
+// listPendingStream receives the notifications streamed by
+// ListPendingNotifications, calling send for each.
+type listPendingStream struct {
+	grpc.ServerStream
+	send func(*pb.PendingNotification) error
+}
+
+func (s listPendingStream) Send(p *pb.PendingNotification) error { return s.send(p) }
+
+func TestListPendingNotificationsLargeQueue(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	if testing.Short() {
+		t.Skip("skipping large queue test in short mode")
+	}
+	const (
+		count = 100000
+
+		// maxHeapGrowth bounds the live heap while listing. Holding every
+		// listed notification would take many times this.
+		maxHeapGrowth = 8 << 20
+
+		// maxEnqueueLatency bounds each concurrent enqueue, allowing for
+		// bolt's batch delay (10ms by default).
+		maxEnqueueLatency = 50 * time.Millisecond
+	)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	ns.db.NoSync = true // measure contention with listing, not the disk
+	fillPending(t, ns, count)
+
+	// Enqueue concurrently with listing, timing each enqueue.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var maxLatency time.Duration
+	var enqueued int
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			start := time.Now()
+			if _, _, err := ns.enqueue(testRequest("concurrent")); err != nil {
+				t.Errorf("Could not enqueue message: %v", err)
+				return
+			}
+			if latency := time.Since(start); latency > maxLatency {
+				maxLatency = latency
+			}
+			enqueued++
+		}
+	}()
+
+	var before, during runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var maxHeap uint64
+	var listed int
+	var lastSeq uint64
+	err := ns.ListPendingNotifications(&pb.ListPendingRequest{}, listPendingStream{send: func(p *pb.PendingNotification) error {
+		if p.Seq <= lastSeq {
+			t.Errorf("Listed seq %d after %d", p.Seq, lastSeq)
+		}
+		lastSeq = p.Seq
+		listed++
+		if listed%10000 == 0 {
+			runtime.GC()
+			runtime.ReadMemStats(&during)
+			if during.HeapAlloc > maxHeap {
+				maxHeap = during.HeapAlloc
+			}
+		}
+		return nil
+	}})
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("ListPendingNotifications: %v", err)
+	}
+
+	if listed < count {
+		t.Errorf("Listed %d notifications, want at least %d", listed, count)
+	}
+	if maxHeap > before.HeapAlloc && maxHeap-before.HeapAlloc > maxHeapGrowth {
+		t.Errorf("Heap grew by %d bytes while listing, want at most %d", maxHeap-before.HeapAlloc, maxHeapGrowth)
+	}
+	if enqueued == 0 {
+		t.Errorf("No notifications were enqueued while listing")
+	}
+	if maxLatency > maxEnqueueLatency {
+		t.Errorf("Enqueue took up to %v while listing, want at most %v", maxLatency, maxEnqueueLatency)
+	}
+}
+
+func TestScheduledAttemptTimeAfterClockJump(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	now := time.Date(2017, 1, 1, 3, 26, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc        string
+		lastAttempt time.Time
+		want        time.Time
+	}{
+		{"no jump", now.Add(-time.Second), now},
+		// The attempt was recorded before the clock jumped back an hour; the
+		// attempt is still only its wait away.
+		{"backward jump", now.Add(time.Hour), now.Add(time.Second)},
+		// The clock jumped forward since the attempt was recorded, so the
+		// next attempt appears overdue (i.e. in progress).
+		{"forward jump", now.Add(-time.Hour), now.Add(-time.Hour + time.Second)},
+	} {
+		lastAttemptTime, err := ptypes.TimestampProto(test.lastAttempt)
+		if err != nil {
+			t.Fatalf("Could not convert time: %v", err)
+		}
+		// After two attempts, the next waits waits[1] = 1s from the last.
+		ts, err := scheduledAttemptTime(&pb.PendingPayload{SendAttempts: 2, LastAttemptTime: lastAttemptTime}, now)
+		if err != nil {
+			t.Errorf("%s: scheduledAttemptTime: %v", test.desc, err)
+			continue
+		}
+		got, err := ptypes.Timestamp(ts)
+		if err != nil {
+			t.Errorf("%s: bad timestamp: %v", test.desc, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%s: scheduledAttemptTime = %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
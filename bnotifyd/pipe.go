@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "../proto"
+)
+
+const (
+	// pipeBatchWindow is how long --pipe mode waits for further lines after
+	// the first line of a batch before sending the batch as one notification.
+	pipeBatchWindow = 100 * time.Millisecond
+
+	// pipeMaxBatchBytes is the maximum text size of a --pipe mode batch; a
+	// batch is sent early if it would exceed this size, to keep payloads
+	// well under the FCM size limit.
+	pipeMaxBatchBytes = 2048
+
+	// pipeRPCTimeout is how long --pipe mode waits for each SendNotification RPC.
+	pipeRPCTimeout = 10 * time.Second
+)
+
+// pipe reads lines from stdin, sending them as notifications via the
+// bnotifyd instance listening on --port. Lines arriving within
+// pipeBatchWindow of each other are sent together.
+func pipe() {
+	if *pipeTitle == "" {
+		log.Fatalf("--title is required with --pipe")
+	}
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", *port), grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Error connecting to bnotifyd: %v", err)
+	}
+	defer conn.Close()
+	ns := pb.NewNotificationServiceClient(conn)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("Error reading stdin: %v", err)
+		}
+	}()
+
+	var batch []string
+	var batchBytes int
+	var timer <-chan time.Time
+	flush := func() {
+		if len(batch) > 0 {
+			sendPipeBatch(ns, batch)
+		}
+		batch, batchBytes, timer = nil, 0, nil
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if batchBytes+len(line) > pipeMaxBatchBytes {
+				flush()
+			}
+			if len(batch) == 0 {
+				timer = time.After(pipeBatchWindow)
+			}
+			batch = append(batch, line)
+			batchBytes += len(line) + 1
+		case <-timer:
+			flush()
+		}
+	}
+}
+
+func sendPipeBatch(ns pb.NotificationServiceClient, batch []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), pipeRPCTimeout)
+	defer cancel()
+	_, err := ns.SendNotification(ctx, &pb.SendNotificationRequest{
+		Notification: &pb.Notification{
+			Title: *pipeTitle,
+			Text:  strings.Join(batch, "\n"),
+		},
+	}, grpc.WaitForReady(true))
+	if err != nil {
+		log.Printf("Error sending %d line(s): %v", len(batch), err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	pb "../proto"
+)
+
+// lowPriorityPollInterval is how often a held LOW priority message checks
+// whether the queue has drained enough for it to be sent.
+const lowPriorityPollInterval = time.Second
+
+// priorityRank returns the rank of the given priority; messages of lower rank
+// are sent first.
+func priorityRank(p pb.Priority) int {
+	switch p {
+	case pb.Priority_CRITICAL:
+		return 0
+	case pb.Priority_HIGH:
+		return 1
+	case pb.Priority_LOW:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// rateQueue hands out sends allowed by a rate limiter in priority order,
+// rather than in the order senders began waiting. CRITICAL messages bypass
+// the rate limit entirely.
+type rateQueue struct {
+	limiter *rate.Limiter
+	wake    chan struct{} // signalled when a waiter is added
+
+	mu      sync.Mutex // protects waiters & next
+	waiters waiterHeap
+	next    uint64 // arrival order of the next waiter
+}
+
+type waiter struct {
+	rank  int
+	order uint64        // arrival order, so that equal ranks are served FIFO
+	ready chan struct{} // closed when the waiter may send
+}
+
+// waiterHeap is a heap.Interface of waiters, ordered by rank then arrival.
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].order < h[j].order
+}
+func (h waiterHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *waiterHeap) Push(x interface{}) { *h = append(*h, x.(*waiter)) }
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
+
+func newRateQueue(limiter *rate.Limiter) *rateQueue {
+	q := &rateQueue{
+		limiter: limiter,
+		wake:    make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+// wait blocks until a message of the given priority may be sent.
+func (q *rateQueue) wait(p pb.Priority) {
+	if p == pb.Priority_CRITICAL {
+		return
+	}
+	w := &waiter{rank: priorityRank(p), ready: make(chan struct{})}
+	q.mu.Lock()
+	w.order = q.next
+	q.next++
+	heap.Push(&q.waiters, w)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	<-w.ready
+}
+
+// run grants each token from the rate limiter to the highest-priority waiter
+// at the time the token becomes available.
+func (q *rateQueue) run() {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			n := q.waiters.Len()
+			q.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			if !q.limiter.Allow() {
+				debugf("Delaying send due to rate limit")
+				// The limiter has no deadline, so Wait cannot fail.
+				q.limiter.Wait(context.Background())
+			}
+			q.mu.Lock()
+			w := heap.Pop(&q.waiters).(*waiter)
+			q.mu.Unlock()
+			close(w.ready)
+		}
+	}
+}
+
+// holdLowPriority delays sending a LOW priority message while more than
+// low_priority_hold_threshold other messages are being sent (not counting
+// LOW priority messages which are themselves held), warning if the
+// message has waited longer than low_priority_warn_seconds since it was
+// enqueued. It returns false if the service began draining while waiting.
+func (ns *notificationService) holdLowPriority(pendingPayload *pb.PendingPayload) bool {
+	if pendingPayload.Priority != pb.Priority_LOW {
+		return true
+	}
+	enqueueTime, err := ptypes.Timestamp(pendingPayload.EnqueueTime)
+	if err != nil {
+		enqueueTime = time.Now()
+	}
+	atomic.AddInt64(&ns.heldSenders, 1)
+	defer atomic.AddInt64(&ns.heldSenders, -1)
+	warned := false
+	for {
+		if wait := time.Since(enqueueTime); ns.lowPriorityWarn > 0 && wait > ns.lowPriorityWarn && !warned {
+			log.Printf("Warning: [%s] LOW priority notification has waited %v to be sent", pendingPayload.NotificationId, wait.Round(time.Second))
+			warned = true
+		}
+		// Held messages (including this one) are not counted, or once more
+		// than the threshold were held, none would ever be released.
+		if ns.lowPriorityHold <= 0 || atomic.LoadInt64(&ns.activeSenders)-atomic.LoadInt64(&ns.heldSenders) <= ns.lowPriorityHold {
+			return true
+		}
+		select {
+		case <-time.After(lowPriorityPollInterval):
+		case <-ns.stopping:
+			return false
+		}
+	}
+}
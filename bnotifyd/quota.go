@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	pb "../proto"
+)
+
+const (
+	// quotaKey is the key of the quota tracker's state in the rate_limiters bucket.
+	quotaKey = "quota"
+
+	// quotaSaveInterval is how often quota state is persisted & quota
+	// metrics are updated. Requests made since the last save are lost on a
+	// crash, so counts are approximate.
+	quotaSaveInterval = time.Minute
+
+	// quotaMinutes is the number of minutes of requests counted.
+	quotaMinutes = 24 * 60
+
+	// defaultQuotaWarnFraction is the quota_warn_fraction used if it is unset.
+	defaultQuotaWarnFraction = 0.8
+)
+
+// quotaWindows are the windows over which requests are counted.
+var quotaWindows = []struct {
+	name    string
+	minutes int64
+	limit   func(*pb.QuotaLimits) int64
+}{
+	{"minute", 1, (*pb.QuotaLimits).GetPerMinute},
+	{"hour", 60, (*pb.QuotaLimits).GetPerHour},
+	{"day", quotaMinutes, (*pb.QuotaLimits).GetPerDay},
+}
+
+// minuteCounter counts requests in each of the last quotaMinutes minutes.
+type minuteCounter struct {
+	minutes [quotaMinutes]int64 // minute (since the epoch) counted in each slot
+	counts  [quotaMinutes]int64
+}
+
+func (c *minuteCounter) add(minute, n int64) {
+	i := minute % quotaMinutes
+	if c.minutes[i] != minute {
+		c.minutes[i], c.counts[i] = minute, 0
+	}
+	c.counts[i] += n
+}
+
+// sum returns the number of requests counted in the given number of minutes
+// up to & including minute.
+func (c *minuteCounter) sum(minute, window int64) int64 {
+	var n int64
+	for i, m := range c.minutes {
+		if age := minute - m; age >= 0 && age < window {
+			n += c.counts[i]
+		}
+	}
+	return n
+}
+
+func (c *minuteCounter) marshal() *pb.QuotaState_Counter {
+	counter := &pb.QuotaState_Counter{}
+	for i, m := range c.minutes {
+		if c.counts[i] > 0 {
+			counter.Minutes = append(counter.Minutes, m)
+			counter.Counts = append(counter.Counts, c.counts[i])
+		}
+	}
+	return counter
+}
+
+func (c *minuteCounter) unmarshal(counter *pb.QuotaState_Counter) {
+	for i, m := range counter.GetMinutes() {
+		if i < len(counter.Counts) {
+			c.add(m, counter.Counts[i])
+		}
+	}
+}
+
+// quotaExceeded describes a quota limit whose warning threshold was crossed.
+type quotaExceeded struct {
+	Scope  string
+	Window string
+	Count  int64
+	Limit  int64
+}
+
+// quotaTracker counts requests made to FCM, project-wide & for the current
+// device, so that usage can be compared against FCM's limits.
+type quotaTracker struct {
+	limits       map[string]*pb.QuotaLimits // by scope
+	warnFraction float64
+
+	mu             sync.Mutex // protects all fields below
+	project        minuteCounter
+	device         minuteCounter
+	registrationID string          // registration ID whose requests are counted in device
+	throttledUntil time.Time       // if FCM has throttled requests, when it asked for them to resume
+	warned         map[string]bool // "scope/window" pairs whose warning threshold is crossed
+}
+
+func newQuotaTracker(settings *pb.BNotifySettings) *quotaTracker {
+	warnFraction := settings.QuotaWarnFraction
+	if warnFraction <= 0 {
+		warnFraction = defaultQuotaWarnFraction
+	}
+	return &quotaTracker{
+		limits: map[string]*pb.QuotaLimits{
+			"project": settings.ProjectQuota,
+			"device":  settings.DeviceQuota,
+		},
+		warnFraction: warnFraction,
+		warned:       map[string]bool{},
+	}
+}
+
+// record counts a request to the given registration ID, returning any limits
+// whose warning threshold the request crossed.
+func (qt *quotaTracker) record(registrationID string) []quotaExceeded {
+	minute := time.Now().Unix() / 60
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	if registrationID != qt.registrationID {
+		qt.device = minuteCounter{}
+		qt.registrationID = registrationID
+	}
+	qt.project.add(minute, 1)
+	qt.device.add(minute, 1)
+
+	var exceeded []quotaExceeded
+	for scope, counter := range map[string]*minuteCounter{"project": &qt.project, "device": &qt.device} {
+		for _, w := range quotaWindows {
+			limit := w.limit(qt.limits[scope])
+			if limit <= 0 {
+				continue
+			}
+			key := scope + "/" + w.name
+			count := counter.sum(minute, w.minutes)
+			crossed := float64(count) >= qt.warnFraction*float64(limit)
+			if crossed && !qt.warned[key] {
+				exceeded = append(exceeded, quotaExceeded{scope, w.name, count, limit})
+			}
+			qt.warned[key] = crossed
+		}
+	}
+	return exceeded
+}
+
+// throttled records that FCM throttled a request, asking that requests not
+// resume for retryAfter (which may be zero, if FCM did not say).
+func (qt *quotaTracker) throttled(retryAfter time.Duration) {
+	until := time.Now().Add(retryAfter)
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	if until.After(qt.throttledUntil) {
+		qt.throttledUntil = until
+	}
+}
+
+// status fills in the quota fields of resp.
+func (qt *quotaTracker) status(resp *pb.GetStatusResponse) {
+	minute := time.Now().Unix() / 60
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	for _, s := range []struct {
+		scope   string
+		counter *minuteCounter
+	}{{"project", &qt.project}, {"device", &qt.device}} {
+		resp.QuotaUsage = append(resp.QuotaUsage, &pb.GetStatusResponse_QuotaUsage{
+			Scope:      s.scope,
+			LastMinute: s.counter.sum(minute, 1),
+			LastHour:   s.counter.sum(minute, 60),
+			LastDay:    s.counter.sum(minute, quotaMinutes),
+			Limits:     qt.limits[s.scope],
+		})
+	}
+	if time.Now().Before(qt.throttledUntil) {
+		resp.ThrottledUntil, _ = ptypes.TimestampProto(qt.throttledUntil)
+	}
+}
+
+// updateMetrics sets the quota metrics to the current counts.
+func (qt *quotaTracker) updateMetrics() {
+	resp := &pb.GetStatusResponse{}
+	qt.status(resp)
+	for _, u := range resp.QuotaUsage {
+		fcmRequests.WithLabelValues(u.Scope, "minute").Set(float64(u.LastMinute))
+		fcmRequests.WithLabelValues(u.Scope, "hour").Set(float64(u.LastHour))
+		fcmRequests.WithLabelValues(u.Scope, "day").Set(float64(u.LastDay))
+	}
+}
+
+// save persists the tracker's counts.
+func (qt *quotaTracker) save(db *bolt.DB) error {
+	qt.mu.Lock()
+	state := &pb.QuotaState{
+		Project:        qt.project.marshal(),
+		Device:         qt.device.marshal(),
+		RegistrationId: qt.registrationID,
+	}
+	throttledUntil := qt.throttledUntil
+	qt.mu.Unlock()
+	if !throttledUntil.IsZero() {
+		ts, err := ptypes.TimestampProto(throttledUntil)
+		if err != nil {
+			return err
+		}
+		state.ThrottledUntil = ts
+	}
+	stateBytes, err := proto.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not marshal quota state: %v", err)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		limitersBucket := tx.Bucket([]byte("rate_limiters"))
+		if limitersBucket == nil {
+			return errors.New("missing rate_limiters bucket")
+		}
+		return limitersBucket.Put([]byte(quotaKey), stateBytes)
+	})
+}
+
+// restore restores persisted counts, if any, to the (freshly-created) tracker.
+func (qt *quotaTracker) restore(db *bolt.DB) error {
+	state := &pb.QuotaState{}
+	if err := db.View(func(tx *bolt.Tx) error {
+		limitersBucket := tx.Bucket([]byte("rate_limiters"))
+		if limitersBucket == nil {
+			return errors.New("missing rate_limiters bucket")
+		}
+		if stateBytes := limitersBucket.Get([]byte(quotaKey)); stateBytes != nil {
+			return proto.Unmarshal(stateBytes, state)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	qt.project.unmarshal(state.Project)
+	qt.device.unmarshal(state.Device)
+	qt.registrationID = state.RegistrationId
+	if state.ThrottledUntil != nil {
+		if t, err := ptypes.Timestamp(state.ThrottledUntil); err == nil {
+			qt.throttledUntil = t
+		}
+	}
+	return nil
+}
+
+func saveQuotaStatePeriodically(db *bolt.DB, qt *quotaTracker) {
+	for range time.Tick(quotaSaveInterval) {
+		qt.updateMetrics()
+		if err := qt.save(db); err != nil {
+			log.Printf("Error saving quota state: %v", err)
+		}
+	}
+}
+
+// recordFCMRequest counts a request to FCM for the given registration ID,
+// warning if this brings usage close to a known limit.
+func (ns *notificationService) recordFCMRequest(registrationID string) {
+	for _, e := range ns.quota.record(registrationID) {
+		log.Printf("Warning: made %d of at most %d FCM requests allowed per %s (%s)", e.Count, e.Limit, e.Window, e.Scope)
+		if ns.quotaWarnNotify {
+			// Sending may block waiting for an in-flight slot, which the
+			// caller may be holding.
+			go ns.sendQuotaWarning(e)
+		}
+	}
+}
+
+// sendQuotaWarning sends a notification warning that the given quota limit is close.
+func (ns *notificationService) sendQuotaWarning(e quotaExceeded) {
+	ns.mu.RLock()
+	localizer := ns.localizer
+	ns.mu.RUnlock()
+	seq, _, err := ns.enqueue(&pb.SendNotificationRequest{
+		Notification: &pb.Notification{
+			Title: localizer.format(msgQuotaWarningTitle, nil),
+			Text:  localizer.format(msgQuotaWarningText, e),
+		},
+	})
+	if err != nil {
+		log.Printf("Error while sending quota warning: %v", err)
+		return
+	}
+	ns.dispatch(seq)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/time/rate"
+
+	pb "../proto"
+)
+
+const (
+	// fcmLimiterKey is the key of the FCM rate limiter's state in the rate_limiters bucket.
+	fcmLimiterKey = "fcm"
+
+	// limiterSaveInterval is how often rate limiter state is persisted.
+	limiterSaveInterval = 10 * time.Second
+)
+
+// saveLimiterState persists the state of the given rate limiter as of now.
+func saveLimiterState(db *bolt.DB, limiter *rate.Limiter, now time.Time) error {
+	ts, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return err
+	}
+	stateBytes, err := proto.Marshal(&pb.RateLimiterState{
+		Tokens: limiter.TokensAt(now),
+		Time:   ts,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal rate limiter state: %v", err)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		limitersBucket := tx.Bucket([]byte("rate_limiters"))
+		if limitersBucket == nil {
+			return errors.New("missing rate_limiters bucket")
+		}
+		return limitersBucket.Put([]byte(fcmLimiterKey), stateBytes)
+	})
+}
+
+func saveLimiterStatePeriodically(db *bolt.DB, limiter *rate.Limiter) {
+	for now := range time.Tick(limiterSaveInterval) {
+		if err := saveLimiterState(db, limiter, now); err != nil {
+			log.Printf("Error saving rate limiter state: %v", err)
+		}
+	}
+}
+
+// restoreLimiterState restores persisted state, if any, to the given
+// (freshly-created) rate limiter as of now. Tokens accrued since the state was saved
+// are credited, but the restored allowance never exceeds the limiter's
+// burst, and a saved time in the future (e.g. due to the clock moving
+// backwards) accrues nothing.
+func restoreLimiterState(db *bolt.DB, limiter *rate.Limiter, now time.Time) error {
+	state := &pb.RateLimiterState{}
+	found := false
+	if err := db.View(func(tx *bolt.Tx) error {
+		limitersBucket := tx.Bucket([]byte("rate_limiters"))
+		if limitersBucket == nil {
+			return errors.New("missing rate_limiters bucket")
+		}
+		stateBytes := limitersBucket.Get([]byte(fcmLimiterKey))
+		if stateBytes == nil {
+			return nil
+		}
+		found = true
+		return proto.Unmarshal(stateBytes, state)
+	}); err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+
+	tokens := state.Tokens
+	if savedAt, err := ptypes.Timestamp(state.Time); err == nil && savedAt.Before(now) {
+		tokens += now.Sub(savedAt).Seconds() * float64(limiter.Limit())
+	}
+	tokens = math.Max(0, math.Min(tokens, float64(limiter.Burst())))
+	if used := limiter.Burst() - int(tokens); used > 0 {
+		limiter.AllowN(now, used)
+	}
+	log.Printf("Restored FCM rate limiter state (%.1f tokens available)", tokens)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"go.uber.org/goleak"
+	"golang.org/x/time/rate"
+)
+
+const (
+	testLimit = 5 // sends per second
+	testBurst = 5
+)
+
+// limiterStorm attempts a send every 10ms of fake time in [start, end),
+// returning the number allowed by limiter.
+func limiterStorm(limiter *rate.Limiter, start, end time.Time) int {
+	allowed := 0
+	for now := start; now.Before(end); now = now.Add(10 * time.Millisecond) {
+		if limiter.AllowN(now, 1) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+// restartLimiter saves limiter's state at stop, then returns a new limiter
+// with that state restored at start, as a restart of bnotifyd would.
+func restartLimiter(t *testing.T, db *bolt.DB, limiter *rate.Limiter, stop, start time.Time) *rate.Limiter {
+	if err := saveLimiterState(db, limiter, stop); err != nil {
+		t.Fatalf("Could not save rate limiter state: %v", err)
+	}
+	limiter = rate.NewLimiter(testLimit, testBurst)
+	if err := restoreLimiterState(db, limiter, start); err != nil {
+		t.Fatalf("Could not restore rate limiter state: %v", err)
+	}
+	return limiter
+}
+
+func TestLimiterRestartMidStorm(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	statePath, removeState := testStatePath(t)
+	defer removeState()
+	db, _ := openTestState(t, statePath, testSettings())
+	defer db.Close()
+
+	// Storm for a second, restart with 100ms of downtime, then storm for
+	// another two seconds. The restart must not grant a fresh burst.
+	t0 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	stop, start, end := t0.Add(time.Second), t0.Add(1100*time.Millisecond), t0.Add(3*time.Second)
+	limiter := rate.NewLimiter(testLimit, testBurst)
+	allowed := limiterStorm(limiter, t0, stop)
+	limiter = restartLimiter(t, db, limiter, stop, start)
+	allowed += limiterStorm(limiter, start, end)
+
+	if max := testBurst + int(end.Sub(t0).Seconds()*testLimit); allowed > max {
+		t.Errorf("Allowed %d sends in %v, want at most %d", allowed, end.Sub(t0), max)
+	}
+	// The limiter should still let the storm through at the limited rate.
+	if min := int(end.Sub(t0).Seconds()*testLimit) - 1; allowed < min {
+		t.Errorf("Allowed %d sends in %v, want at least %d", allowed, end.Sub(t0), min)
+	}
+}
+
+func TestLimiterRestoreCapsAllowance(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, test := range []struct {
+		desc     string
+		downtime time.Duration
+	}{
+		{"long downtime", time.Hour},
+		{"clock moved backwards", -time.Hour},
+	} {
+		statePath, removeState := testStatePath(t)
+		db, _ := openTestState(t, statePath, testSettings())
+
+		// Use up all tokens, then restart.
+		t0 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		limiter := rate.NewLimiter(testLimit, testBurst)
+		limiter.AllowN(t0, testBurst)
+		limiter = restartLimiter(t, db, limiter, t0, t0.Add(test.downtime))
+
+		// A long downtime refills at most a burst; a backwards clock none.
+		want := float64(testBurst)
+		if test.downtime < 0 {
+			want = 0
+		}
+		if got := limiter.TokensAt(t0.Add(test.downtime)); got != want {
+			t.Errorf("%s: %.1f tokens available after restart, want %.1f", test.desc, got, want)
+		}
+
+		db.Close()
+		removeState()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordHashedValues are the FCM request parameters which are replaced by
+// their hash when recorded: they identify the device, or are ciphertext.
+var recordHashedValues = map[string]bool{
+	"registration_id": true,
+	"data.payload":    true,
+}
+
+// fcmExchange is a recorded FCM request & its response (or error), written as
+// a JSON line. The request's Authorization header is never recorded.
+type fcmExchange struct {
+	Time    time.Time         `json:"time"`
+	URL     string            `json:"url"`
+	Request map[string]string `json:"request"`
+	Error   string            `json:"error,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Header  map[string]string `json:"header,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// fcmRecorder writes sanitized FCM request/response pairs, so that real
+// response shapes can be kept as fixtures. A nil *fcmRecorder records
+// nothing.
+type fcmRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newFCMRecorder(w io.Writer) *fcmRecorder {
+	return &fcmRecorder{enc: json.NewEncoder(w)}
+}
+
+// record writes the given request parameters, sent to fcmURL, along with
+// either the response (whose body has been read into body) or the error.
+func (r *fcmRecorder) record(fcmURL string, values url.Values, resp *http.Response, body []byte, err error) error {
+	if r == nil {
+		return nil
+	}
+	ex := fcmExchange{
+		Time:    time.Now().UTC(),
+		URL:     fcmURL,
+		Request: map[string]string{},
+	}
+	for k := range values {
+		v := values.Get(k)
+		if recordHashedValues[k] {
+			v = recordHash(v)
+		}
+		ex.Request[k] = v
+	}
+	if err != nil {
+		ex.Error = err.Error()
+	}
+	if resp != nil {
+		ex.Status = resp.StatusCode
+		ex.Header = map[string]string{}
+		for k := range resp.Header {
+			ex.Header[k] = resp.Header.Get(k)
+		}
+		ex.Body = sanitizeResponseBody(string(body))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(ex)
+}
+
+// recordHash returns the form in which a hashed value is recorded.
+func recordHash(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// sanitizeResponseBody hashes any hashed values (such as the canonical
+// registration ID FCM returns when a device's ID has changed) found on lines
+// of the form key=value in the given response body.
+func sanitizeResponseBody(body string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		eol := ""
+		if strings.HasSuffix(line, "\r") {
+			line, eol = strings.TrimSuffix(line, "\r"), "\r"
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && recordHashedValues[parts[0]] {
+			lines[i] = parts[0] + "=" + recordHash(parts[1]) + eol
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/goleak"
+
+	pb "../proto"
+)
+
+// fixtureExchange is a recorded FCM exchange kept in testdata/fcm, annotated
+// with how bnotifyd should classify the response.
+type fixtureExchange struct {
+	fcmExchange
+	Description string `json:"description"`
+	Want        string `json:"want"` // the error returned by postPayload, or "" if it succeeds
+}
+
+// readFixtures reads the recorded exchanges in the given JSON lines file.
+func readFixtures(t *testing.T, path string) []fixtureExchange {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open fixtures: %v", err)
+	}
+	defer f.Close()
+	var fixtures []fixtureExchange
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var fixture fixtureExchange
+		if err := json.Unmarshal(s.Bytes(), &fixture); err != nil {
+			t.Fatalf("Could not parse fixture %d of %s: %v", len(fixtures)+1, path, err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Could not read fixtures: %v", err)
+	}
+	return fixtures
+}
+
+// TestReplayFCMFixtures replays every recorded FCM response in testdata/fcm
+// through the response parser & error classifier.
+func TestReplayFCMFixtures(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	paths, err := filepath.Glob(filepath.Join("testdata", "fcm", "*.jsonl"))
+	if err != nil {
+		t.Fatalf("Could not list fixtures: %v", err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("No fixtures found")
+	}
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+
+	for _, path := range paths {
+		for _, fixture := range readFixtures(t, path) {
+			fcm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range fixture.Header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(fixture.Status)
+				fmt.Fprint(w, fixture.Body)
+			}))
+			ns.fcmAddress = fcm.URL
+			err := ns.postPayloadWithKey(&pb.PendingPayload{Payload: []byte("payload")}, "registration-id", "api-key")
+			fcm.Close()
+
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != fixture.Want {
+				t.Errorf("%s: %s: got error %q, want %q", filepath.Base(path), fixture.Description, got, fixture.Want)
+			}
+		}
+	}
+}
+
+func TestRecordSanitizes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var buf bytes.Buffer
+	r := newFCMRecorder(&buf)
+	values := url.Values{}
+	values.Set("registration_id", "device-registration-id")
+	values.Set("data.payload", "ciphertext")
+	values.Set("priority", "normal")
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}}
+	body := []byte("id=0:1\r\nregistration_id=canonical-registration-id\r\n")
+	if err := r.record("https://fcm.example/send", values, resp, body, nil); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	recorded := buf.String()
+	for _, secret := range []string{"device-registration-id", "ciphertext", "canonical-registration-id"} {
+		if strings.Contains(recorded, secret) {
+			t.Errorf("Recorded exchange contains %q: %s", secret, recorded)
+		}
+	}
+	var ex fcmExchange
+	if err := json.Unmarshal(buf.Bytes(), &ex); err != nil {
+		t.Fatalf("Could not parse recorded exchange: %v", err)
+	}
+	if want := recordHash("device-registration-id"); ex.Request["registration_id"] != want {
+		t.Errorf("Recorded registration_id %q, want %q", ex.Request["registration_id"], want)
+	}
+	if ex.Request["priority"] != "normal" {
+		t.Errorf("Recorded priority %q, want %q", ex.Request["priority"], "normal")
+	}
+	if want := "id=0:1\r\nregistration_id=" + recordHash("canonical-registration-id") + "\r\n"; ex.Body != want {
+		t.Errorf("Recorded body %q, want %q", ex.Body, want)
+	}
+}
+
+func TestSanitizeResponseBody(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, test := range []struct {
+		body, want string
+	}{
+		{"id=0:1\n", "id=0:1\n"},
+		{"Error=NotRegistered\n", "Error=NotRegistered\n"},
+		{"id=0:1\nregistration_id=abc\n", "id=0:1\nregistration_id=" + recordHash("abc") + "\n"},
+		{"registration_id=abc", "registration_id=" + recordHash("abc")},
+		{"{\"name\": \"projects/p/messages/1\"}\n", "{\"name\": \"projects/p/messages/1\"}\n"},
+		{"", ""},
+	} {
+		if got := sanitizeResponseBody(test.body); got != test.want {
+			t.Errorf("sanitizeResponseBody(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
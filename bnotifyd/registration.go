@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// adminTokenMetadataKey is the gRPC metadata key carrying the admin token.
+const adminTokenMetadataKey = "bnotify-admin-token"
+
+// credentials are the registration ID of the device & the cipher derived from it.
+type credentials struct {
+	registrationID string
+	gcmCipher      cipher.AEAD
+}
+
+func (ns *notificationService) creds() *credentials {
+	return ns.credentials.Load().(*credentials)
+}
+
+// checkAdmin verifies that the RPC with the given context carries the admin
+// token, and a valid TOTP code if TOTP is enabled.
+func (ns *notificationService) checkAdmin(ctx context.Context) error {
+	if ns.adminToken == "" {
+		return status.Error(codes.PermissionDenied, "admin RPCs are disabled; set admin_token in settings to enable them")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md[adminTokenMetadataKey]
+	if len(tokens) != 1 || subtle.ConstantTimeCompare([]byte(tokens[0]), []byte(ns.adminToken)) != 1 {
+		return status.Error(codes.Unauthenticated, "missing or incorrect admin token")
+	}
+	if ns.totp != nil {
+		totpCodes := md[totpMetadataKey]
+		if len(totpCodes) != 1 {
+			return status.Error(codes.Unauthenticated, "missing TOTP code")
+		}
+		if err := ns.totp.verify(totpCodes[0]); err != nil {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	return nil
+}
+
+func (ns *notificationService) UpdateRegistrationID(ctx context.Context, req *pb.UpdateRegIDRequest) (*pb.UpdateRegIDResponse, error) {
+	if err := ns.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.NewRegistrationId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing new_registration_id")
+	}
+	count, err := ns.updateRegistrationID(req.NewRegistrationId)
+	if err != nil {
+		log.Printf("Error while updating registration ID: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("Updated registration ID, re-encrypted %d pending message(s)", count)
+	return &pb.UpdateRegIDResponse{ReencryptedCount: int32(count)}, nil
+}
+
+// updateRegistrationID replaces the registration ID, re-encrypting pending
+// messages for it & returning the number re-encrypted.
+func (ns *notificationService) updateRegistrationID(registrationID string) (int, error) {
+	newCipher, err := newCipher(ns.password, registrationID, serverIDSize+binary.Size(uint64(0)))
+	if err != nil {
+		return 0, fmt.Errorf("could not initialize cipher: %v", err)
+	}
+
+	// The key is derived from the registration ID, so pending payloads must
+	// be re-encrypted. Holding rekeyMu keeps enqueues & send attempts from
+	// seeing a mix of old & new payloads & credentials.
+	ns.rekeyMu.Lock()
+	defer ns.rekeyMu.Unlock()
+	var count int
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		settingsBucket := tx.Bucket([]byte("settings"))
+		if settingsBucket == nil {
+			return errors.New("missing settings bucket")
+		}
+		serverID := settingsBucket.Get([]byte("serverID"))
+		if err := checkServerID(serverID); err != nil {
+			return err
+		}
+		var err error
+		if count, err = reencryptPending(tx, ns.creds().gcmCipher, newCipher, serverID); err != nil {
+			return err
+		}
+		return settingsBucket.Put([]byte("registrationID"), []byte(registrationID))
+	}); err != nil {
+		return 0, err
+	}
+	ns.credentials.Store(&credentials{registrationID, newCipher})
+	if ns.echo != nil {
+		ns.echo.setCipher(newCipher)
+	}
+	ns.tokens.replace()
+	return count, nil
+}
+
+// storedRegistrationID returns the registration ID set by
+// UpdateRegistrationID, if any, which takes precedence over the settings file.
+func storedRegistrationID(tx *bolt.Tx) string {
+	settingsBucket := tx.Bucket([]byte("settings"))
+	if settingsBucket == nil {
+		return ""
+	}
+	return string(settingsBucket.Get([]byte("registrationID")))
+}
+
+// stateCipher returns the cipher which pending payloads in the given state
+// are encrypted with, for use by offline subcommands.
+func stateCipher(tx *bolt.Tx, settings *pb.BNotifySettings) (cipher.AEAD, error) {
+	registrationID := settings.RegistrationId
+	if stored := storedRegistrationID(tx); stored != "" {
+		registrationID = stored
+	}
+	return newCipher(settings.Password, registrationID, serverIDSize+binary.Size(uint64(0)))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	pb "../proto"
+)
+
+const (
+	// recoveryProgressInterval is how often progress recovering a backlog at startup is checked.
+	recoveryProgressInterval = 10 * time.Second
+
+	// recoveryLogEvery is how many recovered messages are logged about at a time.
+	recoveryLogEvery = 100
+)
+
+// dropStaleBacklog moves those of the given pending messages which were
+// enqueued longer ago than maxAge to the dead-letter queue, so that they are
+// not replayed at startup. It returns the sequence numbers of the messages
+// which remain pending.
+func dropStaleBacklog(db *bolt.DB, seqs []uint64, maxAge time.Duration) ([]uint64, error) {
+	cutoff := time.Now().Add(-maxAge)
+	var remaining []uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		remaining = nil // in case of retries
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		for _, seq := range seqs {
+			pendingPayload := &pb.PendingPayload{}
+			if err := proto.Unmarshal(messagesBucket.Get(seqKey(seq)), pendingPayload); err != nil {
+				return fmt.Errorf("could not unmarshal pending payload %d: %v", seq, err)
+			}
+			// Messages without a (valid) enqueue time are kept.
+			enqueueTime, err := ptypes.Timestamp(pendingPayload.EnqueueTime)
+			if err != nil || !enqueueTime.Before(cutoff) {
+				remaining = append(remaining, seq)
+				continue
+			}
+			if err := messagesBucket.Delete(seqKey(seq)); err != nil {
+				return fmt.Errorf("could not delete pending payload %d: %v", seq, err)
+			}
+			if err := putDeadLetter(tx, seq, pendingPayload, pb.DeadLetter_REPLAY_TOO_OLD); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if skipped := len(seqs) - len(remaining); skipped > 0 {
+		log.Printf("Skipped replaying %d pending message(s) enqueued before %v; moved to dead-letter queue", skipped, cutoff.Format(time.RFC3339))
+	}
+	return remaining, nil
+}
+
+// recoverBacklog sends the given pending messages, found at startup, in the
+// order given by recoveryOrder, logging progress as they are sent. If the
+// service begins draining, the remaining messages are left pending, to be
+// recovered on the next startup.
+//
+// Only the order in which sends start is controlled: they run concurrently,
+// up to max_in_flight_messages at a time, so they are only guaranteed to
+// reach FCM in this order if that is 1. The exception is group summaries,
+// which are dispatched only once those of their notifications in the backlog
+// have been sent (or have given up), as when first sent.
+func (ns *notificationService) recoverBacklog(seqs []uint64) {
+	if len(seqs) == 0 {
+		return
+	}
+	seqs = ns.orderBacklog(seqs)
+	ordered, err := ns.recoveryOrder(seqs)
+	if err != nil {
+		log.Printf("Warning: could not read pending messages to order recovery by priority & channel: %v", err)
+		ordered = seqs
+	}
+	groups, held, err := ns.backlogGroups(ordered)
+	if err != nil {
+		log.Printf("Warning: could not read pending messages to hold group summaries: %v", err)
+	}
+	log.Printf("Recovering %d pending message(s)", len(ordered))
+	go ns.logRecoveryProgress(ordered)
+	for _, seq := range ordered {
+		if ns.isStopping() {
+			return
+		}
+		if held[seq] {
+			// Dispatched once its group's notifications finish, below.
+			continue
+		}
+		g := groups[seq]
+		if g == nil {
+			ns.dispatch(seq)
+			continue
+		}
+		ns.dispatchThen(seq, func() {
+			if atomic.AddInt32(&g.pending, -1) == 0 {
+				ns.dispatch(g.summary)
+			}
+		})
+	}
+}
+
+// recoveryOrder reorders the given pending messages for recovery: CRITICAL
+// then HIGH priority messages first, then the rest by weighted round-robin across
+// channels, with NORMAL before LOW priority messages within each channel.
+// Otherwise, the given order is kept.
+func (ns *notificationService) recoveryOrder(seqs []uint64) ([]uint64, error) {
+	var urgent []uint64
+	urgentRanks := map[uint64]int{}
+	queues := map[string][]uint64{}
+	lowQueues := map[string][]uint64{}
+	var channels []string // in order of first appearance
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		for _, seq := range seqs {
+			pendingPayload := &pb.PendingPayload{}
+			if err := proto.Unmarshal(messagesBucket.Get(seqKey(seq)), pendingPayload); err != nil {
+				return fmt.Errorf("could not unmarshal pending payload %d: %v", seq, err)
+			}
+			rank := priorityRank(pendingPayload.Priority)
+			if rank <= priorityRank(pb.Priority_HIGH) {
+				urgent, urgentRanks[seq] = append(urgent, seq), rank
+				continue
+			}
+			ch := pendingPayload.Channel
+			if _, ok := queues[ch]; !ok {
+				queues[ch] = nil
+				channels = append(channels, ch)
+			}
+			if rank > priorityRank(pb.Priority_NORMAL) {
+				lowQueues[ch] = append(lowQueues[ch], seq)
+			} else {
+				queues[ch] = append(queues[ch], seq)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// CRITICAL messages go before HIGH ones, each in the given order.
+	sort.SliceStable(urgent, func(i, j int) bool { return urgentRanks[urgent[i]] < urgentRanks[urgent[j]] })
+	ordered := append(make([]uint64, 0, len(seqs)), urgent...)
+	for _, ch := range channels {
+		queues[ch] = append(queues[ch], lowQueues[ch]...)
+	}
+	for len(ordered) < len(seqs) {
+		for _, ch := range channels {
+			n := int(ns.recoveryWeights[ch])
+			if n <= 0 {
+				n = 1
+			}
+			if n > len(queues[ch]) {
+				n = len(queues[ch])
+			}
+			ordered = append(ordered, queues[ch][:n]...)
+			queues[ch] = queues[ch][n:]
+		}
+	}
+	return ordered, nil
+}
+
+// logRecoveryProgress periodically logs how many of the given messages have
+// been recovered (i.e. are no longer pending) along with an estimate of the
+// time remaining, until all have been or the service begins draining.
+func (ns *notificationService) logRecoveryProgress(seqs []uint64) {
+	start := time.Now()
+	logged := 0
+	ticker := time.NewTicker(recoveryProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ns.stopping:
+			return
+		}
+		remaining, err := ns.countPending(seqs)
+		if err != nil {
+			log.Printf("Error while checking recovery progress: %v", err)
+			continue
+		}
+		if remaining == 0 {
+			log.Printf("Recovered all %d pending message(s) in %s", len(seqs), roughDuration(time.Since(start)))
+			return
+		}
+		recovered := len(seqs) - remaining
+		if recovered < logged+recoveryLogEvery {
+			continue
+		}
+		logged = recovered
+		eta := time.Duration(float64(time.Since(start)) * float64(remaining) / float64(recovered))
+		log.Printf("Recovered %d/%d pending message(s), ~%s remaining at current rate", recovered, len(seqs), roughDuration(eta))
+	}
+}
+
+// countPending returns how many of the given messages are still pending.
+func (ns *notificationService) countPending(seqs []uint64) (int, error) {
+	count := 0
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		for _, seq := range seqs {
+			if messagesBucket.Get(seqKey(seq)) != nil {
+				count++
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
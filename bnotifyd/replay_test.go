@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/sync/semaphore"
+
+	pb "../proto"
+)
+
+// TestRecoverBacklogAfterRestart stops bnotifyd partway through recovering a
+// backlog, as on SIGTERM, then restarts it on the same state file: every
+// message must be sent exactly once across the two runs.
+func TestRecoverBacklogAfterRestart(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const count, stopAfter = 60, 20
+	settings := testSettings()
+	statePath, removeState := testStatePath(t)
+	defer removeState()
+
+	db, _ := openTestState(t, statePath, settings)
+	fcm := startRecordingFCM(t, testCipher(t))
+	defer fcm.Close()
+	fillPending(t, newTestServiceForDB(t, db, settings, fcm.URL), count)
+	db.Close()
+
+	// First run: recover one message at a time, stopping partway through.
+	db, seqs := openTestState(t, statePath, settings)
+	if len(seqs) != count {
+		t.Fatalf("Found %d pending messages at startup, want %d", len(seqs), count)
+	}
+	ns := newTestServiceForDB(t, db, settings, fcm.URL)
+	ns.inFlight = semaphore.NewWeighted(1)
+	recovered := make(chan struct{})
+	go func() {
+		ns.recoverBacklog(seqs)
+		close(recovered)
+	}()
+	eventually(t, "some messages are recovered", func() bool { return len(fcm.received()) >= stopAfter })
+	ns.drain(pb.BNotifySettings_NONE, 5*time.Second)
+	select {
+	case <-recovered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Recovery did not stop once draining began")
+	}
+	db.Close()
+
+	sentFirst := map[uint64]bool{}
+	for _, seq := range fcm.receivedSeqs() {
+		sentFirst[seq] = true
+	}
+	if len(sentFirst) >= count {
+		t.Fatalf("All messages were recovered before stopping; cannot test restart")
+	}
+
+	// Second run: everything not yet sent, & nothing already sent, is still
+	// pending, & is recovered.
+	db, seqs = openTestState(t, statePath, settings)
+	defer db.Close()
+	for _, seq := range seqs {
+		if sentFirst[seq] {
+			t.Errorf("Message %d is pending after restart, but was already sent", seq)
+		}
+	}
+	if len(seqs)+len(sentFirst) != count {
+		t.Errorf("Found %d pending messages after restart, %d were sent before; want %d in all", len(seqs), len(sentFirst), count)
+	}
+	ns = newTestServiceForDB(t, db, settings, fcm.URL)
+	ns.recoverBacklog(seqs)
+	ns.senders.Wait()
+	ns.drain(pb.BNotifySettings_NONE, time.Second)
+
+	sent := map[uint64]int{}
+	for _, seq := range fcm.receivedSeqs() {
+		sent[seq]++
+	}
+	if len(sent) != count {
+		t.Errorf("FCM received %d distinct messages, want %d", len(sent), count)
+	}
+	for seq, n := range sent {
+		if n != 1 {
+			t.Errorf("FCM received message %d %d times, want once", seq, n)
+		}
+	}
+	if pending := pendingPayloads(t, ns); len(pending) != 0 {
+		t.Errorf("Got %d pending messages after recovery, want 0", len(pending))
+	}
+}
+
+func TestRecoveryOrderCriticalBeforeHigh(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	seqOf := map[string]uint64{}
+	var seqs []uint64
+	for _, m := range []struct {
+		title    string
+		priority pb.Priority
+	}{
+		{"high 1", pb.Priority_HIGH},
+		{"normal", pb.Priority_NORMAL},
+		{"critical 1", pb.Priority_CRITICAL},
+		{"high 2", pb.Priority_HIGH},
+		{"critical 2", pb.Priority_CRITICAL},
+	} {
+		req := testRequest(m.title)
+		req.Priority = m.priority
+		seq, _, err := ns.enqueue(req)
+		if err != nil {
+			t.Fatalf("Could not enqueue message: %v", err)
+		}
+		seqOf[m.title], seqs = seq, append(seqs, seq)
+	}
+
+	// An older HIGH message must not take an in-flight slot ahead of a newer
+	// CRITICAL one; within each priority, the given order is kept.
+	got, err := ns.recoveryOrder(seqs)
+	if err != nil {
+		t.Fatalf("recoveryOrder: %v", err)
+	}
+	want := []uint64{seqOf["critical 1"], seqOf["critical 2"], seqOf["high 1"], seqOf["high 2"], seqOf["normal"]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recoveryOrder = %v, want %v", got, want)
+	}
+}
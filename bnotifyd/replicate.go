@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/ptypes"
+
+	pb "../proto"
+)
+
+// replicator periodically writes snapshots of the state database to a
+// secondary file.
+type replicator struct {
+	db       *bolt.DB
+	path     string
+	interval time.Duration
+
+	mu       sync.Mutex
+	lastTime time.Time // time of the last successful snapshot
+}
+
+func newReplicator(db *bolt.DB, path string, interval time.Duration) *replicator {
+	return &replicator{db: db, path: path, interval: interval}
+}
+
+// run writes snapshots forever. Failures are logged but otherwise ignored:
+// snapshots are taken in read transactions, so replication never blocks or
+// fails writes to the primary state file.
+func (r *replicator) run() {
+	for {
+		if err := r.snapshot(); err != nil {
+			log.Printf("Warning: could not replicate state to %s: %v", r.path, err)
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+// snapshot writes a consistent copy of the state database to the replica
+// path, replacing the previous copy atomically.
+func (r *replicator) snapshot() error {
+	tmpPath := r.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	var snapshotTime time.Time
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		snapshotTime = time.Now()
+		_, err := tx.WriteTo(f)
+		return err
+	}); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not sync snapshot: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not close snapshot: %v", err)
+	}
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		return fmt.Errorf("could not move snapshot into place: %v", err)
+	}
+	debugf("Replicated state to %s", r.path)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastTime = snapshotTime
+	return nil
+}
+
+// status fills in the replication fields of a GetStatus response.
+func (r *replicator) status(resp *pb.GetStatusResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastTime.IsZero() {
+		resp.ReplicationLagSeconds = -1
+		return
+	}
+	if t, err := ptypes.TimestampProto(r.lastTime); err == nil {
+		resp.LastReplicationTime = t
+	}
+	resp.ReplicationLagSeconds = int64(time.Since(r.lastTime).Seconds())
+}
+
+// restore rebuilds the state file from a replica given by --from. Since the
+// replica may be behind the lost state file, sequence numbers after its
+// high-water mark may already have been used with its server ID; so the
+// server ID is rotated (re-encrypting pending messages) before the restored
+// state is used, which keeps nonces unique.
+func restore() {
+	if *restoreFrom == "" {
+		log.Fatalf("--from is required")
+	}
+	settingsPath, statePath, err := resolvePaths()
+	if err != nil {
+		log.Fatalf("Error resolving file locations: %v", err)
+	}
+	if _, err := os.Stat(statePath); err == nil {
+		log.Fatalf("State file %s already exists; move it aside before restoring", statePath)
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Error checking state file: %v", err)
+	}
+	settings, err := readSettings(settingsPath)
+	if err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	if err := prepareStateDir(statePath); err != nil {
+		log.Fatalf("Error preparing state file: %v", err)
+	}
+	if err := copyFile(*restoreFrom, statePath); err != nil {
+		log.Fatalf("Error copying replica: %v", err)
+	}
+
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("Error opening restored state file: %v", err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		gcmCipher, err := stateCipher(tx, settings)
+		if err != nil {
+			return fmt.Errorf("could not initialize cipher: %v", err)
+		}
+		serverID, count, err := rotateServerID(tx, gcmCipher)
+		if err != nil {
+			return err
+		}
+		log.Printf("Restored state from %s; rotated server ID to %x, re-encrypted %d pending message(s)", *restoreFrom, serverID, count)
+		return nil
+	}); err != nil {
+		log.Fatalf("Error rotating server ID of restored state: %v", err)
+	}
+}
+
+// copyFile copies src to a new file dst, which must not already exist.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+func (ns *notificationService) ResendNotification(ctx context.Context, req *pb.ResendRequest) (*pb.ResendResponse, error) {
+	_, seq, err := parseNotificationID(req.NotificationId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Find the original notification in the history.
+	var sentMessage *pb.SentMessage
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		sentBucket := tx.Bucket([]byte("sent_messages"))
+		if sentBucket == nil {
+			return errors.New("missing sent_messages bucket")
+		}
+		smBytes := sentBucket.Get(seqKey(seq))
+		if smBytes == nil {
+			return nil
+		}
+		sm := &pb.SentMessage{}
+		if err := proto.Unmarshal(smBytes, sm); err != nil {
+			return fmt.Errorf("could not unmarshal sent message: %v", err)
+		}
+		if sm.NotificationId == req.NotificationId {
+			sentMessage = sm
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Error while resending notification %q: %v", req.NotificationId, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if sentMessage == nil {
+		return nil, status.Errorf(codes.NotFound, "no sent notification %q in history", req.NotificationId)
+	}
+	if sentMessage.Notification == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "only a hash of notification %q's content was retained in history, so it cannot be resent", req.NotificationId)
+	}
+
+	// Enqueue it as a new notification. It was already enriched & checked
+	// against mute rules when first sent. (Messages sent by older versions
+	// have no recorded Android config or priority, & are resent with the
+	// defaults.)
+	if ns.inFlight != nil && !ns.inFlight.TryAcquire(1) {
+		return nil, quotaFailure("too many notifications in flight", "max_in_flight_messages", inFlightRetryDelay)
+	}
+	newSeq, pendingPayload, err := ns.enqueueMessage(&pb.SendNotificationRequest{
+		Notification:  sentMessage.Notification,
+		AndroidConfig: sentMessage.AndroidConfig,
+		Priority:      sentMessage.Priority,
+	}, sentMessage.Test)
+	if err != nil {
+		ns.releaseInFlight()
+		log.Printf("Error while resending notification %q: %v", req.NotificationId, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("[%s] Enqueued resend of notification %s", pendingPayload.NotificationId, req.NotificationId)
+	if ns.startSenders(1) {
+		go ns.sendPayload(newSeq)
+	} else {
+		ns.releaseInFlight()
+	}
+	return &pb.ResendResponse{
+		Seq:            newSeq,
+		NotificationId: pendingPayload.NotificationId,
+	}, nil
+}
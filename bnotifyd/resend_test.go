@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+
+	pb "../proto"
+)
+
+// sentMessageRecord returns the history record of the sent message with the
+// given sequence number.
+func sentMessageRecord(t *testing.T, ns *notificationService, seq uint64) *pb.SentMessage {
+	sentMessage := &pb.SentMessage{}
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		return proto.Unmarshal(tx.Bucket([]byte("sent_messages")).Get(seqKey(seq)), sentMessage)
+	}); err != nil {
+		t.Fatalf("Could not read sent message %d: %v", seq, err)
+	}
+	return sentMessage
+}
+
+func TestResendKeepsPriorityAndAndroidConfig(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+
+	req := testRequest("resend me")
+	req.Priority = pb.Priority_HIGH
+	req.AndroidConfig = &pb.AndroidConfig{DirectBootOk: true, RestrictedPackageName: "com.example.fork"}
+	resp, err := ns.SendNotification(context.Background(), req)
+	if err != nil {
+		t.Fatalf("SendNotification: %v", err)
+	}
+	ns.senders.Wait()
+	_, seq, err := parseNotificationID(resp.NotificationId)
+	if err != nil {
+		t.Fatalf("Bad notification ID: %v", err)
+	}
+
+	resendResp, err := ns.ResendNotification(context.Background(), &pb.ResendRequest{NotificationId: resp.NotificationId})
+	if err != nil {
+		t.Fatalf("ResendNotification: %v", err)
+	}
+	ns.senders.Wait()
+
+	original, resent := sentMessageRecord(t, ns, seq), sentMessageRecord(t, ns, resendResp.Seq)
+	for _, sm := range []*pb.SentMessage{original, resent} {
+		if sm.Priority != req.Priority {
+			t.Errorf("Message %d has priority %v, want %v", sm.Seq, sm.Priority, req.Priority)
+		}
+		if !proto.Equal(sm.AndroidConfig, req.AndroidConfig) {
+			t.Errorf("Message %d has Android config %v, want %v", sm.Seq, sm.AndroidConfig, req.AndroidConfig)
+		}
+	}
+	if !proto.Equal(resent.Notification, original.Notification) {
+		t.Errorf("Resent notification %v, want %v", resent.Notification, original.Notification)
+	}
+}
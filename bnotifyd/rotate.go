@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+func (ns *notificationService) RotateServerID(ctx context.Context, req *pb.RotateServerIDRequest) (*pb.RotateServerIDResponse, error) {
+	if err := ns.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	var serverID []byte
+	var count int
+	// The rotation happens in a single transaction, so it is atomic with
+	// respect to concurrent enqueues & sends.
+	ns.rekeyMu.RLock()
+	defer ns.rekeyMu.RUnlock()
+	gcmCipher := ns.creds().gcmCipher
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		serverID, count, err = rotateServerID(tx, gcmCipher)
+		return err
+	}); err != nil {
+		log.Printf("Error while rotating server ID: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("Rotated server ID to %x, re-encrypted %d pending message(s)", serverID, count)
+	return &pb.RotateServerIDResponse{
+		ServerId:         fmt.Sprintf("%x", serverID),
+		ReencryptedCount: int32(count),
+	}, nil
+}
+
+// rotateServerIDCmd rotates the server ID of a state file not currently in
+// use by a running bnotifyd.
+func rotateServerIDCmd() {
+	settingsPath, statePath, err := resolvePaths()
+	if err != nil {
+		log.Fatalf("Error resolving file locations: %v", err)
+	}
+	settings, err := readSettings(settingsPath)
+	if err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("Error opening state file (is bnotifyd running? if so, use the RotateServerID RPC): %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		gcmCipher, err := stateCipher(tx, settings)
+		if err != nil {
+			return fmt.Errorf("could not initialize cipher: %v", err)
+		}
+		serverID, count, err := rotateServerID(tx, gcmCipher)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rotated server ID to %x, re-encrypted %d pending message(s)", serverID, count)
+		return nil
+	}); err != nil {
+		log.Fatalf("Error rotating server ID: %v", err)
+	}
+}
+
+// rotateServerID generates & stores a new server ID, then re-encrypts all
+// pending messages with gcmCipher so that they are sent with the new server
+// ID, returning the new server ID & the number of re-encrypted messages.
+func rotateServerID(tx *bolt.Tx, gcmCipher cipher.AEAD) ([]byte, int, error) {
+	settingsBucket := tx.Bucket([]byte("settings"))
+	if settingsBucket == nil {
+		return nil, 0, errors.New("missing settings bucket")
+	}
+	serverID := make([]byte, serverIDSize)
+	if _, err := rand.Read(serverID); err != nil {
+		return nil, 0, fmt.Errorf("could not generate server ID: %v", err)
+	}
+	if err := settingsBucket.Put([]byte("serverID"), serverID); err != nil {
+		return nil, 0, fmt.Errorf("could not set server ID: %v", err)
+	}
+	count, err := reencryptPending(tx, gcmCipher, gcmCipher, serverID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return serverID, count, nil
+}
+
+// reencryptPending decrypts every pending message with oldCipher, then
+// re-encrypts it with newCipher under a nonce built from the given server ID.
+// (Notification IDs are left as originally issued.) It returns the number of
+// re-encrypted messages.
+func reencryptPending(tx *bolt.Tx, oldCipher, newCipher cipher.AEAD, serverID []byte) (int, error) {
+	messagesBucket := tx.Bucket([]byte("pending_messages"))
+	if messagesBucket == nil {
+		return 0, errors.New("missing pending_messages bucket")
+	}
+
+	updated := map[string][]byte{}
+	if err := messagesBucket.ForEach(func(key, ppBytes []byte) error {
+		seq := binary.BigEndian.Uint64(key)
+		pendingPayload := &pb.PendingPayload{}
+		if err := proto.Unmarshal(ppBytes, pendingPayload); err != nil {
+			return fmt.Errorf("could not unmarshal pending payload %d: %v", seq, err)
+		}
+		envelope := &pb.Envelope{}
+		if err := proto.Unmarshal(pendingPayload.Payload, envelope); err != nil {
+			return fmt.Errorf("could not unmarshal envelope %d: %v", seq, err)
+		}
+		plaintextMessage, err := oldCipher.Open(nil, envelope.Nonce, envelope.Message, nil)
+		if err != nil {
+			return fmt.Errorf("could not decrypt message %d: %v", seq, err)
+		}
+		message := &pb.Message{}
+		if err := proto.Unmarshal(plaintextMessage, message); err != nil {
+			return fmt.Errorf("could not unmarshal message %d: %v", seq, err)
+		}
+
+		message.ServerId = serverID
+		if plaintextMessage, err = proto.Marshal(message); err != nil {
+			return fmt.Errorf("could not marshal message %d: %v", seq, err)
+		}
+		envelope.Nonce = makeNonce(serverID, seq)
+		envelope.Message = newCipher.Seal(nil, envelope.Nonce, plaintextMessage, nil)
+		if pendingPayload.Payload, err = proto.Marshal(envelope); err != nil {
+			return fmt.Errorf("could not marshal envelope %d: %v", seq, err)
+		}
+		if ppBytes, err = proto.Marshal(pendingPayload); err != nil {
+			return fmt.Errorf("could not marshal pending payload %d: %v", seq, err)
+		}
+		updated[string(key)] = ppBytes
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	// Buckets may not be modified while iterating over them, so write back afterwards.
+	for key, ppBytes := range updated {
+		if err := messagesBucket.Put([]byte(key), ppBytes); err != nil {
+			return 0, fmt.Errorf("could not write pending payload: %v", err)
+		}
+	}
+	return len(updated), nil
+}
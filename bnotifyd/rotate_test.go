@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"go.uber.org/goleak"
+)
+
+func TestRotateServerID(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ns, cleanup := newTestService(t, testSettings())
+	defer cleanup()
+	gcmCipher := ns.creds().gcmCipher
+
+	// Every nonce used, whether by a message sent before rotation or by one
+	// still pending after it, must be unique.
+	nonces := map[string]uint64{}
+	useNonce := func(seq uint64, nonce []byte) {
+		if other, ok := nonces[string(nonce)]; ok && other != seq {
+			t.Errorf("Messages %d & %d both use nonce %x", other, seq, nonce)
+		}
+		nonces[string(nonce)] = seq
+	}
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		if _, _, err := ns.enqueue(testRequest(fmt.Sprintf("before %d", i))); err != nil {
+			t.Fatalf("Could not enqueue message: %v", err)
+		}
+	}
+	before := pendingPayloads(t, ns)
+	var oldServerID []byte
+	for seq, pendingPayload := range before {
+		nonce, message := openTestPayload(t, gcmCipher, pendingPayload.Payload)
+		useNonce(seq, nonce)
+		oldServerID = message.ServerId
+	}
+
+	var newServerID []byte
+	var reencrypted int
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		newServerID, reencrypted, err = rotateServerID(tx, gcmCipher)
+		return err
+	}); err != nil {
+		t.Fatalf("Could not rotate server ID: %v", err)
+	}
+	if reencrypted != count {
+		t.Errorf("rotateServerID re-encrypted %d messages, want %d", reencrypted, count)
+	}
+	if bytes.Equal(newServerID, oldServerID) {
+		t.Errorf("rotateServerID kept server ID %x", oldServerID)
+	}
+
+	for i := 0; i < count; i++ {
+		if _, _, err := ns.enqueue(testRequest(fmt.Sprintf("after %d", i))); err != nil {
+			t.Fatalf("Could not enqueue message: %v", err)
+		}
+	}
+	after := pendingPayloads(t, ns)
+	if len(after) != 2*count {
+		t.Fatalf("Got %d pending messages, want %d", len(after), 2*count)
+	}
+	for seq, pendingPayload := range after {
+		nonce, message := openTestPayload(t, gcmCipher, pendingPayload.Payload)
+		if !bytes.Equal(message.ServerId, newServerID) {
+			t.Errorf("Message %d has server ID %x, want %x", seq, message.ServerId, newServerID)
+		}
+		if message.Seq != seq {
+			t.Errorf("Message %d has sequence number %d", seq, message.Seq)
+		}
+		if !bytes.Equal(nonce, makeNonce(newServerID, seq)) {
+			t.Errorf("Message %d has nonce %x, want %x", seq, nonce, makeNonce(newServerID, seq))
+		}
+		if _, ok := before[seq]; ok && pendingPayload.NotificationId != before[seq].NotificationId {
+			t.Errorf("Message %d has notification ID %q after rotation, want %q", seq, pendingPayload.NotificationId, before[seq].NotificationId)
+		}
+		useNonce(seq, nonce)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// retryDecision describes when the next attempt to send a message will be
+// made, along with the inputs that went into the decision.
+type retryDecision struct {
+	attempt    int           // number of previous send attempts
+	baseWait   time.Duration // wait given by the backoff schedule
+	retryAfter time.Duration // minimum wait requested by FCM's Retry-After header
+	wait       time.Duration // total wait before the next attempt
+	giveUp     bool          // if set, no further attempts will be made
+}
+
+func (d retryDecision) String() string {
+	if d.giveUp {
+		return fmt.Sprintf("attempt=%d, giving up", d.attempt)
+	}
+	return fmt.Sprintf("attempt=%d, wait=%v (base wait %v, retry-after %v)", d.attempt, d.wait, d.baseWait, d.retryAfter)
+}
+
+// scheduleRetry decides when to next attempt to send a message that has
+// already had sendAttempts attempts made. retryAfter is the minimum wait
+// requested by FCM in response to the previous attempt, if any.
+func scheduleRetry(sendAttempts int, retryAfter time.Duration) retryDecision {
+	d := retryDecision{attempt: sendAttempts, retryAfter: retryAfter}
+	if sendAttempts >= len(waits) {
+		d.giveUp = true
+		return d
+	}
+	d.baseWait = waits[sendAttempts]
+	d.wait = d.baseWait
+	if d.retryAfter > d.wait {
+		d.wait = d.retryAfter
+	}
+	return d
+}
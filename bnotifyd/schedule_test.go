@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func TestScheduleRetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, test := range []struct {
+		desc         string
+		sendAttempts int
+		retryAfter   time.Duration
+		want         retryDecision
+	}{
+		{"first attempt", 0, 0, retryDecision{attempt: 0, baseWait: 0, wait: 0}},
+		{"backoff", 3, 0, retryDecision{attempt: 3, baseWait: 4 * time.Second, wait: 4 * time.Second}},
+		{"last attempt", len(waits) - 1, 0, retryDecision{attempt: len(waits) - 1, baseWait: 16 * time.Minute, wait: 16 * time.Minute}},
+		{"retry-after longer than backoff", 1, time.Minute, retryDecision{attempt: 1, baseWait: time.Second, retryAfter: time.Minute, wait: time.Minute}},
+		{"retry-after shorter than backoff", 7, time.Second, retryDecision{attempt: 7, baseWait: 2 * time.Minute, retryAfter: time.Second, wait: 2 * time.Minute}},
+		{"retry-after equal to backoff", 2, 2 * time.Second, retryDecision{attempt: 2, baseWait: 2 * time.Second, retryAfter: 2 * time.Second, wait: 2 * time.Second}},
+		{"give up", len(waits), 0, retryDecision{attempt: len(waits), giveUp: true}},
+		{"give up despite retry-after", len(waits), time.Minute, retryDecision{attempt: len(waits), retryAfter: time.Minute, giveUp: true}},
+		{"give up after too many attempts", len(waits) + 5, 0, retryDecision{attempt: len(waits) + 5, giveUp: true}},
+	} {
+		if got := scheduleRetry(test.sendAttempts, test.retryAfter); got != test.want {
+			t.Errorf("%s: scheduleRetry(%d, %v) = %+v, want %+v", test.desc, test.sendAttempts, test.retryAfter, got, test.want)
+		}
+	}
+}
+
+func TestScheduleRetryBackoffIsMonotonic(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var last time.Duration
+	for attempt := 0; attempt < len(waits); attempt++ {
+		d := scheduleRetry(attempt, 0)
+		if d.giveUp {
+			t.Fatalf("scheduleRetry(%d, 0) gave up, want a wait", attempt)
+		}
+		if d.wait < last {
+			t.Errorf("scheduleRetry(%d, 0) waits %v, less than the previous attempt's %v", attempt, d.wait, last)
+		}
+		last = d.wait
+	}
+}
+
+func TestRetryDecisionString(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, test := range []struct {
+		d    retryDecision
+		want string
+	}{
+		{scheduleRetry(1, time.Minute), "attempt=1, wait=1m0s (base wait 1s, retry-after 1m0s)"},
+		{scheduleRetry(len(waits), 0), "attempt=11, giving up"},
+	} {
+		if got := test.d.String(); got != test.want {
+			t.Errorf("%+v.String() = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "../proto"
+)
+
+// serverEventBroadcaster distributes server events to watchers. Like
+// eventBroadcaster, it drops events for watchers more than eventBufferSize
+// events behind. A nil *serverEventBroadcaster drops all events.
+type serverEventBroadcaster struct {
+	mu       sync.Mutex
+	watchers map[chan *pb.ServerEvent]serverEventWatcher
+}
+
+// serverEventWatcher describes which events are queued for a watcher, & what
+// happens when its queue is full.
+type serverEventWatcher struct {
+	filter  func(*pb.ServerEvent) bool // if non-nil, only events for which this returns true are queued
+	dropped func()                     // if non-nil, called (rather than logging a warning) for each dropped event
+}
+
+func newServerEventBroadcaster() *serverEventBroadcaster {
+	return &serverEventBroadcaster{watchers: map[chan *pb.ServerEvent]serverEventWatcher{}}
+}
+
+// watch returns a channel of future events, and a function which must be
+// called to stop watching.
+func (b *serverEventBroadcaster) watch() (<-chan *pb.ServerEvent, func()) {
+	return b.watchQueue(eventBufferSize, serverEventWatcher{})
+}
+
+// watchQueue is watch, with a queue of the given size, filtered & reporting
+// dropped events as described by w.
+func (b *serverEventBroadcaster) watchQueue(size int, w serverEventWatcher) (<-chan *pb.ServerEvent, func()) {
+	ch := make(chan *pb.ServerEvent, size)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watchers[ch] = w
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.watchers, ch)
+	}
+}
+
+// publish sends the given event, timestamped now, to all watchers.
+func (b *serverEventBroadcaster) publish(event *pb.ServerEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.watchers) == 0 {
+		return
+	}
+	event.Time, _ = ptypes.TimestampProto(time.Now())
+	for ch, w := range b.watchers {
+		if w.filter != nil && !w.filter(event) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			if w.dropped != nil {
+				w.dropped()
+				continue
+			}
+			log.Printf("Warning: dropped server event for slow watcher")
+		}
+	}
+}
+
+// publishStatusServerEvent publishes the server event for a change in the
+// status of the given pending payload.
+func (ns *notificationService) publishStatusServerEvent(seq uint64, pendingPayload *pb.PendingPayload, status pb.StatusResponse_Status) {
+	id := pendingPayload.NotificationId
+	switch status {
+	case pb.StatusResponse_PENDING:
+		ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_Queued{Queued: &pb.ServerEvent_NotificationQueued{
+			Seq:            seq,
+			NotificationId: id,
+			Priority:       pendingPayload.Priority,
+			Channel:        pendingPayload.Channel,
+		}}})
+	case pb.StatusResponse_SENT:
+		// The pending payload is as it was before the successful attempt was recorded.
+		ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_Sent{Sent: &pb.ServerEvent_NotificationSent{
+			Seq:            seq,
+			NotificationId: id,
+			SendAttempts:   pendingPayload.SendAttempts + 1,
+		}}})
+	case pb.StatusResponse_FAILED:
+		// Once running, notifications only fail by running out of retries.
+		ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_Failed{Failed: &pb.ServerEvent_NotificationFailed{
+			Seq:            seq,
+			NotificationId: id,
+			Reason:         pb.DeadLetter_TOO_MANY_RETRIES,
+		}}})
+	}
+}
+
+func (ns *notificationService) WatchServerEvents(req *pb.WatchServerEventsRequest, stream pb.NotificationService_WatchServerEventsServer) error {
+	events, stop := ns.serverEvents.watch()
+	defer stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event := <-events:
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
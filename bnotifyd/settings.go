@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "../proto"
+)
+
+// readSettings reads & parses the settings file, resolving any secrets stored in separate files.
+func readSettings(filename string) (*pb.BNotifySettings, error) {
+	settings, err := readSettingsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if settings.ApiKey, err = readSecret(settings.ApiKey, settings.ApiKeyFile, "api_key"); err != nil {
+		return nil, err
+	}
+	if settings.Password, err = readSecret(settings.Password, settings.PasswordFile, "password"); err != nil {
+		return nil, err
+	}
+	if settings.AdminToken, err = readSecret(settings.AdminToken, settings.AdminTokenFile, "admin_token"); err != nil {
+		return nil, err
+	}
+	if settings.TotpSecret, err = readSecret(settings.TotpSecret, settings.TotpSecretFile, "totp_secret"); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// readSettingsFile reads & parses the settings file as written.
+func readSettingsFile(filename string) (*pb.BNotifySettings, error) {
+	settingsBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	settings := &pb.BNotifySettings{}
+	if err := proto.UnmarshalText(string(settingsBytes), settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// readSecret returns a secret setting, which is specified either inline (as
+// value) or as the name of a file containing the secret. Surrounding
+// whitespace is trimmed from secrets read from files.
+func readSecret(value, filename, name string) (string, error) {
+	if filename == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("only one of %s and %s_file may be set", name, name)
+	}
+	secret, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s_file: %v", name, err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// reloadSettingsOnSIGHUP re-reads the settings file whenever SIGHUP is
+// received, updating those settings which can be changed at runtime.
+func (ns *notificationService) reloadSettingsOnSIGHUP(filename string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Printf("Received SIGHUP, reloading settings")
+		reloaded := &pb.ServerEvent_ConfigReloaded{}
+		if err := ns.reloadSettings(filename); err != nil {
+			log.Printf("Could not reload settings: %v", err)
+			reloaded.Error = err.Error()
+		} else {
+			log.Printf("Reloaded settings")
+		}
+		ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_SettingsReloaded{SettingsReloaded: reloaded}})
+	}
+}
+
+// reloadSettings reads the settings file & applies those settings which may
+// change at runtime. If any setting is invalid, none are applied.
+func (ns *notificationService) reloadSettings(filename string) error {
+	settings, err := readSettings(filename)
+	if err != nil {
+		return err
+	}
+	validationRules, err := compileValidationRules(settings.ValidationRules)
+	if err != nil {
+		return err
+	}
+	localizer, err := newLocalizer(settings.Locale, settings.MessageOverrides)
+	if err != nil {
+		return err
+	}
+	enrichers, err := compileEnrichers(settings.Enrichers)
+	if err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.validationRules = validationRules
+	ns.localizer = localizer
+	ns.enrichers = enrichers
+	return nil
+}
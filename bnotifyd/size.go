@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	pb "../proto"
+)
+
+// maxPayloadSize is the maximum encoded size of a payload, in bytes, as
+// imposed by FCM's limit on data message size.
+const maxPayloadSize = 4096
+
+// payloadSizeBuckets are the upper bounds of the buckets used to summarize payload sizes.
+var payloadSizeBuckets = []float64{512, 1024, 2048, 3072, 3584, maxPayloadSize}
+
+// payloadSize returns the size of the given payload as counted against
+// maxPayloadSize, i.e. the size of the payload as sent to FCM. This is used
+// both to enforce the limit & to report sizes, so that the two agree.
+func payloadSize(payload []byte) int {
+	return base64.StdEncoding.EncodedLen(len(payload))
+}
+
+// maxNotificationPayloadSize returns an upper bound on the size, as counted by
+// payloadSize, of the payload enqueue would produce for the given
+// notification, whatever its sequence number, channel counter & enqueue
+// time. overhead is that of the cipher the payload is sealed with.
+func maxNotificationPayloadSize(n *pb.Notification, overhead int) (int, error) {
+	plaintextMessage, err := proto.Marshal(&pb.Message{
+		ServerId:     make([]byte, serverIDSize),
+		Seq:          math.MaxUint64,
+		Notification: n,
+		Ordering: &pb.OrderingToken{
+			Channel:     n.Category,
+			Counter:     math.MaxUint64,
+			EnqueueTime: &timestamp.Timestamp{Seconds: math.MaxInt64, Nanos: math.MaxInt32},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not marshal message proto: %v", err)
+	}
+	payload, err := proto.Marshal(&pb.Envelope{
+		Message: make([]byte, len(plaintextMessage)+overhead),
+		Nonce:   makeNonce(make([]byte, serverIDSize), math.MaxUint64),
+		Version: envelopeVersion,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not marshal envelope proto: %v", err)
+	}
+	return payloadSize(payload), nil
+}
+
+// payloadTooLargeError is returned when a notification's payload would exceed maxPayloadSize.
+type payloadTooLargeError struct {
+	size int
+}
+
+func (e payloadTooLargeError) Error() string {
+	return fmt.Sprintf("notification payload is %d bytes, which exceeds the maximum of %d bytes", e.size, maxPayloadSize)
+}
+
+// recordPayloadSize records the size of an enqueued payload in metrics &
+// status, warning if it exceeds the configured threshold.
+func (ns *notificationService) recordPayloadSize(size int) {
+	payloadSizeBytes.Observe(float64(size))
+	ns.payloadSizes.add(size)
+	if ns.sizeWarnBytes > 0 && size > ns.sizeWarnBytes {
+		log.Printf("Warning: payload is %d bytes, which exceeds the warning threshold of %d bytes (maximum is %d bytes)", size, ns.sizeWarnBytes, maxPayloadSize)
+	}
+}
+
+// sizeSummary counts sizes in the fixed buckets given by payloadSizeBuckets.
+type sizeSummary struct {
+	mu     sync.Mutex
+	counts []int64
+}
+
+func newSizeSummary() *sizeSummary {
+	return &sizeSummary{counts: make([]int64, len(payloadSizeBuckets))}
+}
+
+func (ss *sizeSummary) add(size int) {
+	i := sort.SearchFloat64s(payloadSizeBuckets, float64(size))
+	if i == len(payloadSizeBuckets) {
+		// Sizes larger than the largest bucket are never enqueued.
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.counts[i]++
+}
+
+func (ss *sizeSummary) buckets() []*pb.GetStatusResponse_SizeBucket {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var buckets []*pb.GetStatusResponse_SizeBucket
+	for i, max := range payloadSizeBuckets {
+		buckets = append(buckets, &pb.GetStatusResponse_SizeBucket{
+			MaxBytes: int64(max),
+			Count:    ss.counts[i],
+		})
+	}
+	return buckets
+}
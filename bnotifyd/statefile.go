@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	pb "../proto"
+)
+
+const (
+	// stateFileCheckInterval is how often state file statistics are updated.
+	stateFileCheckInterval = 5 * time.Minute
+
+	// defaultFreePageWarnRatio is the free_page_warn_ratio used if it is unset.
+	defaultFreePageWarnRatio = 1
+
+	// defaultBucketStatsInterval is the db_stats_interval_seconds used if it is unset.
+	defaultBucketStatsInterval = time.Minute
+)
+
+// stateFileStats returns page usage statistics of the state file, as seen by
+// the given transaction.
+func stateFileStats(db *bolt.DB, tx *bolt.Tx) *pb.GetStatusResponse_StateFileStats {
+	dbStats := db.Stats()
+	pageSize := int64(db.Info().PageSize)
+	return &pb.GetStatusResponse_StateFileStats{
+		SizeBytes:        tx.Size(),
+		PageSize:         pageSize,
+		PageCount:        tx.Size() / pageSize,
+		FreePageCount:    int64(dbStats.FreePageN),
+		PendingPageCount: int64(dbStats.PendingPageN),
+		FreelistBytes:    int64(dbStats.FreelistInuse),
+		TxCount:          int64(dbStats.TxN),
+		OpenTxCount:      int64(dbStats.OpenTxN),
+	}
+}
+
+// monitorStateFile periodically updates the state file metrics, logging a
+// warning when the proportion of free pages grows past warnRatio (e.g. due to
+// churn from many retries), since bolt never shrinks the file on its own.
+func monitorStateFile(db *bolt.DB, warnRatio float64) {
+	if warnRatio <= 0 {
+		warnRatio = defaultFreePageWarnRatio
+	}
+	warned := false
+	check := func() {
+		var stats *pb.GetStatusResponse_StateFileStats
+		if err := db.View(func(tx *bolt.Tx) error {
+			stats = stateFileStats(db, tx)
+			return nil
+		}); err != nil {
+			log.Printf("Error while checking state file: %v", err)
+			return
+		}
+		free := stats.FreePageCount + stats.PendingPageCount
+		used := stats.PageCount - free
+		stateFileSizeBytes.Set(float64(stats.SizeBytes))
+		stateFilePages.WithLabelValues("used").Set(float64(used))
+		stateFilePages.WithLabelValues("free").Set(float64(stats.FreePageCount))
+		stateFilePages.WithLabelValues("pending").Set(float64(stats.PendingPageCount))
+		stateFileFreelistBytes.Set(float64(stats.FreelistBytes))
+		stateFileTransactions.Set(float64(stats.TxCount))
+
+		// Only warn when the ratio is first exceeded, rather than at every check.
+		exceeded := used > 0 && float64(free)/float64(used) > warnRatio
+		if exceeded && !warned {
+			log.Printf("Warning: state file is %d bytes, of which %d of %d pages are free; consider compacting it (e.g. with bolt compact) while bnotifyd is stopped", stats.SizeBytes, free, stats.PageCount)
+		}
+		warned = exceeded
+	}
+
+	check()
+	for range time.Tick(stateFileCheckInterval) {
+		check()
+	}
+}
+
+// bucketStats returns usage statistics of each top-level bucket of the state
+// file, as seen by the given transaction. This reads every page of every
+// bucket, so it should not be called too often.
+func bucketStats(tx *bolt.Tx) []*pb.GetStatusResponse_StateFileStats_Bucket {
+	var buckets []*pb.GetStatusResponse_StateFileStats_Bucket
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		s := b.Stats()
+		buckets = append(buckets, &pb.GetStatusResponse_StateFileStats_Bucket{
+			Name:             string(name),
+			KeyCount:         int64(s.KeyN),
+			LeafInuseBytes:   int64(s.LeafInuse),
+			LeafAllocBytes:   int64(s.LeafAlloc),
+			BranchInuseBytes: int64(s.BranchInuse),
+			BranchAllocBytes: int64(s.BranchAlloc),
+		})
+		return nil
+	})
+	return buckets
+}
+
+// monitorBuckets updates the per-bucket state file metrics at the given
+// interval (or defaultBucketStatsInterval, if it is not positive).
+func monitorBuckets(db *bolt.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultBucketStatsInterval
+	}
+	check := func() {
+		var buckets []*pb.GetStatusResponse_StateFileStats_Bucket
+		if err := db.View(func(tx *bolt.Tx) error {
+			buckets = bucketStats(tx)
+			return nil
+		}); err != nil {
+			log.Printf("Error while checking state file buckets: %v", err)
+			return
+		}
+		for _, b := range buckets {
+			stateBucketKeys.WithLabelValues(b.Name).Set(float64(b.KeyCount))
+			stateBucketBytes.WithLabelValues(b.Name, "leaf", "inuse").Set(float64(b.LeafInuseBytes))
+			stateBucketBytes.WithLabelValues(b.Name, "leaf", "alloc").Set(float64(b.LeafAllocBytes))
+			stateBucketBytes.WithLabelValues(b.Name, "branch", "inuse").Set(float64(b.BranchInuseBytes))
+			stateBucketBytes.WithLabelValues(b.Name, "branch", "alloc").Set(float64(b.BranchAllocBytes))
+		}
+	}
+
+	check()
+	for range time.Tick(interval) {
+		check()
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+
+	pb "../proto"
+)
+
+// stateSettings are the settings which bnotifyd updates at runtime. For these,
+// the settings file is only a seed: once bnotifyd has stored a value in the
+// state file's settings bucket, the stored value takes precedence. bnotifyd
+// never writes the settings file, and all other settings are read only from
+// it.
+var stateSettings = []struct {
+	key   string // key in the settings bucket
+	field string // name of the field in the settings file
+	get   func(*pb.BNotifySettings) string
+	set   func(*pb.BNotifySettings, string)
+}{
+	{"registrationID", "registration_id", (*pb.BNotifySettings).GetRegistrationId, func(s *pb.BNotifySettings, v string) { s.RegistrationId = v }},
+}
+
+// applyStateSettings replaces state-authoritative settings with the values
+// stored in state, if any, returning the names of those settings whose value
+// in the settings file was overridden.
+func applyStateSettings(tx *bolt.Tx, settings *pb.BNotifySettings) []string {
+	settingsBucket := tx.Bucket([]byte("settings"))
+	if settingsBucket == nil {
+		return nil
+	}
+	var overridden []string
+	for _, s := range stateSettings {
+		stored := settingsBucket.Get([]byte(s.key))
+		if stored == nil || string(stored) == s.get(settings) {
+			continue
+		}
+		s.set(settings, string(stored))
+		overridden = append(overridden, s.field)
+	}
+	return overridden
+}
+
+// configExport writes the settings file, with state-authoritative settings
+// replaced by their values in state, to --output (or stdout). The result can
+// seed a new install. Secrets stored in separate files are left as references
+// to those files.
+func configExport() {
+	settingsPath, statePath, err := resolvePaths()
+	if err != nil {
+		log.Fatalf("Error resolving file locations: %v", err)
+	}
+	settings, err := readSettingsFile(settingsPath)
+	if err != nil {
+		log.Fatalf("Error reading settings file: %v", err)
+	}
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		log.Fatalf("Error opening state file (is bnotifyd running?): %v", err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *bolt.Tx) error {
+		for _, field := range applyStateSettings(tx, settings) {
+			log.Printf("Using %s stored in the state file", field)
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("Error reading state file: %v", err)
+	}
+
+	out := proto.MarshalTextString(settings)
+	if *output == "" {
+		fmt.Print(out)
+		return
+	}
+	if err := ioutil.WriteFile(*output, []byte(out), 0600); err != nil {
+		log.Fatalf("Error writing settings: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+func (ns *notificationService) GetNotificationStatus(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	seq := req.Seq
+	if req.NotificationId != "" {
+		_, idSeq, err := parseNotificationID(req.NotificationId)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		seq = idSeq
+	}
+	if seq == 0 {
+		return nil, status.Error(codes.InvalidArgument, "one of notification_id or seq is required")
+	}
+
+	var s pb.StatusResponse_Status
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = notificationStatus(tx, seq, req.NotificationId)
+		return err
+	}); err != nil {
+		log.Printf("Error while getting notification status: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return &pb.StatusResponse{Status: s}, nil
+}
+
+// notificationStatus determines the status of the message with the given
+// sequence number by checking, in order, the pending_messages,
+// sent_messages, delivered_messages, and dead_letter buckets. If id is
+// non-empty, records with a different notification ID are ignored.
+func notificationStatus(tx *bolt.Tx, seq uint64, id string) (pb.StatusResponse_Status, error) {
+	key := seqKey(seq)
+	for _, b := range []struct {
+		bucket string
+		status pb.StatusResponse_Status
+		id     func([]byte) (string, error)
+	}{
+		{"pending_messages", pb.StatusResponse_PENDING, func(v []byte) (string, error) {
+			pp := &pb.PendingPayload{}
+			err := proto.Unmarshal(v, pp)
+			return pp.NotificationId, err
+		}},
+		{"sent_messages", pb.StatusResponse_SENT, func(v []byte) (string, error) {
+			sm := &pb.SentMessage{}
+			err := proto.Unmarshal(v, sm)
+			return sm.NotificationId, err
+		}},
+		{"delivered_messages", pb.StatusResponse_ACKNOWLEDGED, func(v []byte) (string, error) {
+			sm := &pb.SentMessage{}
+			err := proto.Unmarshal(v, sm)
+			return sm.NotificationId, err
+		}},
+		{"dead_letter", pb.StatusResponse_FAILED, func(v []byte) (string, error) {
+			dl := &pb.DeadLetter{}
+			err := proto.Unmarshal(v, dl)
+			return dl.GetPendingPayload().GetNotificationId(), err
+		}},
+	} {
+		// Buckets that do not exist (e.g. delivered_messages, which is only
+		// created once acknowledgements are supported) are skipped.
+		bucket := tx.Bucket([]byte(b.bucket))
+		if bucket == nil {
+			continue
+		}
+		v := bucket.Get(key)
+		if v == nil {
+			continue
+		}
+		if id != "" {
+			recordID, err := b.id(v)
+			if err != nil {
+				return pb.StatusResponse_UNKNOWN, fmt.Errorf("could not unmarshal %s record: %v", b.bucket, err)
+			}
+			if recordID != "" && recordID != id {
+				continue
+			}
+		}
+		return b.status, nil
+	}
+	return pb.StatusResponse_UNKNOWN, nil
+}
+
+func (ns *notificationService) GetStatus(ctx context.Context, req *pb.GetStatusRequest) (*pb.GetStatusResponse, error) {
+	resp := &pb.GetStatusResponse{
+		PayloadSizes: ns.payloadSizes.buckets(),
+	}
+	if err := ns.db.View(func(tx *bolt.Tx) error {
+		messagesBucket := tx.Bucket([]byte("pending_messages"))
+		if messagesBucket == nil {
+			return errors.New("missing pending_messages bucket")
+		}
+		resp.PendingCount = int64(messagesBucket.Stats().KeyN)
+		resp.StateFile = stateFileStats(ns.db, tx)
+		resp.StateFile.Buckets = bucketStats(tx)
+		return ns.checkStatus(tx, resp)
+	}); err != nil {
+		log.Printf("Error while getting status: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if ns.replica != nil {
+		ns.replica.status(resp)
+	}
+	ns.quota.status(resp)
+	ns.breaker.status(resp)
+	return resp, nil
+}
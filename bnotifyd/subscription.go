@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "../proto"
+)
+
+// authSecretSize is the size of a WebPush subscription's authentication secret, per RFC 8291.
+const authSecretSize = 16
+
+func (ns *notificationService) RegisterPushSubscription(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	// Verify request.
+	if req.DeviceId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing device_id")
+	}
+	endpoint, err := url.Parse(req.EndpointUrl)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad endpoint_url: %v", err)
+	}
+	if endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, status.Error(codes.InvalidArgument, "endpoint_url must be an absolute https URL")
+	}
+	p256dhKey, err := decodeBase64(req.P256DhKey)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad p256dh_key: %v", err)
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), p256dhKey); x == nil {
+		return nil, status.Error(codes.InvalidArgument, "p256dh_key is not an uncompressed P-256 point")
+	}
+	authSecret, err := decodeBase64(req.AuthSecret)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad auth_secret: %v", err)
+	}
+	if len(authSecret) != authSecretSize {
+		return nil, status.Errorf(codes.InvalidArgument, "auth_secret must be %d bytes", authSecretSize)
+	}
+	registerTime, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		log.Printf("Error while registering push subscription: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	// Store subscription.
+	subBytes, err := proto.Marshal(&pb.PushSubscription{
+		DeviceId:     req.DeviceId,
+		EndpointUrl:  req.EndpointUrl,
+		P256DhKey:    p256dhKey,
+		AuthSecret:   authSecret,
+		RegisterTime: registerTime,
+	})
+	if err != nil {
+		log.Printf("Error while registering push subscription: could not marshal subscription: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		subscriptionsBucket := tx.Bucket([]byte("subscriptions"))
+		if subscriptionsBucket == nil {
+			return errors.New("missing subscriptions bucket")
+		}
+		return subscriptionsBucket.Put([]byte(req.DeviceId), subBytes)
+	}); err != nil {
+		log.Printf("Error while registering push subscription: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	log.Printf("Registered push subscription for device %q", req.DeviceId)
+	return &pb.RegisterResponse{}, nil
+}
+
+func (ns *notificationService) UnregisterPushSubscription(ctx context.Context, req *pb.UnregisterRequest) (*pb.UnregisterResponse, error) {
+	if req.DeviceId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing device_id")
+	}
+	found := false
+	if err := ns.db.Update(func(tx *bolt.Tx) error {
+		subscriptionsBucket := tx.Bucket([]byte("subscriptions"))
+		if subscriptionsBucket == nil {
+			return errors.New("missing subscriptions bucket")
+		}
+		found = subscriptionsBucket.Get([]byte(req.DeviceId)) != nil
+		if !found {
+			return nil
+		}
+		return subscriptionsBucket.Delete([]byte(req.DeviceId))
+	}); err != nil {
+		log.Printf("Error while unregistering push subscription: %v", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "no subscription for device %q", req.DeviceId)
+	}
+	log.Printf("Unregistered push subscription for device %q", req.DeviceId)
+	return &pb.UnregisterResponse{}, nil
+}
+
+// decodeBase64 decodes s, which may use either the standard or URL-safe
+// alphabet, with or without padding. Browsers produce URL-safe, unpadded
+// keys, but other clients may not.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+
+	pb "../proto"
+)
+
+// testModeSettings returns the settings used in --test-mode, in place of a
+// settings file. The password is random, since nothing needs to decrypt
+// the notifications.
+func testModeSettings() (*pb.BNotifySettings, error) {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, fmt.Errorf("could not generate password: %v", err)
+	}
+	return &pb.BNotifySettings{
+		ApiKey:         "test-mode",
+		RegistrationId: "test-mode",
+		Password:       hex.EncodeToString(password),
+	}, nil
+}
+
+// testModeStatePath creates a temporary directory for the --test-mode state
+// file, returning the directory (which the caller should remove) and the
+// state file's path.
+func testModeStatePath() (dir, statePath string, _ error) {
+	dir, err := ioutil.TempDir("", "bnotifyd-test")
+	if err != nil {
+		return "", "", err
+	}
+	return dir, filepath.Join(dir, "state.db"), nil
+}
+
+// startFakeFCM starts a local server implementing the legacy FCM send
+// endpoint, which accepts every well-formed message.
+func startFakeFCM() *httptest.Server {
+	var id uint64
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("registration_id") == "" {
+			fmt.Fprintln(w, "Error=MissingRegistration")
+			return
+		}
+		debugf("Fake FCM received message with %d bytes of data", len(r.PostFormValue("data.payload")))
+		fmt.Fprintf(w, "id=0:%d\n", atomic.AddUint64(&id, 1))
+	}))
+}
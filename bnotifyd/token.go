@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "../proto"
+)
+
+// tokenRefreshTimeout bounds a call to the token refresh webhook.
+const tokenRefreshTimeout = 30 * time.Second
+
+// errNotRegistered is returned by postPayloadToFCM when FCM reports that the
+// registration ID is no longer registered, e.g. because the app was
+// reinstalled or its data cleared.
+var errNotRegistered = errors.New("GCM error: NotRegistered")
+
+var invalidTokens = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "bnotify_invalid_tokens_total",
+	Help: "Number of registration IDs reported by FCM as no longer registered.",
+})
+
+func init() {
+	prometheus.MustRegister(invalidTokens)
+}
+
+// tokenMonitor tracks whether FCM has reported the current registration ID as
+// no longer registered. While it is, messages are held rather than sent.
+type tokenMonitor struct {
+	mu       sync.Mutex
+	invalid  string        // registration ID reported as not registered, if any
+	replaced chan struct{} // closed when the registration ID is replaced
+}
+
+func newTokenMonitor() *tokenMonitor {
+	return &tokenMonitor{replaced: make(chan struct{})}
+}
+
+// markInvalid records that the given registration ID is not registered,
+// returning true if it was not already known to be.
+func (tm *tokenMonitor) markInvalid(registrationID string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.invalid == registrationID {
+		return false
+	}
+	tm.invalid = registrationID
+	return true
+}
+
+// check returns true if the given registration ID is known not to be
+// registered, along with a channel closed once it is replaced.
+func (tm *tokenMonitor) check(registrationID string) (<-chan struct{}, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.replaced, registrationID != "" && tm.invalid == registrationID
+}
+
+// replace records that the registration ID has changed, waking any senders
+// waiting for it to.
+func (tm *tokenMonitor) replace() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.invalid = ""
+	close(tm.replaced)
+	tm.replaced = make(chan struct{})
+}
+
+// waitForRegistration blocks while the current registration ID is known not
+// to be registered. It returns false if the service began draining while
+// waiting.
+func (ns *notificationService) waitForRegistration() bool {
+	for {
+		replaced, invalid := ns.tokens.check(ns.creds().registrationID)
+		if !invalid {
+			return true
+		}
+		select {
+		case <-replaced:
+		case <-ns.stopping:
+			return false
+		}
+	}
+}
+
+// handleNotRegistered stops sends to the given registration ID, which FCM
+// reported as not registered, and asks the token refresh webhook (if any)
+// for a replacement.
+func (ns *notificationService) handleNotRegistered(registrationID string) {
+	if !ns.tokens.markInvalid(registrationID) {
+		return
+	}
+	invalidTokens.Inc()
+	ns.serverEvents.publish(&pb.ServerEvent{Event: &pb.ServerEvent_DeviceUnreachable{DeviceUnreachable: &pb.ServerEvent_NotRegistered{}}})
+	log.Printf("Warning: FCM reports that the registration ID is no longer registered (was the app reinstalled or its data cleared?); holding all messages until the registration ID is updated")
+	if ns.tokenRefreshURL != "" {
+		go ns.refreshToken(registrationID)
+	}
+}
+
+// refreshToken POSTs the given (unregistered) registration ID to the token
+// refresh webhook. If the webhook responds with a new registration ID, it
+// replaces the old one.
+func (ns *notificationService) refreshToken(oldRegistrationID string) {
+	newRegistrationID, err := callTokenRefreshWebhook(ns.tokenRefreshURL, oldRegistrationID)
+	if err != nil {
+		log.Printf("Warning: could not call token refresh webhook: %v", err)
+		return
+	}
+	if newRegistrationID == "" || newRegistrationID == oldRegistrationID {
+		log.Printf("Token refresh webhook returned no new registration ID; update it with UpdateRegistrationID")
+		return
+	}
+	count, err := ns.updateRegistrationID(newRegistrationID)
+	if err != nil {
+		log.Printf("Error while updating registration ID from token refresh webhook: %v", err)
+		return
+	}
+	log.Printf("Updated registration ID from token refresh webhook, re-encrypted %d pending message(s)", count)
+}
+
+// callTokenRefreshWebhook POSTs the given registration ID, as the form value
+// registration_id, to the given URL. It returns the response body, which is
+// either empty or a new registration ID.
+func callTokenRefreshWebhook(webhookURL, registrationID string) (string, error) {
+	client := &http.Client{Timeout: tokenRefreshTimeout}
+	resp, err := client.PostForm(webhookURL, url.Values{"registration_id": {registrationID}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLogResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("webhook HTTP error: %v", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
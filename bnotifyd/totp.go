@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// totpMetadataKey is the gRPC metadata key carrying a TOTP code.
+	totpMetadataKey = "x-totp-code"
+
+	// totpUsedCodeTTL is how long a code is remembered after use. Codes are
+	// accepted for one time step either side of the current one, so a code
+	// is valid for at most three 30-second steps.
+	totpUsedCodeTTL = 90 * time.Second
+)
+
+var totpValidateOpts = totp.ValidateOpts{
+	Period:    30,
+	Skew:      1,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// totpVerifier verifies TOTP codes, refusing codes which have already been
+// used so that an observed code cannot be replayed.
+type totpVerifier struct {
+	secret string
+
+	mu   sync.Mutex           // protects used
+	used map[string]time.Time // used codes, mapped to when they may be forgotten
+}
+
+func newTOTPVerifier(secret string) (*totpVerifier, error) {
+	if _, err := totp.GenerateCodeCustom(secret, time.Now(), totpValidateOpts); err != nil {
+		return nil, fmt.Errorf("bad totp_secret: %v", err)
+	}
+	return &totpVerifier{
+		secret: secret,
+		used:   map[string]time.Time{},
+	}, nil
+}
+
+// verify checks that code is currently valid & has not been used before,
+// then marks it as used.
+func (v *totpVerifier) verify(code string) error {
+	now := time.Now()
+	valid, err := totp.ValidateCustom(code, v.secret, now.UTC(), totpValidateOpts)
+	if err != nil || !valid {
+		return errors.New("incorrect TOTP code")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for c, expireTime := range v.used {
+		if now.After(expireTime) {
+			delete(v.used, c)
+		}
+	}
+	if _, ok := v.used[code]; ok {
+		return errors.New("TOTP code has already been used")
+	}
+	v.used[code] = now.Add(totpUsedCodeTTL)
+	return nil
+}
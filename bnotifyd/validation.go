@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+
+	pb "../proto"
+)
+
+// validationRule is a compiled form of a ValidationRule from the settings.
+type validationRule struct {
+	field pb.ValidationRule_Field
+	desc  string
+	check func(string) bool // returns true if the field value satisfies the rule
+}
+
+func compileValidationRules(rules []*pb.ValidationRule) ([]validationRule, error) {
+	var compiled []validationRule
+	for i, rule := range rules {
+		if rule.Field != pb.ValidationRule_TITLE && rule.Field != pb.ValidationRule_TEXT {
+			return nil, fmt.Errorf("validation rule %d: unknown field %v", i, rule.Field)
+		}
+		vr := validationRule{field: rule.Field}
+		switch rule.RuleType {
+		case pb.ValidationRule_MAX_LENGTH:
+			maxLen, err := strconv.Atoi(rule.Value)
+			if err != nil || maxLen < 0 {
+				return nil, fmt.Errorf("validation rule %d: bad maximum length %q", i, rule.Value)
+			}
+			vr.desc = fmt.Sprintf("%s must be at most %d characters", fieldName(rule.Field), maxLen)
+			vr.check = func(v string) bool { return utf8.RuneCountInString(v) <= maxLen }
+
+		case pb.ValidationRule_REGEX:
+			re, err := regexp.Compile(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("validation rule %d: bad regex: %v", i, err)
+			}
+			vr.desc = fmt.Sprintf("%s must match %q", fieldName(rule.Field), rule.Value)
+			vr.check = re.MatchString
+
+		case pb.ValidationRule_BAN_LIST:
+			var banned []string
+			for _, word := range strings.Split(rule.Value, ",") {
+				if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+					banned = append(banned, word)
+				}
+			}
+			vr.desc = fmt.Sprintf("%s must not contain banned words", fieldName(rule.Field))
+			vr.check = func(v string) bool {
+				v = strings.ToLower(v)
+				for _, word := range banned {
+					if strings.Contains(v, word) {
+						return false
+					}
+				}
+				return true
+			}
+
+		default:
+			return nil, fmt.Errorf("validation rule %d: unknown rule type %v", i, rule.RuleType)
+		}
+		compiled = append(compiled, vr)
+	}
+	return compiled, nil
+}
+
+// validate checks the given notification against the given rules, returning
+// an InvalidArgument error listing every failed rule.
+func validate(rules []validationRule, n *pb.Notification) error {
+	var failures []string
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, rule := range rules {
+		v := n.Title
+		if rule.field == pb.ValidationRule_TEXT {
+			v = n.Text
+		}
+		if !rule.check(v) {
+			failures = append(failures, rule.desc)
+			violations = append(violations, fieldViolation("notification."+fieldName(rule.field), rule.desc))
+		}
+	}
+	if len(failures) > 0 {
+		return badRequest(fmt.Sprintf("notification failed validation: %s", strings.Join(failures, "; ")), violations...)
+	}
+	return nil
+}
+
+func fieldName(field pb.ValidationRule_Field) string {
+	return strings.ToLower(field.String())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// vapidKeyName is the key in the settings bucket under which the DER-encoded
+// VAPID private key is stored.
+const vapidKeyName = "vapid_private_key"
+
+// generateVAPIDKey generates a VAPID key pair & stores it in the state file,
+// unless one is already present. Either way, the public key is printed.
+func generateVAPIDKey() {
+	_, statePath, err := resolvePaths()
+	if err != nil {
+		log.Fatalf("Error resolving file locations: %v", err)
+	}
+	if err := prepareStateDir(statePath); err != nil {
+		log.Fatalf("Error preparing state directory: %v", err)
+	}
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("Error opening state file (is bnotifyd running?): %v", err)
+	}
+	defer db.Close()
+
+	var key *ecdsa.PrivateKey
+	if err := db.Update(func(tx *bolt.Tx) error {
+		settingsBucket, err := tx.CreateBucketIfNotExists([]byte("settings"))
+		if err != nil {
+			return fmt.Errorf("could not create settings bucket: %v", err)
+		}
+		if der := settingsBucket.Get([]byte(vapidKeyName)); der != nil {
+			log.Printf("VAPID key already exists; using existing key")
+			key, err = x509.ParseECPrivateKey(der)
+			if err != nil {
+				return fmt.Errorf("could not parse stored VAPID key: %v", err)
+			}
+			return nil
+		}
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("could not generate VAPID key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("could not marshal VAPID key: %v", err)
+		}
+		if err := settingsBucket.Put([]byte(vapidKeyName), der); err != nil {
+			return fmt.Errorf("could not store VAPID key: %v", err)
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("Error generating VAPID key: %v", err)
+	}
+	fmt.Println(vapidPublicKey(key))
+}
+
+// showVAPIDPublicKey prints the public key corresponding to the VAPID private
+// key in the state file.
+func showVAPIDPublicKey() {
+	_, statePath, err := resolvePaths()
+	if err != nil {
+		log.Fatalf("Error resolving file locations: %v", err)
+	}
+	db, err := bolt.Open(statePath, 0640, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		log.Fatalf("Error opening state file: %v", err)
+	}
+	defer db.Close()
+
+	var key *ecdsa.PrivateKey
+	if err := db.View(func(tx *bolt.Tx) error {
+		settingsBucket := tx.Bucket([]byte("settings"))
+		if settingsBucket == nil {
+			return errors.New("missing settings bucket")
+		}
+		der := settingsBucket.Get([]byte(vapidKeyName))
+		if der == nil {
+			return errors.New("no VAPID key (use generate-vapid-key to create one)")
+		}
+		key, err = x509.ParseECPrivateKey(der)
+		if err != nil {
+			return fmt.Errorf("could not parse stored VAPID key: %v", err)
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("Error reading VAPID key: %v", err)
+	}
+	fmt.Println(vapidPublicKey(key))
+}
+
+// vapidPublicKey returns the public half of the given key as an uncompressed
+// point, URL-safe-base64-encoded without padding, as expected for a web app's
+// applicationServerKey.
+func vapidPublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "../proto"
+)
+
+const (
+	// webhookPayloadVersion is the version of the JSON documents POSTed to
+	// webhooks, documented on WebhookSink. It must be bumped whenever a field
+	// is removed or changes meaning.
+	webhookPayloadVersion = 1
+
+	// defaultWebhookTimeout is the webhook request timeout used if timeout_seconds is unset.
+	defaultWebhookTimeout = 10 * time.Second
+
+	// webhookAttempts is the number of times a webhook request is attempted.
+	webhookAttempts = 3
+
+	// webhookSignatureHeader is the header carrying a webhook request's signature.
+	webhookSignatureHeader = "X-Bnotify-Signature"
+
+	// webhookQueueSize is the number of events queued for each webhook.
+	webhookQueueSize = 256
+)
+
+var webhookEventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "bnotify_webhook_events_dropped_total",
+	Help: "Number of events not sent to a webhook because its queue was full, by webhook (URL without query).",
+}, []string{"webhook"})
+
+func init() {
+	prometheus.MustRegister(webhookEventsDropped)
+}
+
+// webhookEvents are the events which may be sent to webhooks.
+var webhookEvents = map[string]bool{
+	"sent":               true,
+	"dead_lettered":      true,
+	"device_unreachable": true,
+}
+
+// webhookPayload is the JSON document POSTed to webhooks.
+type webhookPayload struct {
+	Version        int    `json:"version"`
+	Event          string `json:"event"`
+	Time           string `json:"time"`
+	Seq            uint64 `json:"seq,omitempty"`
+	NotificationID string `json:"notification_id,omitempty"`
+	SendAttempts   int32  `json:"send_attempts,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+func validateWebhooks(sinks []*pb.WebhookSink) error {
+	for _, s := range sinks {
+		u, err := url.Parse(s.Url)
+		if err != nil {
+			return fmt.Errorf("webhook %q: bad url: %v", s.Url, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q: url must be an absolute http or https URL", s.Url)
+		}
+		for _, e := range s.Events {
+			if !webhookEvents[e] {
+				return fmt.Errorf("webhook %q: unknown event %q", s.Url, e)
+			}
+		}
+		if s.TimeoutSeconds < 0 {
+			return fmt.Errorf("webhook %q: timeout_seconds must not be negative", s.Url)
+		}
+	}
+	return nil
+}
+
+// webhookPayloadFor returns the webhook payload for the given server event,
+// or nil if the event is not sent to webhooks.
+func webhookPayloadFor(event *pb.ServerEvent) *webhookPayload {
+	p := &webhookPayload{Version: webhookPayloadVersion}
+	if t, err := ptypes.Timestamp(event.Time); err == nil {
+		p.Time = t.UTC().Format(time.RFC3339Nano)
+	}
+	switch e := event.Event.(type) {
+	case *pb.ServerEvent_Sent:
+		p.Event = "sent"
+		p.Seq, p.NotificationID, p.SendAttempts = e.Sent.Seq, e.Sent.NotificationId, e.Sent.SendAttempts
+	case *pb.ServerEvent_Failed:
+		p.Event = "dead_lettered"
+		p.Seq, p.NotificationID, p.Reason = e.Failed.Seq, e.Failed.NotificationId, e.Failed.Reason.String()
+	case *pb.ServerEvent_DeviceUnreachable:
+		p.Event = "device_unreachable"
+	default:
+		return nil
+	}
+	return p
+}
+
+// webhookFilter returns a function reporting whether a server event is sent
+// to the given webhook.
+func webhookFilter(sink *pb.WebhookSink) func(*pb.ServerEvent) bool {
+	filter := map[string]bool{}
+	for _, e := range sink.Events {
+		filter[e] = true
+	}
+	return func(event *pb.ServerEvent) bool {
+		p := webhookPayloadFor(event)
+		return p != nil && (len(filter) == 0 || filter[p.Event])
+	}
+}
+
+// watchWebhook returns the queue of future server events for the given
+// webhook. Only events sent to the webhook are queued, so others never take
+// up space; if the webhook falls behind, events are dropped (& counted)
+// rather than delaying sends.
+func watchWebhook(b *serverEventBroadcaster, sink *pb.WebhookSink) <-chan *pb.ServerEvent {
+	label := sink.Url
+	if u, err := url.Parse(sink.Url); err == nil {
+		u.RawQuery, u.User = "", nil
+		label = u.String()
+	}
+	dropped := webhookEventsDropped.WithLabelValues(label)
+	events, _ := b.watchQueue(webhookQueueSize, serverEventWatcher{
+		filter:  webhookFilter(sink),
+		dropped: dropped.Inc,
+	})
+	return events
+}
+
+// runWebhook POSTs server events from the given queue (from watchWebhook) to
+// the given webhook, forever.
+func runWebhook(sink *pb.WebhookSink, events <-chan *pb.ServerEvent) {
+	timeout := time.Duration(sink.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	for event := range events {
+		p := webhookPayloadFor(event)
+		body, err := json.Marshal(p)
+		if err != nil {
+			log.Printf("Error while marshaling webhook payload: %v", err)
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err := callWebhook(client, sink, body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("Warning: could not call webhook %q for %s event, giving up: %v", sink.Url, p.Event, err)
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+// callWebhook POSTs the given body to the webhook, signing it if the webhook
+// has a secret.
+func callWebhook(client *http.Client, sink *pb.WebhookSink, body []byte) error {
+	req, err := http.NewRequest("POST", sink.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sink.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sink.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxLogResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook HTTP error: %v", resp.Status)
+	}
+	return nil
+}
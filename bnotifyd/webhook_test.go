@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"go.uber.org/goleak"
+
+	pb "../proto"
+)
+
+var updateGoldens = flag.Bool("update", false, "rewrite the golden files in testdata/webhook")
+
+// webhookTestEvents are server events sent to webhooks, by the name of their
+// golden file in testdata/webhook.
+func webhookTestEvents(t *testing.T) map[string]*pb.ServerEvent {
+	ts, err := ptypes.TimestampProto(time.Date(2026, 1, 2, 3, 4, 5, 6000000, time.UTC))
+	if err != nil {
+		t.Fatalf("Could not convert time: %v", err)
+	}
+	return map[string]*pb.ServerEvent{
+		"sent.json": {Time: ts, Event: &pb.ServerEvent_Sent{Sent: &pb.ServerEvent_NotificationSent{
+			Seq: 42, NotificationId: "n-42", SendAttempts: 3,
+		}}},
+		"dead_lettered.json": {Time: ts, Event: &pb.ServerEvent_Failed{Failed: &pb.ServerEvent_NotificationFailed{
+			Seq: 43, NotificationId: "n-43", Reason: pb.DeadLetter_TOO_MANY_RETRIES,
+		}}},
+		"device_unreachable.json": {Time: ts, Event: &pb.ServerEvent_DeviceUnreachable{DeviceUnreachable: &pb.ServerEvent_NotRegistered{}}},
+	}
+}
+
+func TestWebhookPayloadGoldens(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for name, event := range webhookTestEvents(t) {
+		p := webhookPayloadFor(event)
+		if p == nil {
+			t.Errorf("%s: webhookPayloadFor = nil, want payload", name)
+			continue
+		}
+		got, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("%s: could not marshal payload: %v", name, err)
+		}
+		got = append(got, '\n')
+		path := filepath.Join("testdata", "webhook", name)
+		if *updateGoldens {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatalf("Could not write golden: %v", err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Could not read golden: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: payload = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestWebhookPayloadForOtherEvents(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, event := range []*pb.ServerEvent{
+		{Event: &pb.ServerEvent_Queued{Queued: &pb.ServerEvent_NotificationQueued{Seq: 1}}},
+		{Event: &pb.ServerEvent_GcmError{GcmError: &pb.ServerEvent_GCMError{Seq: 1, Error: "GCM error: Unavailable"}}},
+		{Event: &pb.ServerEvent_SettingsReloaded{SettingsReloaded: &pb.ServerEvent_ConfigReloaded{}}},
+		{},
+	} {
+		if p := webhookPayloadFor(event); p != nil {
+			t.Errorf("webhookPayloadFor(%v) = %+v, want nil", event, p)
+		}
+	}
+}
+
+func TestWebhookQueueHoldsOnlyMatchingEvents(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	events := webhookTestEvents(t)
+	b := newServerEventBroadcaster()
+	var dropped int
+	queue, stop := b.watchQueue(2, serverEventWatcher{
+		filter:  webhookFilter(&pb.WebhookSink{Url: "https://example.com/hook", Events: []string{"dead_lettered"}}),
+		dropped: func() { dropped++ },
+	})
+	defer stop()
+
+	// Events the webhook is not sent must not take up its queue.
+	for i := 0; i < 10*eventBufferSize; i++ {
+		b.publish(&pb.ServerEvent{Event: &pb.ServerEvent_Queued{Queued: &pb.ServerEvent_NotificationQueued{Seq: uint64(i)}}})
+		b.publish(events["sent.json"])
+	}
+	if len(queue) != 0 || dropped != 0 {
+		t.Fatalf("After unmatched events: queued %d, dropped %d; want 0, 0", len(queue), dropped)
+	}
+
+	for i := 0; i < 3; i++ {
+		b.publish(events["dead_lettered.json"])
+	}
+	if len(queue) != 2 || dropped != 1 {
+		t.Errorf("After 3 matching events: queued %d, dropped %d; want 2, 1", len(queue), dropped)
+	}
+}